@@ -0,0 +1,87 @@
+package hub
+
+// sendResult tells what happened to a message sent to a Conn.
+type sendResult int
+
+const (
+	sent sendResult = iota
+	// aborted means the connection was aborted while the message was being sent.
+	aborted
+	// connClosed means the consumer has closed the Conn.
+	connClosed
+)
+
+// trySend sends the message to the Conn, unless the connection is aborted meanwhile
+// or the Conn was closed by the consumer, which would otherwise make the Hub panic.
+// A consumer that is ready always receives the message, even if the connection is
+// already aborted.
+func trySend[T any](c ConnOf[T], msg T, abort <-chan struct{}) (result sendResult) {
+	defer func() {
+		if recover() != nil {
+			result = connClosed
+		}
+	}()
+
+	select {
+	case c <- msg:
+		return sent
+	default:
+	}
+
+	select {
+	case c <- msg:
+		return sent
+	case <-abort:
+		return aborted
+	}
+}
+
+// tryClose closes the Conn, unless the consumer has already closed it.
+func tryClose[T any](c ConnOf[T]) {
+	defer func() {
+		_ = recover()
+	}()
+
+	close(c)
+}
+
+// abort tells the Hub to remove the connection for the given reason, without waiting
+// for the Hub. Only the first reason is kept.
+func (ref *connRefCount[T]) abort(reason CloseReason) {
+	ref.abortOnce.Do(func() {
+		ref.abortReason = reason
+		close(ref.aborted)
+	})
+}
+
+// supervise starts the goroutine that removes the connection from the Hub after it is
+// aborted, or after the consumer leaves using its Status.
+func (m *manager[T]) supervise(c ConnOf[T], ref *connRefCount[T]) {
+	if ref.removed != nil {
+		return
+	}
+	ref.removed = make(chan struct{})
+
+	var left <-chan struct{}
+	if ref.status != nil {
+		left = ref.status.left()
+	}
+
+	go func() {
+		select {
+		case <-left:
+			ref.abort(ReasonLeft)
+		case <-ref.aborted:
+		case <-m.stopped:
+			return
+		case <-ref.removed:
+			return
+		}
+
+		select {
+		case m.cancels <- cancellation[T]{conn: c, ref: ref}:
+		case <-m.stopped:
+		case <-ref.removed:
+		}
+	}()
+}
@@ -0,0 +1,213 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// DeliveryOf is sent to a Conn that was connected with Ack set, instead of the message.
+	// The Conn must acknowledge each delivery using Ack, or the message is delivered again
+	// once the connection's AckTimeout elapses, or immediately if Nack is called.
+	DeliveryOf[T any] struct {
+		EnvelopeOf[T]
+		// The number of times the message was delivered to the Conn, including this one.
+		Attempt int
+
+		p       *pending[T]
+		acks    *acker[T]
+		attempt int
+	}
+
+	// pending is a message delivered to a connection in ack mode which wasn't acknowledged yet.
+	pending[T any] struct {
+		conn    ConnOf[T]
+		ref     *connRefCount[T]
+		topic   Topic
+		entry   entry[T]
+		attempt int
+		timer   *time.Timer
+	}
+
+	ackKind int
+
+	ackResult[T any] struct {
+		p       *pending[T]
+		attempt int
+		kind    ackKind
+	}
+
+	// acker collects the acknowledgements and the expired deliveries until the Hub handles them.
+	// Acknowledging never blocks, as the Hub could be waiting itself for the Conn to receive.
+	acker[T any] struct {
+		mu      sync.Mutex
+		results []ackResult[T]
+		closed  bool
+		wake    chan struct{}
+	}
+)
+
+const (
+	acked ackKind = iota
+	nacked
+	expired
+)
+
+// DefaultAckTimeout is the time a Conn in ack mode has to acknowledge a message when no
+// AckTimeout is specified.
+const DefaultAckTimeout = 30 * time.Second
+
+// Ack tells the Hub that the message was processed. Acknowledging any delivery of a message
+// settles it, even if it was delivered again meanwhile. Calls after the first have no effect.
+func (d *DeliveryOf[T]) Ack() {
+	d.acks.push(ackResult[T]{p: d.p, attempt: d.attempt, kind: acked})
+}
+
+// Nack tells the Hub that the message couldn't be processed, so it is delivered again
+// immediately. It has no effect if the message was already acknowledged or delivered again.
+func (d *DeliveryOf[T]) Nack() {
+	d.acks.push(ackResult[T]{p: d.p, attempt: d.attempt, kind: nacked})
+}
+
+func newAcker[T any]() *acker[T] {
+	return &acker[T]{wake: make(chan struct{}, 1)}
+}
+
+func (a *acker[T]) push(r ackResult[T]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	a.results = append(a.results, r)
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *acker[T]) take() []ackResult[T] {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	results := a.results
+	a.results = nil
+
+	return results
+}
+
+func (a *acker[T]) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	a.results = nil
+}
+
+// transmit sends the pending message to its connection and waits for the acknowledgement.
+// It returns false if the message was not delivered because of the connection's policy.
+func (m *manager[T]) transmit(p *pending[T]) bool {
+	d := &DeliveryOf[T]{
+		EnvelopeOf: p.ref.envelopeFor(p.topic, &p.entry),
+		Attempt:    p.attempt + 1,
+		p:          p,
+		acks:       m.acks,
+		attempt:    p.attempt + 1,
+	}
+	// unacknowledged messages are delivered again, so they aren't dead-lettered if dropped
+	if !m.send(p.conn, p.ref, interface{}(d).(T), nil) {
+		return false
+	}
+
+	p.attempt++
+	p.ref.pending[p] = struct{}{}
+	m.expire(p)
+
+	return true
+}
+
+// expire starts the timer after which the message is delivered again.
+func (m *manager[T]) expire(p *pending[T]) {
+	attempt := p.attempt
+	p.timer = time.AfterFunc(p.ref.ackTimeout, func() {
+		m.acks.push(ackResult[T]{p: p, attempt: attempt, kind: expired})
+	})
+}
+
+// settle handles the acknowledgements and the expired deliveries.
+func (m *manager[T]) settle() {
+	for _, r := range m.acks.take() {
+		p := r.p
+		if _, ok := p.ref.pending[p]; !ok || (r.kind != acked && r.attempt != p.attempt) {
+			continue
+		}
+
+		p.timer.Stop()
+
+		switch {
+		case r.kind == acked:
+			delete(p.ref.pending, p)
+			m.commitSettled(p)
+		case p.ref.maxAttempts > 0 && p.attempt >= p.ref.maxAttempts:
+			delete(p.ref.pending, p)
+			m.deadLetter(&p.entry, []Topic{p.entry.topic}, MaxAttemptsExceeded, p.attempt)
+			m.commitSettled(p)
+		default:
+			m.redeliver(p)
+		}
+	}
+}
+
+// redeliver sends the message again to its connection. If the connection was removed
+// meanwhile, the message is forgotten.
+func (m *manager[T]) redeliver(p *pending[T]) {
+	if m.conns[p.conn] != p.ref {
+		delete(p.ref.pending, p)
+		return
+	}
+
+	if m.transmit(p) || m.conns[p.conn] != p.ref {
+		return
+	}
+
+	if p.ref.queue.policy == DisconnectOnFull {
+		m.removeConn(p.conn, ReasonQueueFull)
+	} else {
+		m.expire(p)
+	}
+}
+
+// commitSettled advances the position of the connection's durable subscription up to
+// the last message settled from the topic before the first one that isn't.
+func (m *manager[T]) commitSettled(p *pending[T]) {
+	ref := p.ref
+	if d := ref.durable; d == nil || d.manual {
+		return
+	}
+
+	if ref.acked == nil {
+		ref.acked = map[Topic]uint64{}
+	}
+	if p.entry.seq > ref.acked[p.topic] {
+		ref.acked[p.topic] = p.entry.seq
+	}
+
+	seq := ref.acked[p.topic]
+	for q := range ref.pending {
+		if q.topic == p.topic && q.entry.seq <= seq {
+			seq = q.entry.seq - 1
+		}
+	}
+
+	m.commit(ref.durable, p.topic, seq, false)
+}
+
+// stopPending stops the timers of the connection's unacknowledged messages, which
+// won't be delivered again. They can still be acknowledged.
+func (ref *connRefCount[T]) stopPending() {
+	for p := range ref.pending {
+		p.timer.Stop()
+	}
+}
@@ -0,0 +1,117 @@
+package hub
+
+import "time"
+
+type (
+	// DeadLetterReason tells why a message was dead-lettered.
+	DeadLetterReason int
+
+	// DeadLetterOf is published to the dead-letter topic set using WithDeadLetter for each
+	// message that couldn't be delivered.
+	DeadLetterOf[T any] struct {
+		Message T
+		Reason  DeadLetterReason
+		// The topics the message was published to. If the message couldn't be delivered to a Conn,
+		// it is only the topic the Conn received it from.
+		Topics []Topic
+		// The sequence number the Hub assigned to the message.
+		Sequence uint64
+		// The time the Hub received the message at.
+		Time time.Time
+		// The time the message was dead-lettered at.
+		Failed time.Time
+		// The number of times the message was delivered to the Conn, if it was in ack mode.
+		Attempts int
+	}
+
+	// DeadLetter is the DeadLetterOf published by a Hub.
+	DeadLetter = DeadLetterOf[interface{}]
+)
+
+const (
+	// MaxAttemptsExceeded is the reason for messages that a Conn in ack mode didn't acknowledge
+	// after MaxAttempts deliveries.
+	MaxAttemptsExceeded DeadLetterReason = iota + 1
+	// ConnFull is the reason for messages dropped because of a Conn's Policy.
+	ConnFull
+	// NoSubscribers is the reason for messages published to topics with no connections.
+	// Messages that are retained or kept in a history are not dead-lettered.
+	NoSubscribers
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case MaxAttemptsExceeded:
+		return "max attempts exceeded"
+	case ConnFull:
+		return "connection full"
+	case NoSubscribers:
+		return "no subscribers"
+	default:
+		return "unknown"
+	}
+}
+
+// WithDeadLetter sets the topic to which the messages that couldn't be delivered are published,
+// wrapped in a DeadLetterOf. Configure a history for the topic using ConfigureTopics if you want
+// to replay the dead letters published while no Conn was connected to it. Messages published
+// to the dead-letter topic itself are never dead-lettered.
+//
+// As the dead letters are messages of the Hub, the Hub panics when it starts if T isn't
+// an interface type.
+func WithDeadLetter(t Topic) Option {
+	return func(o *options) {
+		o.deadLetter, o.deadLetters = t, true
+	}
+}
+
+// deadLetter queues the message to be published to the dead-letter topic, if there is one.
+func (m *manager[T]) deadLetter(e *entry[T], topics []Topic, reason DeadLetterReason, attempts int) {
+	if !m.opts.deadLetters {
+		return
+	}
+	for _, t := range topics {
+		// replies that arrive after the requester has given up are expected
+		if _, ok := t.(inbox); ok || t == m.opts.deadLetter || (m.opts.systemEvents && t == m.opts.systemTopic) {
+			return
+		}
+	}
+
+	m.dead = append(m.dead, interface{}(DeadLetterOf[T]{
+		Message:  e.msg,
+		Reason:   reason,
+		Topics:   topics,
+		Sequence: e.seq,
+		Time:     e.time,
+		Failed:   time.Now(),
+		Attempts: attempts,
+	}).(T))
+}
+
+// publishDeadLetters publishes the queued dead letters. They are not published as soon as
+// they are created, so the Hub doesn't deliver messages while it is delivering another one.
+func (m *manager[T]) publishDeadLetters() {
+	for len(m.dead) > 0 {
+		msg := m.dead[0]
+		m.dead = m.dead[1:]
+		m.message(&MessageOf[T]{Message: msg, Topics: []Topic{m.opts.deadLetter}})
+	}
+	m.dead = nil
+}
+
+// subscribed reports whether a message published to the given topic is delivered to
+// a connection or kept for later ones.
+func (m *manager[T]) subscribed(t Topic, retain bool) bool {
+	return retain || m.connected(t) || m.config(t).keepsHistory()
+}
+
+// connected reports whether any connection receives the messages published to the given
+// topic, either directly or through a Pattern.
+func (m *manager[T]) connected(t Topic) bool {
+	if len(m.topics[t]) > 0 {
+		return true
+	}
+
+	s, ok := t.(string)
+	return ok && len(m.patterns.match(s)) > 0
+}
@@ -0,0 +1,141 @@
+package hub
+
+import "time"
+
+type (
+	// Offsets are the committed positions of a durable subscription. For each topic the
+	// subscription is connected to, they hold the sequence number of the last message
+	// consumed from it. Topics are either string topics or patterns.
+	Offsets struct {
+		Topics   map[string]uint64 `json:"topics,omitempty"`
+		Patterns map[string]uint64 `json:"patterns,omitempty"`
+	}
+
+	// OffsetStore is implemented by the Stores that can also save the offsets of durable
+	// subscriptions. If the Hub's Store doesn't implement it, the offsets are kept only
+	// in memory, so they are lost when the Hub is restarted.
+	OffsetStore interface {
+		// SaveOffsets replaces the offsets saved for the durable subscription with the given name.
+		SaveOffsets(name string, offsets Offsets) error
+		// LoadOffsets returns the offsets saved for the durable subscription with the given name.
+		// If there are none, it returns empty offsets.
+		LoadOffsets(name string) (Offsets, error)
+	}
+
+	// durable is the state of a durable subscription.
+	durable struct {
+		name      string
+		positions map[Topic]uint64
+		manual    bool
+		dirty     bool
+		saved     time.Time
+	}
+)
+
+// durableSaveInterval is the minimum time between two saves of automatically committed offsets.
+const durableSaveInterval = time.Second
+
+func (o *Offsets) positions() map[Topic]uint64 {
+	positions := map[Topic]uint64{}
+	for t, seq := range o.Topics {
+		positions[t] = seq
+	}
+	for p, seq := range o.Patterns {
+		positions[Pattern(p)] = seq
+	}
+	return positions
+}
+
+func (d *durable) offsets() Offsets {
+	o := Offsets{Topics: map[string]uint64{}, Patterns: map[string]uint64{}}
+	for t, seq := range d.positions {
+		switch v := t.(type) {
+		case string:
+			o.Topics[v] = seq
+		case Pattern:
+			o.Patterns[string(v)] = seq
+		}
+	}
+	return o
+}
+
+// durable returns the state of the durable subscription with the given name,
+// loading its offsets from the Store the first time it is used.
+func (m *manager[T]) durable(name string, manual bool) *durable {
+	d, ok := m.durables[name]
+	if !ok {
+		d = &durable{name: name, positions: map[Topic]uint64{}}
+
+		if s, ok := m.opts.store.(OffsetStore); ok {
+			if o, err := s.LoadOffsets(name); err != nil {
+				m.fail(err)
+			} else {
+				d.positions = o.positions()
+			}
+		}
+
+		if m.durables == nil {
+			m.durables = map[string]*durable{}
+		}
+		m.durables[name] = d
+	}
+
+	d.manual = manual
+
+	return d
+}
+
+// commit advances the position of the durable subscription in the given topic.
+// The offsets are saved immediately if force is true, otherwise at most once
+// every durableSaveInterval.
+func (m *manager[T]) commit(d *durable, t Topic, seq uint64, force bool) {
+	if seq <= d.positions[t] {
+		return
+	}
+
+	d.positions[t] = seq
+	d.dirty = true
+
+	if force || time.Since(d.saved) >= durableSaveInterval {
+		m.saveOffsets(d)
+	}
+}
+
+func (m *manager[T]) saveOffsets(d *durable) {
+	s, ok := m.opts.store.(OffsetStore)
+	if !ok || !d.dirty {
+		return
+	}
+
+	if err := s.SaveOffsets(d.name, d.offsets()); err != nil {
+		m.fail(err)
+		return
+	}
+
+	d.dirty = false
+	d.saved = time.Now()
+}
+
+func (m *manager[T]) commitExplicit(c *Commit) {
+	d, ok := m.durables[c.Name]
+	if !ok {
+		d = m.durable(c.Name, true)
+	}
+
+	for _, t := range getTopics(c.Topics, true) {
+		m.commit(d, t, c.Sequence, true)
+	}
+}
+
+// resume sends to the connection the messages it missed from the topic of its durable
+// subscription, if it has consumed from the topic before. It returns false otherwise.
+func (m *manager[T]) resume(t Topic, c ConnOf[T], d *durable) bool {
+	seq, ok := d.positions[t]
+	if !ok {
+		return false
+	}
+
+	m.replay(t, c, 0, seq)
+
+	return true
+}
@@ -0,0 +1,177 @@
+package hub
+
+import "fmt"
+
+type (
+	// EventKind is the kind of a lifecycle event.
+	EventKind int
+
+	// CloseReason tells why the Hub removed a Conn.
+	CloseReason int
+
+	// EventOf is a lifecycle event of a Hub. Set a handler for the events using OnEvent,
+	// or a topic to which they are published using WithSystemTopic.
+	EventOf[T any] struct {
+		Kind EventKind
+		// The topic the event is about. It is nil for ConnClosed events.
+		Topic Topic
+		// The Conn the event is about. It is nil for TopicCreated and TopicDeleted events.
+		Conn ConnOf[T]
+		// Why the Conn was removed, for ConnClosed events.
+		Reason CloseReason
+	}
+
+	// Event is the EventOf a Hub.
+	Event = EventOf[interface{}]
+)
+
+const (
+	// Connected is the event of a Conn connecting to a topic.
+	Connected EventKind = iota + 1
+	// Disconnected is the event of a Conn disconnecting from a topic, either because it was
+	// told to or because it has received all the messages it should from the topic.
+	Disconnected
+	// TopicCreated is the event of a topic gaining its first Conn.
+	TopicCreated
+	// TopicDeleted is the event of a topic losing its last Conn.
+	TopicDeleted
+	// ConnClosed is the event of a Conn being removed from the Hub, after which its channel
+	// is closed, unless KeepAlive was set.
+	ConnClosed
+)
+
+const (
+	// ReasonDisconnected is the reason of the Conns removed because they were disconnected
+	// from all their topics using Disconnect or DisconnectAll.
+	ReasonDisconnected CloseReason = iota + 1
+	// ReasonMessageCount is the reason of the Conns removed after receiving their MessageCount.
+	ReasonMessageCount
+	// ReasonTopicClosed is the reason of the Conns removed because their topics were closed.
+	ReasonTopicClosed
+	// ReasonContextDone is the reason of the Conns removed because their Context was done.
+	ReasonContextDone
+	// ReasonQueueFull is the reason of the Conns with the DisconnectOnFull policy removed
+	// because their queue was full.
+	ReasonQueueFull
+	// ReasonHubClosed is the reason of the Conns removed because the Hub stopped.
+	ReasonHubClosed
+	// ReasonLeft is the reason of the Conns removed because the consumer called Status.Leave.
+	ReasonLeft
+	// ReasonClosedByConsumer is the reason of the Conns removed because the consumer closed
+	// their channel, which it shouldn't do.
+	ReasonClosedByConsumer
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case TopicCreated:
+		return "topic created"
+	case TopicDeleted:
+		return "topic deleted"
+	case ConnClosed:
+		return "conn closed"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Error returns the reason as an error message, so the reason can be used as an error.
+func (r CloseReason) Error() string {
+	return "hub: conn closed: " + r.String()
+}
+
+func (r CloseReason) String() string {
+	switch r {
+	case ReasonDisconnected:
+		return "disconnected"
+	case ReasonMessageCount:
+		return "message count reached"
+	case ReasonTopicClosed:
+		return "topic closed"
+	case ReasonContextDone:
+		return "context done"
+	case ReasonQueueFull:
+		return "queue full"
+	case ReasonHubClosed:
+		return "hub closed"
+	case ReasonLeft:
+		return "left"
+	case ReasonClosedByConsumer:
+		return "closed by consumer"
+	default:
+		return fmt.Sprintf("CloseReason(%d)", int(r))
+	}
+}
+
+// OnEvent sets a function that is called with the lifecycle events of the Hub. It is called
+// from the goroutine the Hub runs on, after the command that caused the events is executed,
+// so it must not block nor send commands to the Hub. T must be the type of the Hub's messages,
+// or the Hub panics when it starts.
+func OnEvent[T any](fn func(EventOf[T])) Option {
+	return func(o *options) {
+		o.onEvent = fn
+	}
+}
+
+// WithSystemTopic sets the topic to which the lifecycle events of the Hub are published.
+// Events about the system topic itself are not published. As the events are messages
+// of the Hub, the Hub panics when it starts if T isn't an interface type.
+func WithSystemTopic(t Topic) Option {
+	return func(o *options) {
+		o.systemTopic, o.systemEvents = t, true
+	}
+}
+
+// checkEvents panics if the options for events don't fit a Hub of type HubOf[T].
+func checkEvents[T any](o *options) {
+	if o.onEvent != nil {
+		if _, ok := o.onEvent.(func(EventOf[T])); !ok {
+			panic(fmt.Sprintf("hub: OnEvent requires a func(%T)", EventOf[T]{}))
+		}
+	}
+	if o.systemEvents {
+		checkWrapper[T]("WithSystemTopic", EventOf[T]{})
+	}
+}
+
+// flush handles the queued dead letters and events, including the ones queued while doing so.
+func (m *manager[T]) flush() {
+	for len(m.dead) > 0 || len(m.events) > 0 {
+		m.publishDeadLetters()
+		m.handleEvents(true)
+	}
+}
+
+// emit queues the event, if anyone is interested in it.
+func (m *manager[T]) emit(kind EventKind, t Topic, c ConnOf[T], reason CloseReason) {
+	if m.opts.onEvent == nil && !m.opts.systemEvents {
+		return
+	}
+	if _, ok := t.(inbox); ok {
+		return
+	}
+
+	m.events = append(m.events, EventOf[T]{Kind: kind, Topic: t, Conn: c, Reason: reason})
+}
+
+// handleEvents passes the queued events to the handler and, if publish is true, publishes them
+// to the system topic. They are handled after the commands causing them, so the Hub doesn't
+// deliver messages while it is delivering another one.
+func (m *manager[T]) handleEvents(publish bool) {
+	for len(m.events) > 0 {
+		e := m.events[0]
+		m.events = m.events[1:]
+
+		if fn, ok := m.opts.onEvent.(func(EventOf[T])); ok {
+			fn(e)
+		}
+		if publish && m.opts.systemEvents && (e.Kind == ConnClosed || e.Topic != m.opts.systemTopic) {
+			m.message(&MessageOf[T]{Message: interface{}(e).(T), Topics: []Topic{m.opts.systemTopic}})
+		}
+	}
+	m.events = nil
+}
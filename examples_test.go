@@ -228,3 +228,28 @@ func Example_receiveNFromTopics() {
 	// connOne received a message connAll also received!
 	// connAll received 5/5 messages.
 }
+
+func Example_typed() {
+	h, done := hub.NewOf[int]()
+	conn := h.Connect("numbers")
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			h.Send(i*i, "numbers")
+		}
+
+		close(h)
+	}()
+
+	sum := 0
+	for n := range conn {
+		// no type assertion needed, n is an int
+		sum += n
+	}
+	<-done
+
+	fmt.Println(sum)
+
+	// Output:
+	// 14
+}
@@ -0,0 +1,520 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// FileStore is a Store that saves the records in a directory, as an append-only log split
+	// in segments. Each segment is a pair of files: the log, named after the sequence number
+	// of the segment's first record, and the index, which holds the position in the log of each
+	// record. Each record is checksummed, so if the process crashes in the middle of a write,
+	// the torn record is truncated when the FileStore is opened again.
+	//
+	// FileStore is also an OffsetStore, which saves the offsets of each durable subscription
+	// in a JSON file in the offsets subdirectory.
+	FileStore struct {
+		mu       sync.Mutex
+		dir      string
+		opts     FileStoreOptions
+		segments []*segment
+	}
+
+	// FileStoreOptions configures a FileStore.
+	FileStoreOptions struct {
+		// The size in bytes after which a new segment is started.
+		// If it isn't positive, DefaultSegmentSize is used.
+		SegmentSize int64
+		// The maximum number of segments kept. When it is exceeded, the oldest segment is deleted.
+		// If it isn't positive, all the segments are kept.
+		MaxSegments int
+		// Set this to true if you want the log to be synced to the disk after each record
+		// is appended. Otherwise the records can be lost if the operating system crashes.
+		Sync bool
+	}
+
+	segment struct {
+		base    uint64
+		log     *os.File
+		index   *os.File
+		size    int64
+		entries []indexEntry
+	}
+
+	indexEntry struct {
+		seq uint64
+		pos int64
+	}
+)
+
+// DefaultSegmentSize is the size of a FileStore's segments when none is specified.
+const DefaultSegmentSize = 16 << 20
+
+const (
+	logExt           = ".log"
+	indexExt         = ".index"
+	offsetsDir       = "offsets"
+	offsetsExt       = ".json"
+	recordHeaderSize = 8
+	indexEntrySize   = 16
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("hub: corrupt record")
+)
+
+// OpenFileStore opens the FileStore in the given directory, creating the directory if
+// it doesn't exist. Close the FileStore when you're done using it.
+func OpenFileStore(dir string, opts FileStoreOptions) (*FileStore, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+logExt))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{dir: dir, opts: opts}
+
+	for _, name := range names {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), logExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seg, err := openSegment(dir, base)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].base < s.segments[j].base
+	})
+
+	return s, nil
+}
+
+func segmentPath(dir string, base uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, ext))
+}
+
+func openSegment(dir string, base uint64) (*segment, error) {
+	log, err := os.OpenFile(segmentPath(dir, base, logExt), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(segmentPath(dir, base, indexExt), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		_ = log.Close()
+		return nil, err
+	}
+
+	seg := &segment{base: base, log: log, index: index}
+	if err := seg.recover(); err != nil {
+		_ = seg.close()
+		return nil, err
+	}
+
+	return seg, nil
+}
+
+// recover loads the segment's index and checks the records after the last indexed one.
+// Records missing from the index are added to it, and the log is truncated at the first
+// incomplete or corrupt record.
+func (s *segment) recover() error {
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+
+	data, err := io.ReadAll(io.NewSectionReader(s.index, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		e := indexEntry{
+			seq: binary.BigEndian.Uint64(data[i:]),
+			pos: int64(binary.BigEndian.Uint64(data[i+8:])),
+		}
+
+		valid := e.pos < s.size && e.seq >= s.base
+		if n := len(s.entries); n > 0 {
+			valid = valid && e.seq > s.entries[n-1].seq && e.pos > s.entries[n-1].pos
+		}
+		if !valid {
+			break
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	// the last indexed record could have been torn, so it's checked too
+	var pos int64
+	for len(s.entries) > 0 {
+		last := s.entries[len(s.entries)-1]
+		r, n, err := s.readAt(last.pos)
+		if err == nil && r.Sequence == last.seq {
+			pos = last.pos + n
+			break
+		}
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+
+	// the records after it are read sequentially, with a single buffer
+	br := bufio.NewReader(io.NewSectionReader(s.log, pos, s.size-pos))
+	for pos < s.size {
+		r, n, err := readRecord(br, s.size-pos)
+		if err != nil {
+			break
+		}
+		if l := len(s.entries); r.Sequence < s.base || (l > 0 && r.Sequence <= s.entries[l-1].seq) {
+			break
+		}
+
+		s.entries = append(s.entries, indexEntry{seq: r.Sequence, pos: pos})
+		pos += n
+	}
+
+	if pos < s.size {
+		if err := s.log.Truncate(pos); err != nil {
+			return err
+		}
+		s.size = pos
+	}
+
+	buf := make([]byte, 0, len(s.entries)*indexEntrySize)
+	for _, e := range s.entries {
+		buf = appendIndexEntry(buf, e)
+	}
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+	_, err = s.index.WriteAt(buf, 0)
+
+	return err
+}
+
+func appendIndexEntry(buf []byte, e indexEntry) []byte {
+	buf = appendUint64(buf, e.seq)
+	return appendUint64(buf, uint64(e.pos))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// firstError returns the first non-nil error.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAt reads the record at the given position in the log.
+// It also returns the size of the record in the log.
+func (s *segment) readAt(pos int64) (Record, int64, error) {
+	left := s.size - pos
+	return readRecord(bufio.NewReader(io.NewSectionReader(s.log, pos, left)), left)
+}
+
+func (s *segment) append(r *Record, sync bool) error {
+	buf := encodeRecord(r)
+	if _, err := s.log.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+
+	e := indexEntry{seq: r.Sequence, pos: s.size}
+	if _, err := s.index.WriteAt(appendIndexEntry(nil, e), int64(len(s.entries))*indexEntrySize); err != nil {
+		return err
+	}
+
+	if sync {
+		if err := s.log.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.entries = append(s.entries, e)
+	s.size += int64(len(buf))
+
+	return nil
+}
+
+// read calls fn for the segment's records with a sequence number greater than or equal
+// to from, until fn returns false. It returns false if fn returned false.
+func (s *segment) read(from uint64, fn func(Record) bool) (bool, error) {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].seq >= from
+	})
+	if i == len(s.entries) {
+		return true, nil
+	}
+
+	left := s.size - s.entries[i].pos
+	br := bufio.NewReader(io.NewSectionReader(s.log, s.entries[i].pos, left))
+
+	for ; i < len(s.entries); i++ {
+		r, n, err := readRecord(br, left)
+		if err != nil {
+			return false, err
+		}
+		left -= n
+		if !fn(r) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *segment) close() error {
+	return firstError(s.log.Close(), s.index.Close())
+}
+
+func (s *segment) remove() error {
+	return firstError(os.Remove(s.log.Name()), os.Remove(s.index.Name()))
+}
+
+// encodeRecord encodes the record as a header, holding the body's length and checksum,
+// followed by the body: the sequence number, the time, the topics and the data.
+func encodeRecord(r *Record) []byte {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+16+len(r.Data))
+	buf = appendUint64(buf, r.Sequence)
+	buf = appendUint64(buf, uint64(r.Time.UnixNano()))
+	buf = appendUvarint(buf, uint64(len(r.Topics)))
+	for _, t := range r.Topics {
+		buf = appendUvarint(buf, uint64(len(t)))
+		buf = append(buf, t...)
+	}
+	buf = append(buf, r.Data...)
+
+	body := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(body, crcTable))
+
+	return buf
+}
+
+// readRecord reads a record from a reader holding the given number of bytes of the log,
+// so a corrupt length can't make it allocate more than the log holds.
+func readRecord(r *bufio.Reader, left int64) (Record, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Record{}, 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length > left-recordHeaderSize {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, 0, err
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	rec, err := decodeRecordBody(body)
+	return rec, int64(recordHeaderSize + len(body)), err
+}
+
+func decodeRecordBody(body []byte) (Record, error) {
+	if len(body) < 16 {
+		return Record{}, errCorruptRecord
+	}
+
+	rec := Record{
+		Sequence: binary.BigEndian.Uint64(body),
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(body[8:]))),
+	}
+	body = body[16:]
+
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return Record{}, errCorruptRecord
+	}
+	body = body[n:]
+
+	rec.Topics = make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(body)
+		if n <= 0 || l > uint64(len(body)-n) {
+			return Record{}, errCorruptRecord
+		}
+		rec.Topics = append(rec.Topics, string(body[n:n+int(l)]))
+		body = body[n+int(l):]
+	}
+	rec.Data = body
+
+	return rec, nil
+}
+
+// Append implements Store.
+func (s *FileStore) Append(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last := s.lastSequence(); len(s.segments) > 0 && r.Sequence <= last {
+		return fmt.Errorf("hub: record sequence %d is not greater than the last one, %d", r.Sequence, last)
+	}
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= s.opts.SegmentSize {
+		if err := s.roll(r.Sequence); err != nil {
+			return err
+		}
+	}
+
+	return s.segments[len(s.segments)-1].append(&r, s.opts.Sync)
+}
+
+// roll starts a new segment, deleting the oldest ones if there are too many.
+func (s *FileStore) roll(base uint64) error {
+	seg, err := openSegment(s.dir, base)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+
+	for s.opts.MaxSegments > 0 && len(s.segments) > s.opts.MaxSegments {
+		old := s.segments[0]
+		s.segments = s.segments[1:]
+
+		if err := firstError(old.close(), old.remove()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read implements Store. The FileStore is locked while fn is called,
+// so fn must not call the FileStore's methods.
+func (s *FileStore) Read(from uint64, fn func(Record) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].base > from
+	})
+	if i > 0 {
+		i--
+	}
+
+	for _, seg := range s.segments[i:] {
+		more, err := seg.read(from, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastSequence implements Store.
+func (s *FileStore) LastSequence() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastSequence(), nil
+}
+
+func (s *FileStore) lastSequence() uint64 {
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if entries := s.segments[i].entries; len(entries) > 0 {
+			return entries[len(entries)-1].seq
+		}
+	}
+	return 0
+}
+
+// Close closes the FileStore's files.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, seg := range s.segments {
+		errs = append(errs, seg.close())
+	}
+	s.segments = nil
+
+	return firstError(errs...)
+}
+
+func (s *FileStore) offsetsPath(name string) string {
+	return filepath.Join(s.dir, offsetsDir, url.PathEscape(name)+offsetsExt)
+}
+
+// SaveOffsets implements OffsetStore. The offsets are written to a temporary file first,
+// which then replaces the previous offsets, so they are never partially written.
+func (s *FileStore) SaveOffsets(name string, offsets Offsets) error {
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+
+	path := s.offsetsPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadOffsets implements OffsetStore.
+func (s *FileStore) LoadOffsets(name string) (Offsets, error) {
+	var offsets Offsets
+
+	data, err := os.ReadFile(s.offsetsPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return offsets, nil
+	} else if err != nil {
+		return offsets, err
+	}
+
+	err = json.Unmarshal(data, &offsets)
+	return offsets, err
+}
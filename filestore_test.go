@@ -0,0 +1,279 @@
+package hub_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+)
+
+func openStore(tb testing.TB, dir string, opts hub.FileStoreOptions) *hub.FileStore {
+	tb.Helper()
+
+	s, err := hub.OpenFileStore(dir, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return s
+}
+
+func appendRecords(tb testing.TB, s hub.Store, seqs ...uint64) {
+	tb.Helper()
+
+	for _, seq := range seqs {
+		r := hub.Record{
+			Sequence: seq,
+			Time:     time.Unix(0, int64(seq)),
+			Topics:   []string{"A", "B"},
+			Data:     []byte{byte(seq)},
+		}
+		if err := s.Append(r); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func readSequences(tb testing.TB, s hub.Store, from uint64) []uint64 {
+	tb.Helper()
+
+	var seqs []uint64
+	err := s.Read(from, func(r hub.Record) bool {
+		if !reflect.DeepEqual(r.Topics, []string{"A", "B"}) || r.Data[0] != byte(r.Sequence) || r.Time.UnixNano() != int64(r.Sequence) {
+			tb.Fatalf("Invalid record %#v", r)
+		}
+		seqs = append(seqs, r.Sequence)
+		return true
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return seqs
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, hub.FileStoreOptions{SegmentSize: 64})
+
+	appendRecords(t, s, 1, 2, 4, 5, 7, 9, 10)
+	if err := s.Append(hub.Record{Sequence: 10}); err == nil {
+		t.Fatal("Expected error for non-increasing sequence")
+	}
+
+	if got := readSequences(t, s, 3); !reflect.DeepEqual(got, []uint64{4, 5, 7, 9, 10}) {
+		t.Fatalf("Invalid sequences read: %v", got)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(logs) < 2 {
+		t.Fatalf("Expected multiple segments, got %d", len(logs))
+	}
+
+	s = openStore(t, dir, hub.FileStoreOptions{SegmentSize: 64})
+	defer s.Close()
+
+	if last, _ := s.LastSequence(); last != 10 {
+		t.Fatalf("Expected last sequence 10, got %d", last)
+	}
+	if got := readSequences(t, s, 0); !reflect.DeepEqual(got, []uint64{1, 2, 4, 5, 7, 9, 10}) {
+		t.Fatalf("Invalid sequences read after reopening: %v", got)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, hub.FileStoreOptions{})
+	appendRecords(t, s, 1, 2, 3)
+	_ = s.Close()
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	f, err := os.OpenFile(logs[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	// cut the last record in half, as if the process crashed while writing it
+	_ = f.Truncate(info.Size() - 10)
+	_ = f.Close()
+
+	s = openStore(t, dir, hub.FileStoreOptions{})
+
+	if last, _ := s.LastSequence(); last != 2 {
+		t.Fatalf("Expected last sequence 2 after recovery, got %d", last)
+	}
+
+	appendRecords(t, s, 3, 4)
+	if got := readSequences(t, s, 0); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4}) {
+		t.Fatalf("Invalid sequences read after recovery: %v", got)
+	}
+	_ = s.Close()
+
+	f, err = os.OpenFile(logs[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a garbage header after the last record, whose length is larger than the log
+	_, _ = f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 1, 2, 3})
+	_ = f.Close()
+
+	s = openStore(t, dir, hub.FileStoreOptions{})
+	defer s.Close()
+
+	if got := readSequences(t, s, 0); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4}) {
+		t.Fatalf("Invalid sequences read after recovering from a garbage header: %v", got)
+	}
+}
+
+func TestFileStoreMissingIndex(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, hub.FileStoreOptions{})
+	appendRecords(t, s, 1, 2, 3)
+	_ = s.Close()
+
+	indexes, _ := filepath.Glob(filepath.Join(dir, "*.index"))
+	_ = os.Remove(indexes[0])
+
+	s = openStore(t, dir, hub.FileStoreOptions{})
+	defer s.Close()
+
+	if got := readSequences(t, s, 2); !reflect.DeepEqual(got, []uint64{2, 3}) {
+		t.Fatalf("Invalid sequences read after rebuilding the index: %v", got)
+	}
+}
+
+func TestFileStoreMaxSegments(t *testing.T) {
+	s := openStore(t, t.TempDir(), hub.FileStoreOptions{SegmentSize: 1, MaxSegments: 2})
+	defer s.Close()
+
+	appendRecords(t, s, 1, 2, 3, 4)
+
+	if got := readSequences(t, s, 0); !reflect.DeepEqual(got, []uint64{3, 4}) {
+		t.Fatalf("Invalid sequences read: %v", got)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, hub.FileStoreOptions{})
+
+	h, done := hub.NewOf[string](hub.WithStore(s, nil))
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{hub.Pattern("orders/#")}, Persist: true}
+	h.Send("First", "orders/eu")
+	h.Send("Not persisted", "stock/eu")
+	h.Send("Second", "orders/us", "orders/eu")
+	close(h)
+	<-done
+	_ = s.Close()
+
+	s = openStore(t, dir, hub.FileStoreOptions{})
+	defer s.Close()
+
+	h, done = hub.NewOf[string](hub.WithStore(s, hub.JSON))
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{hub.Pattern("orders/#")}, Persist: true, History: 2}
+	h.Send("Third", "orders/eu")
+
+	eu, all := make(hub.ConnOf[string], 2), make(hub.ConnOf[string], 4)
+	h <- hub.ConnectOf[string]{Conn: eu, Topics: []hub.Topic{"orders/eu"}, ReplaySince: 1}
+	h <- hub.ConnectOf[string]{Conn: all, Topics: []hub.Topic{hub.Pattern("orders/+")}, ReplayLast: 10}
+	close(h)
+	<-done
+
+	var got []string
+	for msg := range eu {
+		got = append(got, msg)
+	}
+	if expected := []string{"Second", "Third"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	got = got[:0]
+	for msg := range all {
+		got = append(got, msg)
+	}
+	// the history of orders/eu is limited to 2 messages
+	if expected := []string{"Second", "Second", "Third"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+type failingStore struct{ hub.Store }
+
+func (failingStore) LastSequence() (uint64, error) { return 0, nil }
+func (failingStore) Append(hub.Record) error       { return os.ErrClosed }
+
+func TestPersistError(t *testing.T) {
+	h := make(hub.Hub)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- h.Run(context.Background(), hub.WithStore(failingStore{}, nil))
+	}()
+
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{"A"}, Persist: true}
+	h.Send("Hello world!", "A")
+
+	if err := <-errc; err != os.ErrClosed {
+		t.Fatalf("Expected the store's error, got %v", err)
+	}
+
+	var handled []error
+	h, done := hub.New(hub.WithStore(failingStore{}, nil), hub.WithErrorHandler(func(err error) {
+		handled = append(handled, err)
+	}))
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{"A"}, Persist: true}
+	h.Send("Hello world!", "A")
+	h.Send("Hello again!", "A")
+	close(h)
+	<-done
+
+	if len(handled) != 2 {
+		t.Fatalf("Expected two handled errors, got %v", handled)
+	}
+}
+
+func TestPersistCorruptRecord(t *testing.T) {
+	s := openStore(t, t.TempDir(), hub.FileStoreOptions{})
+	defer s.Close()
+
+	for _, r := range []hub.Record{
+		{Sequence: 1, Topics: []string{"A"}, Data: []byte(`"First"`)},
+		{Sequence: 2, Topics: []string{"A"}, Data: []byte(`{`)},
+		{Sequence: 3, Topics: []string{"A"}, Data: []byte(`"Third"`)},
+	} {
+		if err := s.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var handled []error
+	h, done := hub.NewOf[string](hub.WithStore(s, nil), hub.WithErrorHandler(func(err error) {
+		handled = append(handled, err)
+	}))
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{"A"}, Persist: true}
+
+	// the record that can't be decoded is skipped
+	conn := make(hub.ConnOf[string], 3)
+	h <- hub.ConnectOf[string]{Conn: conn, Topics: []hub.Topic{"A"}, ReplayLast: 10}
+	h.Send("Fourth", "A")
+	close(h)
+	<-done
+
+	var got []string
+	for msg := range conn {
+		got = append(got, msg)
+	}
+	if expected := []string{"First", "Third", "Fourth"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	if len(handled) != 1 {
+		t.Fatalf("Expected one handled error, got %v", handled)
+	}
+}
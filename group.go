@@ -0,0 +1,141 @@
+package hub
+
+import "hash/fnv"
+
+type (
+	// Balance tells the Hub how to choose the member of a queue group that receives a message.
+	Balance int
+
+	// group is a queue group of a topic.
+	group[T any] struct {
+		members []ConnOf[T]
+		// next is the index of the member from which the next round-robin search starts.
+		next    int
+		balance Balance
+		key     func(T) string
+	}
+)
+
+const (
+	// RoundRobin sends the messages to the members of the group in turn. This is the default.
+	RoundRobin Balance = iota
+	// LeastLoaded sends each message to the member with the fewest messages waiting in its
+	// queue or waiting to be acknowledged, in turn if there are more.
+	LeastLoaded
+	// KeyHash sends all the messages with the same key, as returned by the group's Key function,
+	// to the same member, as long as the group's members don't change.
+	KeyHash
+)
+
+// join adds the connection to the given queue group of the topic, or removes it from its
+// current group if the name is empty. The group's Balance and Key are replaced.
+func (m *manager[T]) join(t Topic, c ConnOf[T], tr *topicRef[T], tc *TopicConnOf[T]) {
+	if tc.Group != "" && tc.Balance == KeyHash && tc.Key == nil {
+		panic("hub: KeyHash requires a Key")
+	}
+
+	if tr.group != tc.Group {
+		m.leave(t, c, tr)
+	}
+	if tc.Group == "" {
+		return
+	}
+
+	groups := m.groups[t]
+	if groups == nil {
+		if m.groups == nil {
+			m.groups = map[Topic]map[string]*group[T]{}
+		}
+		groups = map[string]*group[T]{}
+		m.groups[t] = groups
+	}
+
+	g, ok := groups[tc.Group]
+	if !ok {
+		g = &group[T]{}
+		groups[tc.Group] = g
+	}
+	if tr.group != tc.Group {
+		g.members = append(g.members, c)
+		tr.group = tc.Group
+	}
+	g.balance, g.key = tc.Balance, tc.Key
+}
+
+// leave removes the connection from its queue group of the topic, if it is in one.
+// The group is deleted if it has no other members.
+func (m *manager[T]) leave(t Topic, c ConnOf[T], tr *topicRef[T]) {
+	g, ok := m.groups[t][tr.group]
+	if !ok {
+		return
+	}
+
+	for i, member := range g.members {
+		if member != c {
+			continue
+		}
+
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if i < g.next {
+			g.next--
+		}
+		break
+	}
+
+	if len(g.members) == 0 {
+		delete(m.groups[t], tr.group)
+		if len(m.groups[t]) == 0 {
+			delete(m.groups, t)
+		}
+	}
+	tr.group = ""
+}
+
+// pick returns the member of the group that receives the message, from the ones
+// whose filters accept it.
+func (m *manager[T]) pick(t Topic, g *group[T], msg T) (ConnOf[T], bool) {
+	start := g.next
+	if g.balance == KeyHash {
+		start = 0
+	}
+
+	candidates := make([]int, 0, len(g.members))
+	for i := range g.members {
+		j := (start + i) % len(g.members)
+		c := g.members[j]
+		if accepts(m.topics[t][c].filter, msg) && accepts(m.conns[c].filter, msg) {
+			candidates = append(candidates, j)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	chosen := candidates[0]
+	switch g.balance {
+	case LeastLoaded:
+		least := m.conns[g.members[chosen]].load()
+		for _, j := range candidates[1:] {
+			if load := m.conns[g.members[j]].load(); load < least {
+				chosen, least = j, load
+			}
+		}
+	case KeyHash:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(g.key(msg)))
+		chosen = candidates[h.Sum32()%uint32(len(candidates))]
+	}
+
+	g.next = (chosen + 1) % len(g.members)
+
+	return g.members[chosen], true
+}
+
+// load returns the number of messages the connection hasn't received or acknowledged yet.
+func (ref *connRefCount[T]) load() int {
+	n := len(ref.pending)
+	if ref.queue != nil {
+		n += ref.queue.len()
+	}
+	return n
+}
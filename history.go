@@ -0,0 +1,300 @@
+package hub
+
+import (
+	"sort"
+	"time"
+)
+
+type (
+	// entry is a message published to a topic, as kept in the topic's history.
+	entry[T any] struct {
+		msg   T
+		topic Topic
+		seq   uint64
+		time  time.Time
+	}
+
+	// history is a ring buffer of the last messages published to a topic.
+	// If size is 0, the history is bounded only by maxAge.
+	history[T any] struct {
+		buf    []entry[T]
+		start  int
+		len    int
+		size   int
+		maxAge time.Duration
+	}
+
+	// topicConfig is a configuration sent using ConfigureTopics.
+	topicConfig struct {
+		history Number
+		maxAge  time.Duration
+		persist bool
+	}
+	patternConfig struct {
+		pattern Pattern
+		config  topicConfig
+	}
+)
+
+func (c topicConfig) keepsHistory() bool {
+	return c.history > 0 || c.maxAge > 0 || c.persist
+}
+
+func newHistory[T any](cfg topicConfig) *history[T] {
+	h := &history[T]{}
+	h.configure(cfg)
+	return h
+}
+
+func (h *history[T]) at(i int) *entry[T] {
+	return &h.buf[(h.start+i)%len(h.buf)]
+}
+
+// configure changes the bounds of the history, discarding the oldest entries
+// if they don't fit anymore.
+func (h *history[T]) configure(cfg topicConfig) {
+	h.size, h.maxAge = cfg.history, cfg.maxAge
+	if h.size > 0 && h.len > h.size {
+		h.drop(h.len - h.size)
+	}
+	h.grow(h.size)
+}
+
+// grow reallocates the buffer with the given capacity, which must fit all the entries.
+func (h *history[T]) grow(capacity int) {
+	if capacity == len(h.buf) || capacity < h.len {
+		return
+	}
+
+	buf := make([]entry[T], capacity)
+	for i := 0; i < h.len; i++ {
+		buf[i] = *h.at(i)
+	}
+	h.buf, h.start = buf, 0
+}
+
+func (h *history[T]) drop(n int) {
+	for i := 0; i < n; i++ {
+		*h.at(i) = entry[T]{}
+	}
+	if len(h.buf) > 0 {
+		h.start = (h.start + n) % len(h.buf)
+	}
+	h.len -= n
+}
+
+func (h *history[T]) push(e entry[T]) {
+	h.expire(e.time)
+
+	if h.size > 0 && h.len == h.size {
+		h.drop(1)
+	} else if h.len == len(h.buf) {
+		h.grow(2*h.len + 1)
+	}
+
+	*h.at(h.len) = e
+	h.len++
+}
+
+// expire discards the entries older than maxAge.
+func (h *history[T]) expire(now time.Time) {
+	if h.maxAge <= 0 {
+		return
+	}
+
+	n := 0
+	for n < h.len && now.Sub(h.at(n).time) > h.maxAge {
+		n++
+	}
+	h.drop(n)
+}
+
+// since returns the entries with a sequence number greater than seq, but not more than
+// the last given number of entries, if it is positive.
+func (h *history[T]) since(seq uint64, last Number) []entry[T] {
+	h.expire(time.Now())
+
+	i := sort.Search(h.len, func(i int) bool {
+		return h.at(i).seq > seq
+	})
+	if last > 0 && h.len-i > last {
+		i = h.len - last
+	}
+
+	entries := make([]entry[T], 0, h.len-i)
+	for ; i < h.len; i++ {
+		entries = append(entries, *h.at(i))
+	}
+
+	return entries
+}
+
+// config returns the configuration of the given topic. The configuration sent for the topic
+// itself takes precedence over the ones sent for the patterns matching the topic, from which
+// the last one sent is used.
+func (m *manager[T]) config(t Topic) topicConfig {
+	if cfg, ok := m.configs[t]; ok {
+		return cfg
+	}
+
+	if s, ok := t.(string); ok {
+		for i := len(m.patternConfigs) - 1; i >= 0; i-- {
+			if pc := m.patternConfigs[i]; pc.pattern.Match(s) {
+				return pc.config
+			}
+		}
+	}
+
+	return topicConfig{}
+}
+
+func (m *manager[T]) configure(c *ConfigureTopics) {
+	cfg := topicConfig{history: c.History, maxAge: c.MaxAge, persist: c.Persist}
+
+	for _, t := range getTopics(c.Topics, true) {
+		p, isPattern := t.(Pattern)
+		if !isPattern {
+			if m.configs == nil {
+				m.configs = map[Topic]topicConfig{}
+			}
+			m.configs[t] = cfg
+			m.reconfigure(t)
+			continue
+		}
+
+		configs := m.patternConfigs[:0]
+		for _, pc := range m.patternConfigs {
+			if pc.pattern != p {
+				configs = append(configs, pc)
+			}
+		}
+		m.patternConfigs = append(configs, patternConfig{pattern: p, config: cfg})
+
+		for t := range m.histories {
+			if s, ok := t.(string); ok && p.Match(s) {
+				m.reconfigure(t)
+			}
+		}
+	}
+}
+
+// reconfigure applies the topic's current configuration to its history, if it has one.
+func (m *manager[T]) reconfigure(t Topic) {
+	h, ok := m.histories[t]
+	if !ok {
+		return
+	}
+
+	if cfg := m.config(t); cfg.keepsHistory() && !cfg.persist {
+		h.configure(cfg)
+	} else {
+		delete(m.histories, t)
+	}
+}
+
+// record adds the message to its topic's history, if the topic keeps one.
+func (m *manager[T]) record(e *entry[T]) {
+	h, ok := m.histories[e.topic]
+	if !ok {
+		cfg := m.config(e.topic)
+		if !cfg.keepsHistory() || cfg.persist {
+			return
+		}
+
+		if m.histories == nil {
+			m.histories = map[Topic]*history[T]{}
+		}
+		h = newHistory[T](cfg)
+		m.histories[e.topic] = h
+	}
+
+	h.push(*e)
+}
+
+// replay sends to the connection the messages from the history of the topic it has
+// just connected to, with a sequence number greater than since, but not more than
+// the last given number of messages. If the topic is a Pattern, the histories of all
+// the topics it matches are merged. The histories of persisted topics are read from
+// the Store. It returns false if there is no history to replay from.
+func (m *manager[T]) replay(t Topic, c ConnOf[T], last Number, since uint64) bool {
+	var entries []entry[T]
+	found := false
+
+	if h, ok := m.histories[t]; ok {
+		entries = h.since(since, last)
+		found = true
+	} else if _, ok := t.(string); ok && m.config(t).persist {
+		entries = m.bound(m.stored(t, since))
+		found = true
+	}
+
+	if p, ok := t.(Pattern); ok {
+		for ht, h := range m.histories {
+			if s, ok := ht.(string); ok && p.Match(s) {
+				entries = append(entries, h.since(since, last)...)
+				found = true
+			}
+		}
+
+		if stored := m.bound(m.stored(p, since)); len(stored) > 0 {
+			entries = append(entries, stored...)
+			found = true
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].seq < entries[j].seq
+		})
+	}
+
+	if last > 0 && len(entries) > last {
+		entries = entries[len(entries)-last:]
+	}
+
+	tr := m.topics[t][c]
+	for i := range entries {
+		if !m.deliver(t, c, tr, &entries[i]) {
+			break
+		}
+	}
+
+	return found
+}
+
+// bound returns the entries read from the Store that fit in the histories of their topics,
+// which are the ones not older than the topic's MaxAge and not more than its History.
+func (m *manager[T]) bound(entries []entry[T]) []entry[T] {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	configs := map[Topic]topicConfig{}
+	counts := map[Topic]Number{}
+	keep := make([]bool, len(entries))
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+
+		cfg, ok := configs[e.topic]
+		if !ok {
+			cfg = m.config(e.topic)
+			configs[e.topic] = cfg
+		}
+
+		if (cfg.maxAge > 0 && now.Sub(e.time) > cfg.maxAge) || (cfg.history > 0 && counts[e.topic] == cfg.history) {
+			continue
+		}
+
+		counts[e.topic]++
+		keep[i] = true
+	}
+
+	bounded := entries[:0]
+	for i, e := range entries {
+		if keep[i] {
+			bounded = append(bounded, e)
+		}
+	}
+
+	return bounded
+}
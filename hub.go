@@ -6,44 +6,76 @@ The pattern is simple: publish messages to given topics. To do this a series of
 are sent to the Hub, which is a plain channel, commands that are executed afterwards. Most
 commands take topics as parameters, but if the topics are not specified a default topic
 (a topic identified by the nil interface) is used.
+
+String topics can also be hierarchical, like "orders/eu/123". Connect to a Pattern such as
+"orders/+/123" or "orders/#" to receive the messages of all the topics it matches.
+
+Hub and the other commands accept messages of any type. If all the messages have the same
+type, use the generic HubOf and its commands instead, so the compiler checks the types
+of the messages for you.
 */
 package hub
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
 type (
-	// Hub is the coordinator channel on which commands are sent. Even though in general
+	// HubOf is the coordinator channel on which commands are sent. Even though in general
 	// channels don't have to be closed, the Hub must be, or resources will be leaked otherwise.
-	Hub chan interface{}
-	// Conn is a connection. It is a channel on which the Hub sends messages
+	//
+	// The commands for a HubOf[T] are the ones instantiated with T, together with Close,
+	// CloseAll, ClearRetained, ConfigureTopics and Commit. Any other value sent is a message of type T published to the default topic.
+	HubOf[T any] chan interface{}
+	// ConnOf is a connection. It is a channel on which the Hub sends messages
 	// from each Topic the Conn is connected to.
 	//
 	// Message a Conn as a command and the Hub will connect it to the default topic.
-	Conn chan interface{}
+	ConnOf[T any] chan T
 	// Topic is an identifier for a topic.
 	Topic interface{}
 
+	// Policy tells the Hub what to do when a Conn doesn't receive its messages fast enough.
+	Policy int
+
 	// Number is an alias for int. If a struct field of a command that manipulates a connections has this type,
 	// it means that the first time the command is sent negative values are ignored,
 	// and on subsequent times negative values do not reset specific properties of
 	// the connections that the respective values manipulate.
 	Number = int
 
-	// TopicConn represents a connection to a topic. Use it with ConnectEach
+	// TopicConnOf represents a connection to a topic. Use it with ConnectEach
 	// to describe how the connection connects to topics.
-	TopicConn struct {
+	TopicConnOf[T any] struct {
 		Topic Topic
 		// The number of messages the connection should receive from the given topic.
 		// If the ConnectEach command is sent multiple times for the same connection,
 		// the number of messages is reset to the new value.
 		MessageCount Number
+		// If a Filter is given, the connection receives from the topic only the messages
+		// for which it returns true. Messages that are filtered out don't count towards
+		// MessageCount. The Filter is replaced each time ConnectEach is sent.
+		Filter func(T) bool
+		// If a Group is given, the connection joins the queue group with that name of the topic.
+		// Each message published to the topic is received by only one member of each group,
+		// chosen using the group's Balance, while the connections that aren't in a group still
+		// receive all of them. The Balance and the Key, which is required by KeyHash, are
+		// replaced for the whole group each time a member connects. Replayed and retained
+		// messages are received by each member.
+		Group   string
+		Balance Balance
+		Key     func(T) string
 	}
 
-	// Connect is a command that tells the Hub to connect a Conn to the given topics.
+	// ConnectOf is a command that tells the Hub to connect a Conn to the given topics.
 	// After connecting, the Conn will receive messages from all the topics until it
 	// disconnects, the topics are closed or the hub is closed.
 	//
 	// If no topics are specified, the Conn will receive all messages from the default topic.
-	Connect struct {
-		Conn   Conn
+	ConnectOf[T any] struct {
+		Conn   ConnOf[T]
 		Topics []Topic
 		// The total number of messages the connection should receive.
 		// Reset this value for the connection by resending this command with
@@ -53,36 +85,122 @@ type (
 		// when the Conn isn't connected to any topics, or it has received the specified
 		// number of messages.
 		KeepAlive bool
+		// The delivery policy of the connection. If it isn't Block, messages are put in a queue
+		// of QueueSize capacity, from which they are sent to the Conn without blocking the Hub.
+		// If QueueSize isn't positive, DefaultQueueSize is used. Both are taken into account
+		// only the first time the Conn is connected.
+		Policy    Policy
+		QueueSize Number
+		// If a Filter is given, the connection receives only the messages for which it returns
+		// true, from all its topics. It is evaluated by the Hub, before delivering the message,
+		// so it must not block. Messages that are filtered out don't count towards MessageCount.
+		// The Filter is replaced each time the command is sent.
+		Filter func(T) bool
+		// Set this to true if you want the Conn to receive each message wrapped in an EnvelopeOf[T].
+		// This is possible only if T is an interface type, like for a Hub, as the envelope is sent
+		// on the Conn. It is taken into account only the first time the Conn is connected.
+		Envelope bool
+		// If the topics keep a history, as set using ConfigureTopics, the Conn first receives the
+		// messages from each topic's history with a sequence number greater than ReplaySince,
+		// but not more than the last ReplayLast messages, if it is positive. Messages published
+		// meanwhile are delivered only after the replay, so none are missed or duplicated.
+		// When connecting to a Pattern, the histories of all the topics it matches are merged.
+		// Replayed messages count towards MessageCount. If a replay is requested, topics
+		// with history don't also send their retained message.
+		ReplayLast  Number
+		ReplaySince uint64
+		// Set Durable to a name if you want the Hub to remember, for each topic, which messages
+		// the Conn has consumed. When a Conn connects again to a topic using the same name,
+		// it first receives the messages it missed from the topic's history, as with ReplaySince,
+		// and then the new ones. The positions are saved in the Hub's Store, if it implements
+		// OffsetStore, so they are kept even if the Hub is restarted. Only one Conn should use
+		// a durable subscription at a time.
+		//
+		// A message is consumed once it is sent to the Conn, or if ManualCommit is set, after
+		// it is committed using the Commit command. Both are taken into account only the
+		// first time the Conn is connected.
+		Durable      string
+		ManualCommit bool
+		// Set Ack to true if you want the Conn to receive each message wrapped in a *DeliveryOf[T],
+		// which must be acknowledged. Messages that aren't acknowledged within AckTimeout, or
+		// DefaultAckTimeout if it isn't positive, are delivered again, until they are. Redeliveries
+		// bypass the filters and don't count towards MessageCount. If the Conn is disconnected, its
+		// unacknowledged messages aren't delivered again. The messages of a durable subscription
+		// are consumed only once acknowledged, so a Conn resuming it receives them again.
+		// As with Envelope, T must be an interface type. Both are taken into account only the
+		// first time the Conn is connected.
+		Ack        bool
+		AckTimeout time.Duration
+		// If MaxAttempts is positive, a message that isn't acknowledged after being delivered
+		// this many times is given up on, as if it were acknowledged, and dead-lettered.
+		// It is taken into account only the first time the Conn is connected.
+		MaxAttempts Number
+		// If a Context is given, the Conn is disconnected from all its topics when the
+		// Context is done, as if DisconnectAll was sent, even if the Hub is waiting for the
+		// Conn to receive a message. If the Conn is connected multiple times with different
+		// contexts, it is disconnected when any of them is done.
+		Context context.Context
+		// If a Status is given, it tells why the Conn was removed from the Hub. It is taken
+		// into account only the first time the Conn is connected.
+		Status *Status
+		// If a Subscription is given, the Topics and the MessageCount are bound to it and
+		// the other fields are taken into account only if the Conn isn't connected yet.
+		Subscription *SubscriptionOf[T]
 	}
-	// ConnectEach is similar to Connect, but you can also specify how many messages
+	// ConnectEachOf is similar to Connect, but you can also specify how many messages
 	// the Conn should receive from each Topic individually. In other words, Connect
 	// would basically be ConnectEach with unset TopicConn.MessageCount.
 	//
 	// If no topics are specified, the Conn will receive all messages from the default topic.
-	ConnectEach struct {
-		Conn         Conn
-		Topics       []TopicConn
+	ConnectEachOf[T any] struct {
+		Conn         ConnOf[T]
+		Topics       []TopicConnOf[T]
 		MessageCount Number
 		KeepAlive    bool
+		Policy       Policy
+		QueueSize    Number
+		Filter       func(T) bool
+		Envelope     bool
+		ReplayLast   Number
+		ReplaySince  uint64
+		Durable      string
+		ManualCommit bool
+		Ack          bool
+		AckTimeout   time.Duration
+		MaxAttempts  Number
+		Context      context.Context
+		Status       *Status
+		Subscription *SubscriptionOf[T]
 	}
-	// Disconnect is a command that tells the Hub to stop sending messages from the
+	// DisconnectOf is a command that tells the Hub to stop sending messages from the
 	// given topics to the Conn. If no topics are given, the Conn is disconnected
 	// from the default topic. Also, if KeepAlive wasn't set on connection its channel is also
 	// closed.
-	Disconnect struct {
-		Conn   Conn
+	DisconnectOf[T any] struct {
+		Conn   ConnOf[T]
 		Topics []Topic
 	}
 
-	// DisconnectAll is the same as Disconnect, but it disconnects the Conn from all the
+	// DisconnectAllOf is the same as Disconnect, but it disconnects the Conn from all the
 	// topics it is connected to.
-	DisconnectAll Conn
+	DisconnectAllOf[T any] ConnOf[T]
 
-	// Message is a command that tells the Hub to publish the given Message to each
+	// MessageOf is a command that tells the Hub to publish the given Message to each
 	// given Topic. If no topic is provided, the Hub publishes is to the default topic.
-	Message struct {
-		Message interface{}
+	MessageOf[T any] struct {
+		Message T
 		Topics  []Topic
+		// Set this to true if you want the Hub to keep the message as the last value of each
+		// given topic. The Conns that connect to the topic afterwards receive it immediately,
+		// as a normal message, until another message is retained or the retained message
+		// is cleared using ClearRetained.
+		Retain bool
+		// If set, the Hub sends on it the number of messages it delivered to Conns, or put
+		// in their queues, for this message, as counted by Delivered in the Hub's StatsOf.
+		// A Conn connected to multiple of the message's topics, or to matching patterns,
+		// is counted once for each. The Hub never waits to send on the channel: the count is
+		// discarded if the channel isn't ready, so it should be buffered.
+		Receivers chan<- int
 	}
 
 	// Close is a command that tells the hub to disconnect all connections that are
@@ -91,30 +209,176 @@ type (
 	Close []Topic
 	// CloseAll is similar to Close, but it disconnects the connections from all topics.
 	CloseAll struct{}
+	// ConfigureTopics is a command that tells the Hub to keep a history of the messages published
+	// to the given topics, so Conns can request a replay when connecting. If no topics are given,
+	// the default topic is configured. If a Pattern is given, all the topics it matches are
+	// configured, except the ones configured directly. Sending the command again for the same
+	// topics replaces their configuration, and if both History and MaxAge are 0 the history
+	// is discarded.
+	ConfigureTopics struct {
+		Topics []Topic
+		// The maximum number of messages the history of each topic holds. If it is 0,
+		// only MaxAge limits the history.
+		History Number
+		// The maximum age of the messages kept in the history. If it is 0, only History
+		// limits the history.
+		MaxAge time.Duration
+		// Set this to true if you want the messages published to the topics to be saved
+		// in the Hub's Store, so they can be replayed after the Hub is restarted. The history
+		// of persisted topics is then read from the Store, still limited by History and MaxAge,
+		// if set. Only string topics can be persisted.
+		Persist bool
+	}
+
+	// Commit is a command that tells the Hub that the durable subscription with the given name
+	// has consumed the messages up to and including the one with the given sequence number from
+	// each given topic. The topics are the ones the subscription is connected to, which for
+	// a message received in an Envelope is its Pattern, if set, or otherwise its Topic.
+	// If no topics are given, the default topic is used.
+	Commit struct {
+		Name     string
+		Topics   []Topic
+		Sequence uint64
+	}
+
+	// Option configures a Hub. Pass options to New, NewOf or Run.
+	Option func(*options)
+
+	options struct {
+		store       Store
+		codec       Codec
+		onError     func(error)
+		deadLetter  Topic
+		deadLetters bool
+		// onEvent is a func(EventOf[T]), checked when the Hub starts.
+		onEvent      interface{}
+		systemTopic  Topic
+		systemEvents bool
+	}
+
+	// EnvelopeOf wraps a message sent to a Conn that was connected with Envelope set.
+	EnvelopeOf[T any] struct {
+		Message T
+		// The topic the message was published to.
+		Topic Topic
+		// The Pattern through which the Conn received the message, if any.
+		Pattern Pattern
+		// The sequence number the Hub assigned to the message. Messages are numbered
+		// starting with 1, in the order they are published.
+		Sequence uint64
+		// The time the Hub received the message at.
+		Time time.Time
+	}
+
+	// ClearRetained is a command that tells the Hub to forget the retained messages of the
+	// given topics. If no topics are given, the retained message of the default topic is
+	// forgotten. A Pattern clears the retained messages of all the topics it matches.
+	ClearRetained []Topic
+)
+
+type (
+	// Hub is a HubOf which accepts messages of any type.
+	Hub = HubOf[interface{}]
+	// Conn is a ConnOf which receives messages of any type.
+	Conn = ConnOf[interface{}]
+	// TopicConn is the TopicConnOf for a Hub.
+	TopicConn = TopicConnOf[interface{}]
+	// Connect is the ConnectOf command for a Hub.
+	Connect = ConnectOf[interface{}]
+	// ConnectEach is the ConnectEachOf command for a Hub.
+	ConnectEach = ConnectEachOf[interface{}]
+	// Disconnect is the DisconnectOf command for a Hub.
+	Disconnect = DisconnectOf[interface{}]
+	// DisconnectAll is the DisconnectAllOf command for a Hub.
+	DisconnectAll = DisconnectAllOf[interface{}]
+	// Message is the MessageOf command for a Hub.
+	Message = MessageOf[interface{}]
+	// Envelope is the EnvelopeOf received on a Conn.
+	Envelope = EnvelopeOf[interface{}]
+	// Delivery is the DeliveryOf received on a Conn.
+	Delivery = DeliveryOf[interface{}]
+)
+
+const (
+	// Block makes the Hub wait until the Conn receives the message. This is the default policy.
+	Block Policy = iota
+	// DropNewest discards the message being sent if the Conn's queue is full.
+	DropNewest
+	// DropOldest discards the oldest queued message to make room for the message being sent.
+	DropOldest
+	// DisconnectOnFull disconnects the Conn from all its topics when its queue is full.
+	// The queued messages are still delivered before the Conn is closed.
+	DisconnectOnFull
 )
 
-func (c *Connect) toConnectEach() *ConnectEach {
-	topics := make([]TopicConn, 0, len(c.Topics))
+// DefaultQueueSize is the capacity of a Conn's queue when none is specified.
+const DefaultQueueSize = 64
+
+func (c *ConnectOf[T]) toConnectEach() *ConnectEachOf[T] {
+	topics := make([]TopicConnOf[T], 0, len(c.Topics))
 	for _, t := range c.Topics {
-		topics = append(topics, TopicConn{Topic: t})
+		topics = append(topics, TopicConnOf[T]{Topic: t})
 	}
 
-	return &ConnectEach{
+	return &ConnectEachOf[T]{
 		Conn:         c.Conn,
 		Topics:       topics,
 		MessageCount: c.MessageCount,
 		KeepAlive:    c.KeepAlive,
+		Policy:       c.Policy,
+		QueueSize:    c.QueueSize,
+		Filter:       c.Filter,
+		Envelope:     c.Envelope,
+		ReplayLast:   c.ReplayLast,
+		ReplaySince:  c.ReplaySince,
+		Durable:      c.Durable,
+		ManualCommit: c.ManualCommit,
+		Ack:          c.Ack,
+		AckTimeout:   c.AckTimeout,
+		MaxAttempts:  c.MaxAttempts,
+		Context:      c.Context,
+		Status:       c.Status,
+		Subscription: c.Subscription,
+	}
+}
+
+// WithStore sets the Store in which the messages published to persisted topics are saved,
+// and the Codec used to encode them. If the Codec is nil, JSON is used.
+func WithStore(s Store, c Codec) Option {
+	return func(o *options) {
+		if c == nil {
+			c = JSON
+		}
+		o.store, o.codec = s, c
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors the Hub encounters,
+// such as the ones returned by the Store. Without an error handler the Hub stops
+// on the first error, which is returned by Run. The stored messages that can't be
+// decoded are skipped, and their errors are only passed to the handler.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.onError = fn
 	}
 }
 
 // New creates a Hub channel and starts the command execution loop.
 // It also returns a channel that blocks until the hub is closed.
-func New() (Hub, <-chan struct{}) {
-	h := make(Hub)
+//
+// If you use options that can make the Hub fail, use Run to find out why it has stopped,
+// or set an error handler.
+func New(opts ...Option) (Hub, <-chan struct{}) {
+	return NewOf[interface{}](opts...)
+}
+
+// NewOf is the same as New, but it creates a HubOf[T].
+func NewOf[T any](opts ...Option) (HubOf[T], <-chan struct{}) {
+	h := make(HubOf[T])
 	done := make(chan struct{})
 
 	go func() {
-		h.Start()
+		_ = h.Run(context.Background(), opts...)
 		close(done)
 	}()
 
@@ -123,39 +387,109 @@ func New() (Hub, <-chan struct{}) {
 
 // Start starts the hub. Run this in a new goroutine. Don't call Start if you have created the
 // Hub using New!
-func (h Hub) Start() {
-	m := newManager()
+//
+// Start panics if a value that is neither a command nor a message of type T is sent to the Hub.
+func (h HubOf[T]) Start() {
+	_ = h.Run(context.Background())
+}
+
+// Run is the same as Start, but it also stops when the given context is done or when the Hub
+// fails. It returns nil if the Hub was closed, or the context's or the Hub's error otherwise.
+// In all cases the connections are closed, but in the latter ones the Hub channel isn't,
+// so use SendContext and ConnectContext to not block forever if Run could stop before
+// you're done sending commands.
+func (h HubOf[T]) Run(ctx context.Context, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.deadLetters {
+		checkWrapper[T]("WithDeadLetter", DeadLetterOf[T]{})
+	}
+	checkEvents[T](&o)
+
+	m := newManager[T](o)
+	m.hub = h
 	defer m.close()
 
-	for cmd := range h {
+	if o.store != nil {
+		seq, err := o.store.LastSequence()
+		if err != nil {
+			return err
+		}
+		m.seq = seq
+	}
+
+	for m.err == nil {
+		m.flush()
+
+		var cmd interface{}
+		var ok bool
+
+		select {
+		case cmd, ok = <-h:
+			if !ok {
+				return nil
+			}
+			// the acknowledgements made before the command was sent are handled first
+			m.settle()
+		case c := <-m.cancels:
+			m.cancel(c)
+			continue
+		case <-m.acks.wake:
+			m.settle()
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
 		switch v := cmd.(type) {
-		case Message:
+		case MessageOf[T]:
+			m.metrics.published++
 			m.message(&v)
-		case Connect:
+		case ConnectOf[T]:
 			m.connect(&v)
-		case ConnectEach:
+		case ConnectEachOf[T]:
 			m.connectEach(&v)
-		case Disconnect:
+		case DisconnectOf[T]:
 			m.disconnect(&v)
-		case DisconnectAll:
+		case DisconnectAllOf[T]:
 			m.disconnectAll(v)
 		case Close:
 			m.closeTopics(v)
 		case CloseAll:
 			m.closeAllTopics()
-		case Conn:
-			m.connectEach(&ConnectEach{Conn: v})
+		case ClearRetained:
+			m.clearRetained(v)
+		case ConfigureTopics:
+			m.configure(&v)
+		case Commit:
+			m.commitExplicit(&v)
+		case RequestOf[T]:
+			m.request(&v)
+		case InspectOf[T]:
+			m.inspect(v)
+		case ConnOf[T]:
+			m.connectEach(&ConnectEachOf[T]{Conn: v})
 		default:
-			m.message(&Message{Message: v})
+			msg, ok := v.(T)
+			if !ok && v != nil {
+				panic(fmt.Sprintf("hub: invalid command or message of type %T", v))
+			}
+			m.metrics.published++
+			m.message(&MessageOf[T]{Message: msg})
 		}
 	}
+
+	return m.err
 }
 
 // Connect is a shortcut for the creating a Conn and sending a Connect command to the Hub.
-func (h Hub) Connect(topics ...Topic) Conn {
-	conn := make(Conn)
+func (h HubOf[T]) Connect(topics ...Topic) ConnOf[T] {
+	conn := make(ConnOf[T])
 
-	h <- Connect{
+	h <- ConnectOf[T]{
 		Conn:   conn,
 		Topics: topics,
 	}
@@ -163,28 +497,63 @@ func (h Hub) Connect(topics ...Topic) Conn {
 	return conn
 }
 
+// ConnectContext is the same as Connect, but the Conn is disconnected when the context is done.
+// It returns the context's error if the context is done before the Hub receives the command.
+func (h HubOf[T]) ConnectContext(ctx context.Context, topics ...Topic) (ConnOf[T], error) {
+	conn := make(ConnOf[T])
+
+	err := h.send(ctx, ConnectOf[T]{
+		Conn:    conn,
+		Topics:  topics,
+		Context: ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
 // Disconnect is a shortcut for sending a Disconnect command to the Hub.
-func (h Hub) Disconnect(c Conn, topics ...Topic) {
-	h <- Disconnect{
+func (h HubOf[T]) Disconnect(c ConnOf[T], topics ...Topic) {
+	h <- DisconnectOf[T]{
 		Conn:   c,
 		Topics: topics,
 	}
 }
 
 // DisconnectAll is a shortcut for sending a DisconnectAll command to the Hub.
-func (h Hub) DisconnectAll(c Conn) {
-	h <- DisconnectAll(c)
+func (h HubOf[T]) DisconnectAll(c ConnOf[T]) {
+	h <- DisconnectAllOf[T](c)
 }
 
 // Send is a shortcut for sending a Message command to the Hub.
-func (h Hub) Send(message interface{}, topics ...Topic) {
-	h <- Message{
+func (h HubOf[T]) Send(message T, topics ...Topic) {
+	h <- MessageOf[T]{
 		Message: message,
 		Topics:  topics,
 	}
 }
 
+// SendContext is the same as Send, but it returns the context's error if the context is done
+// before the Hub receives the message.
+func (h HubOf[T]) SendContext(ctx context.Context, message T, topics ...Topic) error {
+	return h.send(ctx, MessageOf[T]{
+		Message: message,
+		Topics:  topics,
+	})
+}
+
+func (h HubOf[T]) send(ctx context.Context, cmd interface{}) error {
+	select {
+	case h <- cmd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Close is a shortcut for sending a Close command to the Hub.
-func (h Hub) Close(topics ...Topic) {
+func (h HubOf[T]) Close(topics ...Topic) {
 	h <- Close(topics)
 }
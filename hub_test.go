@@ -1,8 +1,11 @@
 package hub_test
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tmaxmax/hub"
 )
@@ -357,3 +360,1232 @@ func TestOverwriteConnectionProperties(t *testing.T) {
 		"Tenth",
 		"For conn only")
 }
+
+func TestPolicyDoesNotBlockHub(t *testing.T) {
+	h, done := hub.New()
+	slow, fast := make(hub.Conn), make(hub.Conn, 3)
+
+	h <- hub.Connect{Conn: slow, Policy: hub.DropNewest, QueueSize: 1}
+	h <- fast
+	h <- "First"
+	h <- "Second"
+	h <- "Third"
+	close(h)
+	<-done
+
+	checkContents(t, fast, "First", "Second", "Third")
+	checkContents(t, slow, "First")
+}
+
+func TestPolicyDropNewest(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+
+	h <- hub.Connect{Conn: conn, Policy: hub.DropNewest, QueueSize: 2, MessageCount: 3}
+	for _, msg := range []string{"First", "Second", "Third", "Fourth"} {
+		h <- msg
+	}
+	close(h)
+	<-done
+
+	checkContents(t, conn, "First", "Second")
+}
+
+func TestPolicyDropOldest(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+
+	h <- hub.Connect{Conn: conn, Policy: hub.DropOldest, QueueSize: 2}
+	for _, msg := range []string{"First", "Second", "Third", "Fourth", "Fifth"} {
+		h <- msg
+	}
+	close(h)
+	<-done
+
+	var got []interface{}
+	for msg := range conn {
+		got = append(got, msg)
+	}
+
+	if len(got) != 2 || got[1] != "Fifth" {
+		t.Fatalf("Expected two messages, the last being the newest one, got %#v", got)
+	}
+}
+
+func TestPolicyDisconnectOnFull(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+	topics := []hub.Topic{"A", "B"}
+
+	h <- hub.Connect{Conn: conn, Topics: topics, Policy: hub.DisconnectOnFull, QueueSize: 2}
+	h <- hub.Message{Message: "First", Topics: topics}
+	h <- hub.Message{Message: "Second", Topics: topics}
+
+	checkContents(t, conn, "First", "First")
+
+	close(h)
+	<-done
+}
+
+func TestPolicyKeepAliveReconnect(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+
+	h <- hub.Connect{Conn: conn, Policy: hub.DropNewest, QueueSize: 2, KeepAlive: true}
+	h <- "First"
+	h.DisconnectAll(conn)
+	h <- hub.Connect{Conn: conn, Policy: hub.DropNewest, QueueSize: 2}
+	h <- "Second"
+	h <- "Third"
+	close(h)
+	<-done
+
+	checkContents(t, conn, "First", "Second", "Third")
+}
+
+func TestTyped(t *testing.T) {
+	h, done := hub.NewOf[int]()
+	a := make(hub.ConnOf[int], 3)
+	b := h.Connect("A")
+
+	h <- hub.ConnectOf[int]{Conn: a, Topics: []hub.Topic{"A", "B"}, MessageCount: 3}
+	go func() {
+		h.Send(1, "A", "B")
+		h <- hub.MessageOf[int]{Message: 2, Topics: []hub.Topic{"A"}}
+		h.DisconnectAll(b)
+		close(h)
+	}()
+
+	var got []int
+	for v := range b {
+		got = append(got, v)
+	}
+	<-done
+
+	if !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("Invalid typed conn contents: %v", got)
+	}
+
+	got = got[:0]
+	for v := range a {
+		got = append(got, v)
+	}
+	if !reflect.DeepEqual(got, []int{1, 1, 2}) {
+		t.Fatalf("Invalid typed conn contents: %v", got)
+	}
+}
+
+func TestTypedInvalidMessage(t *testing.T) {
+	h := make(hub.HubOf[int])
+	go func() {
+		h <- "not an int"
+	}()
+
+	assertPanic(t, "Hub should panic on invalid messages", h.Start)
+}
+
+func TestRunContext(t *testing.T) {
+	h := make(hub.Hub)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- h.Run(ctx)
+	}()
+
+	conn := make(hub.Conn, 1)
+	h <- conn
+	h <- "Hello world!"
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	checkContents(t, conn, "Hello world!")
+
+	if err := h.SendContext(ctx, "Nobody listens"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled from SendContext, got %v", err)
+	}
+}
+
+func TestRunClosed(t *testing.T) {
+	h := make(hub.Hub)
+	close(h)
+
+	if err := h.Run(context.Background()); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+}
+
+func TestSendContextTimeout(t *testing.T) {
+	h := make(hub.Hub)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := h.SendContext(ctx, "Hello world!"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := h.ConnectContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	h, done := hub.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	topics := []hub.Topic{"A", "B"}
+
+	conn, err := h.ConnectContext(ctx, topics...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := make(hub.Conn, 2)
+	h <- hub.Connect{Conn: other, Topics: topics}
+
+	go func() {
+		h <- hub.Message{Message: "First", Topics: topics[:1]}
+		cancel()
+	}()
+
+	if msg := <-conn; msg != "First" {
+		t.Fatalf("Expected first message, got %#v", msg)
+	}
+	// the channel is closed by the hub after the context is cancelled
+	for range conn {
+	}
+
+	h <- hub.Message{Message: "Second", Topics: topics[1:]}
+	close(h)
+	<-done
+
+	checkContents(t, other, "First", "Second")
+}
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern hub.Pattern
+		topic   string
+		match   bool
+	}{
+		{"orders/eu/123", "orders/eu/123", true},
+		{"orders/+/123", "orders/eu/123", true},
+		{"orders/+", "orders/eu/123", false},
+		{"orders/#", "orders/eu/123", true},
+		{"orders/#", "orders", true},
+		{"#", "orders/eu", true},
+		{"+/+", "orders/eu", true},
+		{"+", "", true},
+		{"orders/#/123", "orders/eu/123", false},
+		{"#", "$system/events", false},
+		{"+/events", "$system/events", false},
+		{"$system/#", "$system/events", true},
+	}
+
+	for _, test := range tests {
+		if got := test.pattern.Match(test.topic); got != test.match {
+			t.Errorf("Pattern(%q).Match(%q) = %v, expected %v", test.pattern, test.topic, got, test.match)
+		}
+	}
+}
+
+func TestPatternConnect(t *testing.T) {
+	h, done := hub.New()
+	eu, all, one := make(hub.Conn, 2), make(hub.Conn, 6), make(hub.Conn, 1)
+
+	h <- hub.Connect{Conn: eu, Topics: []hub.Topic{hub.Pattern("orders/eu/+")}}
+	h <- hub.Connect{Conn: all, Topics: []hub.Topic{hub.Pattern("orders/#")}}
+	h <- hub.ConnectEach{Conn: one, Topics: []hub.TopicConn{{Topic: hub.Pattern("#"), MessageCount: 1}}}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"orders/eu/1"}}
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"orders/us/1"}}
+	h <- hub.Message{Message: "Third", Topics: []hub.Topic{"orders/eu/2", "orders"}}
+	h <- hub.Message{Message: "Fourth", Topics: []hub.Topic{hub.Pattern("orders/#")}}
+	h <- hub.Message{Message: "Fifth", Topics: []hub.Topic{"orders/eu/1/items"}}
+	h.Disconnect(eu, hub.Pattern("orders/eu/+"))
+	close(h)
+	<-done
+
+	checkContents(t, eu, "First", "Third")
+	checkContents(t, all, "First", "Second", "Third", "Third", "Fourth", "Fifth")
+	checkContents(t, one, "First")
+}
+
+func TestPatternClose(t *testing.T) {
+	h, done := hub.New()
+	exact, wildcard, broad, other := make(hub.Conn), make(hub.Conn), make(hub.Conn, 2), make(hub.Conn, 1)
+
+	h <- hub.Connect{Conn: exact, Topics: []hub.Topic{"orders/eu/1"}}
+	h <- hub.Connect{Conn: wildcard, Topics: []hub.Topic{hub.Pattern("orders/eu/+")}}
+	h <- hub.Connect{Conn: broad, Topics: []hub.Topic{hub.Pattern("#")}}
+	h <- hub.Connect{Conn: other, Topics: []hub.Topic{"orders"}}
+	h.Close(hub.Pattern("orders/+/#"))
+	h <- hub.Message{Message: "Hello", Topics: []hub.Topic{"orders/eu/1"}}
+	h <- hub.Message{Message: "Hello again", Topics: []hub.Topic{"orders"}}
+	close(h)
+	<-done
+
+	checkContents(t, exact)
+	checkContents(t, wildcard)
+	checkContents(t, broad, "Hello", "Hello again")
+	checkContents(t, other, "Hello again")
+}
+
+func TestFilter(t *testing.T) {
+	h, done := hub.New()
+	topics := []hub.Topic{"A", "B"}
+	conn := make(hub.Conn, 3)
+	long := func(msg interface{}) bool { return len(msg.(string)) > 3 }
+
+	h <- hub.Connect{Conn: conn, Topics: topics, MessageCount: 3, Filter: long}
+	for _, msg := range []string{"One", "Two", "Three", "Four", "Five"} {
+		h <- hub.Message{Message: msg, Topics: topics}
+	}
+	close(h)
+	<-done
+
+	checkContents(t, conn, "Three", "Three", "Four")
+}
+
+func TestFilterPerTopic(t *testing.T) {
+	h, done := hub.NewOf[int]()
+	conn := make(hub.ConnOf[int], 6)
+	even := func(n int) bool { return n%2 == 0 }
+
+	h <- hub.ConnectEachOf[int]{
+		Conn: conn,
+		Topics: []hub.TopicConnOf[int]{
+			{Topic: "A", MessageCount: 1, Filter: even},
+			{Topic: "B"},
+		},
+	}
+	for i := 1; i <= 3; i++ {
+		h.Send(i, "A", "B")
+	}
+	// the filters are replaced when the command is resent
+	h <- hub.ConnectEachOf[int]{
+		Conn:   conn,
+		Topics: []hub.TopicConnOf[int]{{Topic: "B", Filter: even}},
+		Filter: func(n int) bool { return n > 2 },
+	}
+	for i := 4; i <= 6; i++ {
+		h.Send(i, "B")
+	}
+	h.DisconnectAll(conn)
+	close(h)
+	<-done
+
+	var got []int
+	for n := range conn {
+		got = append(got, n)
+	}
+
+	if expected := []int{1, 2, 2, 3, 4, 6}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestRetain(t *testing.T) {
+	h, done := hub.New()
+	before, after, once := make(hub.Conn, 2), make(hub.Conn, 2), make(hub.Conn, 1)
+
+	h <- hub.Connect{Conn: before, Topics: []hub.Topic{"A"}}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"A"}, Retain: true}
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"A", "B"}, Retain: true}
+	h <- hub.Message{Message: "Not retained", Topics: []hub.Topic{"B"}}
+	h <- hub.Connect{Conn: after, Topics: []hub.Topic{"A", "B"}}
+	h <- hub.Connect{Conn: once, Topics: []hub.Topic{"A", "B"}, MessageCount: 1}
+	// already connected to A, so the retained message isn't sent again
+	h <- hub.Connect{Conn: after, Topics: []hub.Topic{"A"}}
+	close(h)
+	<-done
+
+	checkContents(t, before, "First", "Second")
+	checkContents(t, after, "Second", "Second")
+	checkContents(t, once, "Second")
+}
+
+func TestRetainPattern(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 2)
+
+	h <- hub.Message{Message: "EU", Topics: []hub.Topic{"orders/eu"}, Retain: true}
+	h <- hub.Message{Message: "US", Topics: []hub.Topic{"orders/us"}, Retain: true}
+	h <- hub.Message{Message: "Stock", Topics: []hub.Topic{"stock/eu"}, Retain: true}
+	h <- hub.ClearRetained{hub.Pattern("orders/us/#")}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{hub.Pattern("+/eu")}, Filter: func(msg interface{}) bool {
+		return msg != "Stock"
+	}}
+	h <- hub.Message{Message: "Live", Topics: []hub.Topic{"orders/eu"}}
+	close(h)
+	<-done
+
+	checkContents(t, conn, "EU", "Live")
+}
+
+func TestClearRetained(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 1)
+
+	h <- hub.Message{Message: "Retained", Retain: true}
+	h <- hub.ClearRetained{}
+	h <- conn
+	close(h)
+	<-done
+
+	checkContents(t, conn)
+}
+
+func checkEnvelopes(tb testing.TB, c hub.Conn, expected ...interface{}) []hub.Envelope {
+	tb.Helper()
+
+	var got []interface{}
+	var envelopes []hub.Envelope
+	for v := range c {
+		e := v.(hub.Envelope)
+		got = append(got, e.Message)
+		envelopes = append(envelopes, e)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		tb.Fatalf("Invalid envelope contents.\nExpected %#v\nGot %#v", expected, got)
+	}
+
+	return envelopes
+}
+
+func TestEnvelope(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 3)
+
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A", hub.Pattern("B/+")}, Envelope: true}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"A", "B/1"}}
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"B/2"}}
+	close(h)
+	<-done
+
+	envelopes := checkEnvelopes(t, conn, "First", "First", "Second")
+	if e := envelopes[1]; e.Topic != "B/1" || e.Pattern != "B/+" || e.Sequence != 1 || e.Time.IsZero() {
+		t.Fatalf("Invalid envelope %#v", e)
+	}
+	if e := envelopes[2]; e.Sequence != 2 {
+		t.Fatalf("Invalid envelope sequence %d", e.Sequence)
+	}
+}
+
+func TestEnvelopeTyped(t *testing.T) {
+	h := make(hub.HubOf[int])
+	go func() {
+		h <- hub.ConnectOf[int]{Conn: make(hub.ConnOf[int]), Envelope: true}
+	}()
+
+	assertPanic(t, "Hub should panic if the Conn can't receive envelopes", h.Start)
+}
+
+func TestReplayLast(t *testing.T) {
+	h, done := hub.New()
+	topics := []hub.Topic{"A", "B"}
+	conn, live := make(hub.Conn, 4), make(hub.Conn, 3)
+
+	h <- hub.ConfigureTopics{Topics: topics[:1], History: 3}
+	for _, msg := range []string{"First", "Second", "Third", "Fourth"} {
+		h <- hub.Message{Message: msg, Topics: topics, Retain: true}
+	}
+	h <- hub.Connect{Conn: conn, Topics: topics, ReplayLast: 2, MessageCount: 4}
+	h <- hub.Connect{Conn: live, Topics: topics[:1]}
+	h <- hub.Message{Message: "Fifth", Topics: topics[:1]}
+	h <- hub.Message{Message: "Sixth", Topics: topics[:1]}
+	close(h)
+	<-done
+
+	// B has no history, so its retained message is sent instead
+	checkContents(t, conn, "Third", "Fourth", "Fourth", "Fifth")
+	checkContents(t, live, "Fourth", "Fifth", "Sixth")
+}
+
+func TestReplaySince(t *testing.T) {
+	h, done := hub.New()
+	first, second := make(hub.Conn, 2), make(hub.Conn, 2)
+
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{hub.Pattern("orders/#")}}
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{hub.Pattern("orders/#")}, History: 10}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"orders/eu"}}
+	h <- hub.Connect{Conn: first, Topics: []hub.Topic{hub.Pattern("orders/+")}, Envelope: true, MessageCount: 2}
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"orders/us"}}
+	close(h)
+	<-done
+
+	// no replay was requested, so only the messages published afterwards are received
+	if e := checkEnvelopes(t, first, "Second"); e[0].Sequence != 2 {
+		t.Fatalf("Expected sequence 2, got %d", e[0].Sequence)
+	}
+
+	h, done = hub.New()
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{hub.Pattern("orders/#")}, History: 10}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"orders/eu"}}
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"orders/us"}}
+	h <- hub.Message{Message: "Third", Topics: []hub.Topic{"orders/eu"}}
+	h <- hub.Message{Message: "Other", Topics: []hub.Topic{"stock/eu"}}
+	h <- hub.Connect{Conn: second, Topics: []hub.Topic{hub.Pattern("orders/+")}, ReplaySince: 1}
+	close(h)
+	<-done
+
+	checkContents(t, second, "Second", "Third")
+}
+
+func TestReplayMaxAge(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 1)
+
+	h <- hub.ConfigureTopics{MaxAge: 50 * time.Millisecond}
+	h <- "Old"
+	time.Sleep(100 * time.Millisecond)
+	h <- "New"
+	h <- hub.Connect{Conn: conn, ReplayLast: 10}
+	close(h)
+	<-done
+
+	checkContents(t, conn, "New")
+}
+
+func TestConfigureTopicsDiscard(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 1)
+
+	h <- hub.ConfigureTopics{History: 10}
+	h <- "Forgotten"
+	h <- hub.ConfigureTopics{}
+	h <- hub.ConfigureTopics{History: 10}
+	h <- hub.Connect{Conn: conn, ReplayLast: 10}
+	close(h)
+	<-done
+
+	checkContents(t, conn)
+}
+
+func TestDurable(t *testing.T) {
+	h, done := hub.New()
+	topics := []hub.Topic{"A", "B"}
+
+	h <- hub.ConfigureTopics{Topics: topics, History: 10}
+	h <- hub.Message{Message: "Before", Topics: topics}
+
+	first := make(hub.Conn, 2)
+	h <- hub.Connect{Conn: first, Topics: topics, Durable: "worker", MessageCount: 2}
+	h <- hub.Message{Message: "First", Topics: topics}
+	h <- hub.Message{Message: "Second", Topics: topics}
+	h <- hub.Message{Message: "Third", Topics: topics[:1]}
+
+	second := make(hub.Conn, 4)
+	h <- hub.Connect{Conn: second, Topics: topics, Durable: "worker"}
+	h <- hub.Message{Message: "Fourth", Topics: topics[1:]}
+	close(h)
+	<-done
+
+	checkContents(t, first, "First", "First")
+	checkContents(t, second, "Second", "Third", "Second", "Fourth")
+}
+
+func TestDurableManualCommit(t *testing.T) {
+	h, done := hub.New()
+
+	h <- hub.ConfigureTopics{History: 10}
+
+	first := make(hub.Conn, 3)
+	h <- hub.Connect{Conn: first, Durable: "worker", ManualCommit: true, Envelope: true}
+	h <- "First"
+	h <- "Second"
+	h <- "Third"
+	h.DisconnectAll(first)
+
+	envelopes := checkEnvelopes(t, first, "First", "Second", "Third")
+	h <- hub.Commit{Name: "worker", Sequence: envelopes[0].Sequence}
+
+	second := make(hub.Conn, 2)
+	h <- hub.Connect{Conn: second, Durable: "worker", ManualCommit: true}
+	close(h)
+	<-done
+
+	checkContents(t, second, "Second", "Third")
+}
+
+func TestDurablePersisted(t *testing.T) {
+	dir := t.TempDir()
+	topics := []hub.Topic{"A", hub.Pattern("B/+")}
+
+	run := func(conn hub.Conn, messages ...hub.Message) {
+		s := openStore(t, dir, hub.FileStoreOptions{})
+		defer s.Close()
+
+		h, done := hub.New(hub.WithStore(s, nil))
+		h <- hub.ConfigureTopics{Topics: []hub.Topic{"A", hub.Pattern("B/#")}, Persist: true}
+		if conn != nil {
+			h <- hub.Connect{Conn: conn, Topics: topics, Durable: "worker", MessageCount: 2}
+		}
+		for _, msg := range messages {
+			h <- msg
+		}
+		close(h)
+		<-done
+	}
+
+	first, second := make(hub.Conn, 2), make(hub.Conn, 3)
+	run(first, hub.Message{Message: "First", Topics: []hub.Topic{"A", "B/1"}})
+	run(nil, hub.Message{Message: "Second", Topics: []hub.Topic{"A", "B/2"}})
+	run(second)
+
+	checkContents(t, first, "First", "First")
+	checkContents(t, second, "Second", "Second")
+}
+
+func receiveDelivery(tb testing.TB, c hub.Conn, message interface{}, attempt int) *hub.Delivery {
+	tb.Helper()
+
+	select {
+	case v := <-c:
+		d, ok := v.(*hub.Delivery)
+		if !ok || d.Message != message || d.Attempt != attempt {
+			tb.Fatalf("Expected %v at attempt %d, got %#v", message, attempt, v)
+		}
+		return d
+	case <-time.After(time.Second):
+		tb.Fatalf("Expected %v at attempt %d, got nothing", message, attempt)
+		return nil
+	}
+}
+
+func TestAck(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+
+	h <- hub.Connect{Conn: conn, Ack: true, AckTimeout: 10 * time.Millisecond, MessageCount: 2}
+	h <- "First"
+
+	first := receiveDelivery(t, conn, "First", 1)
+	// the first delivery times out
+	receiveDelivery(t, conn, "First", 2).Nack()
+	// a late acknowledgement of a previous delivery still settles the message
+	receiveDelivery(t, conn, "First", 3)
+	first.Ack()
+
+	h <- "Second"
+	second := receiveDelivery(t, conn, "Second", 1)
+	second.Ack()
+	second.Nack()
+
+	close(h)
+	<-done
+
+	for msg := range conn {
+		t.Fatalf("Unexpected message %v", msg)
+	}
+}
+
+func TestAckDurable(t *testing.T) {
+	h, done := hub.New()
+
+	h <- hub.ConfigureTopics{History: 10}
+
+	first := make(hub.Conn, 3)
+	h <- hub.Connect{Conn: first, Durable: "worker", Ack: true, MessageCount: 3}
+	h <- "First"
+	h <- "Second"
+	h <- "Third"
+
+	receiveDelivery(t, first, "First", 1).Ack()
+	receiveDelivery(t, first, "Second", 1)
+	receiveDelivery(t, first, "Third", 1).Ack()
+
+	second := make(hub.Conn, 2)
+	h <- hub.Connect{Conn: second, Durable: "worker"}
+	close(h)
+	<-done
+
+	checkContents(t, second, "Second", "Third")
+}
+
+func TestAckTyped(t *testing.T) {
+	h := make(hub.HubOf[int])
+	go func() {
+		h <- hub.ConnectOf[int]{Conn: make(hub.ConnOf[int]), Ack: true}
+	}()
+
+	assertPanic(t, "Hub should panic if the Conn can't receive deliveries", h.Start)
+}
+
+func TestDeadLetter(t *testing.T) {
+	h, done := hub.New(hub.WithDeadLetter("dead"))
+	dead, full, unacked := make(hub.Conn, 3), make(hub.Conn), make(hub.Conn)
+
+	h <- hub.Connect{Conn: dead, Topics: []hub.Topic{"dead"}}
+	h <- hub.Message{Message: "Nobody", Topics: []hub.Topic{"A", "B"}}
+	h <- hub.Message{Message: "Retained", Topics: []hub.Topic{"A"}, Retain: true}
+
+	h <- hub.Connect{Conn: full, Topics: []hub.Topic{"full"}, Policy: hub.DropNewest, QueueSize: 1}
+	h.Send("Queued", "full")
+	h.Send("Dropped", "full")
+
+	h <- hub.Connect{Conn: unacked, Topics: []hub.Topic{"unacked"}, Ack: true, AckTimeout: 10 * time.Millisecond, MaxAttempts: 2}
+	h.Send("Unacked", "unacked")
+	receiveDelivery(t, unacked, "Unacked", 1)
+	receiveDelivery(t, unacked, "Unacked", 2)
+
+	expected := []struct {
+		message  string
+		reason   hub.DeadLetterReason
+		topics   []hub.Topic
+		sequence uint64
+		attempts int
+	}{
+		{"Nobody", hub.NoSubscribers, []hub.Topic{"A", "B"}, 1, 0},
+		{"Dropped", hub.ConnFull, []hub.Topic{"full"}, 5, 0},
+		{"Unacked", hub.MaxAttemptsExceeded, []hub.Topic{"unacked"}, 7, 2},
+	}
+	for _, e := range expected {
+		var d hub.DeadLetter
+		select {
+		case v := <-dead:
+			d = v.(hub.DeadLetter)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected dead letter for %q", e.message)
+		}
+
+		if d.Message != e.message || d.Reason != e.reason || !reflect.DeepEqual(d.Topics, e.topics) ||
+			d.Sequence != e.sequence || d.Attempts != e.attempts || d.Failed.Before(d.Time) {
+			t.Fatalf("Invalid dead letter %+v, expected %+v", d, e)
+		}
+	}
+
+	close(h)
+	<-done
+	checkContents(t, full, "Queued")
+}
+
+func TestDeadLetterTyped(t *testing.T) {
+	assertPanic(t, "Hub should panic if it can't publish dead letters", func() {
+		_ = make(hub.HubOf[int]).Run(context.Background(), hub.WithDeadLetter("dead"))
+	})
+}
+
+func respond(h hub.Hub, topic hub.Topic, reply func(msg interface{}) interface{}) {
+	conn := make(hub.Conn)
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{topic}, Policy: hub.DropNewest}
+
+	go func() {
+		for msg := range conn {
+			q := msg.(hub.Query)
+			if r := reply(q.Message); r != nil {
+				_ = q.Reply(context.Background(), r)
+			}
+		}
+	}()
+}
+
+func TestRequest(t *testing.T) {
+	h, done := hub.New()
+	defer func() {
+		close(h)
+		<-done
+	}()
+
+	for i := 1; i <= 3; i++ {
+		i := i
+		respond(h, "double", func(msg interface{}) interface{} { return msg.(int) * 2 * i })
+	}
+	respond(h, "silent", func(interface{}) interface{} { return nil })
+
+	ctx := context.Background()
+
+	if reply, err := h.Request(ctx, 1, "double"); err != nil || reply.(int)%2 != 0 {
+		t.Fatalf("Invalid reply %v, error %v", reply, err)
+	}
+
+	replies, err := h.RequestN(ctx, 2, 2, "double")
+	if err != nil || len(replies) != 2 {
+		t.Fatalf("Invalid replies %v, error %v", replies, err)
+	}
+
+	deadline, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	replies, err = h.RequestN(deadline, 3, 0, "double", "silent")
+	sum := 0
+	for _, r := range replies {
+		sum += r.(int)
+	}
+	if err != nil || sum != 36 {
+		t.Fatalf("Invalid replies %v, error %v", replies, err)
+	}
+
+	if _, err := h.Request(deadline, 4, "silent"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if _, err := h.Request(ctx, 5, "nobody"); !errors.Is(err, hub.ErrNoResponders) {
+		t.Fatalf("Expected no responders, got %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn)
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"slow"}, Policy: hub.DropNewest}
+
+	responded := make(chan struct{})
+	go func() {
+		defer close(responded)
+		for msg := range conn {
+			time.Sleep(5 * time.Millisecond)
+			_ = msg.(hub.Query).Reply(context.Background(), msg.(hub.Query).Message)
+		}
+	}()
+
+	defer func() {
+		h <- hub.Disconnect{Conn: conn, Topics: []hub.Topic{"slow"}}
+		<-responded
+		close(h)
+		<-done
+	}()
+
+	// the inbox is closed when the context is done, which must not be reported as
+	// a request without responders
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err := h.Request(ctx, i, "slow")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected deadline exceeded, got %v", err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+		replies, err := h.RequestN(ctx, i, 0, "slow")
+		cancel()
+		if err != nil || len(replies) != 0 {
+			t.Fatalf("Invalid replies %v, error %v", replies, err)
+		}
+
+		// the inbox can even be closed before the reply is awaited
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		if _, err := h.Request(ctx, i, "slow"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context canceled, got %v", err)
+		}
+	}
+}
+
+func TestRequestHubClosed(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 1)
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"silent"}}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := h.Request(context.Background(), 1, "silent")
+		errc <- err
+	}()
+
+	// the Hub is closed once the request is received, before it is answered
+	<-conn
+	close(h)
+	<-done
+
+	if err := <-errc; !errors.Is(err, hub.ReasonHubClosed) {
+		t.Fatalf("Expected the Hub to be closed, got %v", err)
+	}
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	h, done := hub.New()
+	workers := []hub.Conn{make(hub.Conn, 2), make(hub.Conn, 2), make(hub.Conn, 2)}
+	observer := make(hub.Conn, 6)
+
+	for _, w := range workers {
+		h <- hub.ConnectEach{Conn: w, Topics: []hub.TopicConn{{Topic: "jobs", Group: "workers"}}}
+	}
+	h <- hub.Connect{Conn: observer, Topics: []hub.Topic{"jobs"}}
+
+	for i := 0; i < 6; i++ {
+		h.Send(i, "jobs")
+	}
+	close(h)
+	<-done
+
+	checkContents(t, workers[0], 0, 3)
+	checkContents(t, workers[1], 1, 4)
+	checkContents(t, workers[2], 2, 5)
+	checkContents(t, observer, 0, 1, 2, 3, 4, 5)
+}
+
+func TestGroupKeyHash(t *testing.T) {
+	h, done := hub.New()
+	workers := []hub.Conn{make(hub.Conn, 6), make(hub.Conn, 6)}
+	key := func(msg interface{}) string { return msg.(string)[:1] }
+
+	for _, w := range workers {
+		h <- hub.ConnectEach{Conn: w, Topics: []hub.TopicConn{{Topic: "orders", Group: "workers", Balance: hub.KeyHash, Key: key}}}
+	}
+	for _, msg := range []string{"a1", "b1", "a2", "c1", "b2", "a3"} {
+		h.Send(msg, "orders")
+	}
+	close(h)
+	<-done
+
+	owners := map[string]int{}
+	for i, w := range workers {
+		for msg := range w {
+			k := key(msg)
+			if owner, ok := owners[k]; ok && owner != i {
+				t.Fatalf("Messages with key %q received by multiple workers", k)
+			}
+			owners[k] = i
+		}
+	}
+	if len(owners) != 3 {
+		t.Fatalf("Expected all keys to be received, got %v", owners)
+	}
+}
+
+func TestGroupLeastLoaded(t *testing.T) {
+	h, done := hub.New()
+	busy, idle := make(hub.Conn, 3), make(hub.Conn, 3)
+
+	for _, w := range []hub.Conn{busy, idle} {
+		h <- hub.ConnectEach{
+			Conn:   w,
+			Topics: []hub.TopicConn{{Topic: "jobs", Group: "workers", Balance: hub.LeastLoaded}},
+			Ack:    true,
+		}
+	}
+
+	h.Send("First", "jobs")
+	receiveDelivery(t, busy, "First", 1)
+	h.Send("Second", "jobs")
+	receiveDelivery(t, idle, "Second", 1).Ack()
+	h.Send("Third", "jobs")
+	receiveDelivery(t, idle, "Third", 1)
+
+	// the members that leave the group don't receive its messages anymore
+	h.Disconnect(idle, "jobs")
+	h.Send("Fourth", "jobs")
+	receiveDelivery(t, busy, "Fourth", 1)
+
+	close(h)
+	<-done
+}
+
+func TestInspect(t *testing.T) {
+	h, done := hub.New()
+	limited, full := make(hub.Conn, 3), make(hub.Conn)
+
+	h <- hub.ConnectEach{
+		Conn:         limited,
+		Topics:       []hub.TopicConn{{Topic: "A", MessageCount: 3}, {Topic: "B", Group: "workers"}},
+		MessageCount: 5,
+		KeepAlive:    true,
+	}
+	h <- hub.Connect{Conn: full, Topics: []hub.Topic{"B"}, Policy: hub.DropNewest, QueueSize: 1}
+	// the subscription's counters are reported for the topics bound to it
+	subscribed := make(hub.Conn, 1)
+	h <- hub.ConnectEach{
+		Conn:         subscribed,
+		Topics:       []hub.TopicConn{{Topic: "A", MessageCount: 4}, {Topic: "D", MessageCount: 1}, {Topic: "E"}},
+		MessageCount: 3,
+		Subscription: &hub.Subscription{},
+	}
+	h <- hub.Message{Message: "First", Topics: []hub.Topic{"A", "C"}, Retain: true}
+	receivers := make(chan int, 2)
+	h <- hub.Message{Message: "Second", Topics: []hub.Topic{"B"}, Receivers: receivers}
+	h <- hub.Message{Message: "Third", Topics: []hub.Topic{"B"}, Receivers: receivers}
+
+	s := h.Inspect()
+	close(h)
+	<-done
+
+	if s.Published != 3 || s.Delivered != 5 || s.Dropped != 1 {
+		t.Fatalf("Invalid counters %+v", s)
+	}
+	// the third message is dropped by the Conn with the full queue
+	if second, third := <-receivers, <-receivers; second != 2 || third != 1 {
+		t.Fatalf("Invalid receivers %d and %d", second, third)
+	}
+
+	expectedTopics := map[hub.Topic]hub.TopicStats{
+		"A": {Subscribers: 2, Retained: true},
+		"B": {Subscribers: 2, Groups: map[string]int{"workers": 1}},
+		"C": {Retained: true},
+		"D": {Subscribers: 1},
+		"E": {Subscribers: 1},
+	}
+	if !reflect.DeepEqual(s.Topics, expectedTopics) {
+		t.Fatalf("Expected topics %+v, got %+v", expectedTopics, s.Topics)
+	}
+
+	expectedConns := map[hub.Conn]hub.ConnStats{
+		limited:    {Topics: map[hub.Topic]hub.Number{"A": 2, "B": 0}, Remaining: 2, KeepAlive: true},
+		full:       {Topics: map[hub.Topic]hub.Number{"B": 0}, Queued: 1},
+		subscribed: {Topics: map[hub.Topic]hub.Number{"A": 2, "D": 1, "E": 2}},
+	}
+	if !reflect.DeepEqual(s.Conns, expectedConns) {
+		t.Fatalf("Expected conns %+v, got %+v", expectedConns, s.Conns)
+	}
+}
+
+func TestReceiversNotReady(t *testing.T) {
+	h, done := hub.New()
+
+	// the Hub doesn't wait for the count to be received
+	h <- hub.Message{Message: "Hello world!", Receivers: make(chan int)}
+	if s := h.Inspect(); s.Published != 1 {
+		t.Fatalf("Expected the message to be published, got %+v", s)
+	}
+
+	close(h)
+	<-done
+}
+
+func TestInspectInternal(t *testing.T) {
+	h, done := hub.New(hub.WithDeadLetter("dead"), hub.WithSystemTopic("system"))
+	responder := make(hub.Conn, 1)
+	h <- hub.Connect{Conn: responder, Topics: []hub.Topic{"silent"}}
+
+	// the request's inbox and Conn aren't reported
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _, _ = h.Request(ctx, 1, "silent") }()
+	<-responder
+
+	// the message is dead-lettered, and the Hub publishes events for the topics
+	h.Send("Nobody", "nobody")
+
+	s := h.Inspect()
+	cancel()
+	close(h)
+	<-done
+
+	if s.Published != 2 {
+		t.Fatalf("Expected the request and the message to be counted, got %d", s.Published)
+	}
+	if len(s.Conns) != 1 || len(s.Topics) != 1 || s.Topics["silent"].Subscribers != 1 {
+		t.Fatalf("Expected only the responder, got %+v", s)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var events []hub.Event
+	h, done := hub.New(hub.OnEvent(func(e hub.Event) {
+		events = append(events, e)
+	}))
+
+	conn := make(hub.Conn, 1)
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}, MessageCount: 1}
+	h.Send("Hello world!", "A")
+	close(h)
+	<-done
+
+	expected := []hub.Event{
+		{Kind: hub.TopicCreated, Topic: "A"},
+		{Kind: hub.Connected, Topic: "A", Conn: conn},
+		{Kind: hub.Disconnected, Topic: "A", Conn: conn},
+		{Kind: hub.TopicDeleted, Topic: "A"},
+		{Kind: hub.ConnClosed, Conn: conn, Reason: hub.ReasonMessageCount},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestSystemTopic(t *testing.T) {
+	h, done := hub.New(hub.WithSystemTopic("$SYS"))
+	system, conn := make(hub.Conn, 5), make(hub.Conn)
+
+	h <- hub.Connect{Conn: system, Topics: []hub.Topic{"$SYS"}}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}}
+	h.Close("A")
+	close(h)
+	<-done
+
+	checkContents(t, system,
+		hub.Event{Kind: hub.TopicCreated, Topic: "A"},
+		hub.Event{Kind: hub.Connected, Topic: "A", Conn: conn},
+		hub.Event{Kind: hub.Disconnected, Topic: "A", Conn: conn},
+		hub.Event{Kind: hub.TopicDeleted, Topic: "A"},
+		hub.Event{Kind: hub.ConnClosed, Conn: conn, Reason: hub.ReasonTopicClosed},
+	)
+}
+
+func TestEventsTyped(t *testing.T) {
+	assertPanic(t, "Hub should panic if the event handler has the wrong type", func() {
+		_ = make(hub.HubOf[int]).Run(context.Background(), hub.OnEvent(func(hub.Event) {}))
+	})
+}
+
+func TestStatus(t *testing.T) {
+	h, done := hub.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	conns := map[hub.CloseReason]hub.Conn{}
+	statuses := map[hub.CloseReason]*hub.Status{}
+
+	connect := func(reason hub.CloseReason, c hub.Connect) {
+		c.Conn, c.Status = make(hub.Conn, 1), &hub.Status{}
+		conns[reason], statuses[reason] = c.Conn, c.Status
+		h <- c
+	}
+
+	connect(hub.ReasonMessageCount, hub.Connect{Topics: []hub.Topic{"A"}, MessageCount: 1})
+	connect(hub.ReasonTopicClosed, hub.Connect{Topics: []hub.Topic{"B"}})
+	connect(hub.ReasonDisconnected, hub.Connect{Topics: []hub.Topic{"C"}})
+	connect(hub.ReasonContextDone, hub.Connect{Topics: []hub.Topic{"C"}, Context: ctx})
+	connect(hub.ReasonHubClosed, hub.Connect{Topics: []hub.Topic{"C"}, KeepAlive: true})
+
+	if err := statuses[hub.ReasonHubClosed].Err(); err != nil {
+		t.Fatalf("Expected no error before the Conn is removed, got %v", err)
+	}
+
+	h.Send("Hello world!", "A")
+	h.Close("B")
+	h.DisconnectAll(conns[hub.ReasonDisconnected])
+	cancel()
+	<-statuses[hub.ReasonContextDone].Done()
+	close(h)
+	<-done
+
+	for reason, s := range statuses {
+		<-s.Done()
+		if s.Reason() != reason || !errors.Is(s.Err(), reason) {
+			t.Fatalf("Expected reason %v, got %v", reason, s.Err())
+		}
+	}
+}
+
+func TestStatusReused(t *testing.T) {
+	h, done := hub.New()
+	status := &hub.Status{}
+
+	first := make(hub.Conn)
+	h <- hub.Connect{Conn: first, Topics: []hub.Topic{"A"}, Status: status}
+	h.DisconnectAll(first)
+	<-status.Done()
+
+	// the Status is ignored by the second Conn, instead of being closed again
+	second := make(hub.Conn)
+	h <- hub.Connect{Conn: second, Topics: []hub.Topic{"A"}, Status: status}
+	close(h)
+	<-done
+
+	if status.Reason() != hub.ReasonDisconnected {
+		t.Fatalf("Expected the first Conn's reason, got %v", status.Reason())
+	}
+}
+
+func TestClosedByConsumer(t *testing.T) {
+	h, done := hub.New()
+
+	for _, policy := range []hub.Policy{hub.Block, hub.DropNewest} {
+		conn, status := make(hub.Conn), &hub.Status{}
+		h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}, Policy: policy, Status: status}
+		close(conn)
+
+		h.Send("Hello world!", "A")
+		<-status.Done()
+		if status.Reason() != hub.ReasonClosedByConsumer {
+			t.Fatalf("Expected the Conn to be closed by the consumer, got %v", status.Reason())
+		}
+	}
+
+	if s := h.Inspect(); len(s.Conns) != 0 {
+		t.Fatalf("Expected the closed Conns to be removed, got %v", s.Conns)
+	}
+
+	close(h)
+	<-done
+}
+
+func TestLeave(t *testing.T) {
+	h, done := hub.New()
+	conn, status := make(hub.Conn, 1), &hub.Status{}
+
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}, Status: status}
+	h.Send("First", "A")
+	h.Send("Second", "A")
+
+	// the Hub is waiting for the Conn to receive the second message
+	status.Leave()
+	<-status.Done()
+	h.Send("Third", "A")
+	close(h)
+	<-done
+
+	checkContents(t, conn, "First")
+	if status.Reason() != hub.ReasonLeft {
+		t.Fatalf("Expected the consumer to have left, got %v", status.Reason())
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 4)
+
+	a, b := &hub.Subscription{}, &hub.Subscription{}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}, Subscription: a}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A", "B"}, MessageCount: 2, Subscription: b}
+
+	h.Send("First", "A")
+	h.Inspect()
+	if r := b.Remaining(); r != 1 {
+		t.Fatalf("Expected 1 remaining message, got %d", r)
+	}
+
+	h.Send("Second", "B")
+	<-b.Done()
+	if topics := b.Topics(); len(topics) != 0 {
+		t.Fatalf("Expected no topics after the subscription ended, got %v", topics)
+	}
+	if topics := a.Topics(); !reflect.DeepEqual(topics, []hub.Topic{"A"}) {
+		t.Fatalf("Expected the other subscription to keep its topics, got %v", topics)
+	}
+
+	h.Send("Third", "B")
+	h.Send("Fourth", "A")
+	h.Inspect()
+	a.Cancel()
+	<-a.Done()
+	close(h)
+	<-done
+
+	checkContents(t, conn, "First", "Second", "Fourth")
+}
+
+func TestSubscriptionCancelFromConsumer(t *testing.T) {
+	h, done := hub.New()
+	conn, s := h.Subscribe(nil, "A")
+
+	go func() {
+		for v := range conn {
+			if v == "Second" {
+				s.Cancel()
+			}
+		}
+	}()
+
+	h.Send("First", "A")
+	h.Send("Second", "A")
+	h.Send("Third", "A")
+	<-s.Done()
+	close(h)
+	<-done
+}
+
+func TestSubscriptionDirect(t *testing.T) {
+	h, done := hub.New()
+	conn := make(hub.Conn, 2)
+
+	s := &hub.Subscription{}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}}
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A"}, Subscription: s}
+	s.Cancel()
+	<-s.Done()
+
+	h.Send("First", "A")
+	h.Close("A")
+	close(h)
+	<-done
+
+	checkContents(t, conn, "First")
+}
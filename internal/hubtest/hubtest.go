@@ -0,0 +1,79 @@
+// Package hubtest provides the fixtures shared by the tests of the servers and clients
+// of the Hub.
+package hubtest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+)
+
+// Timeout is how long WaitConns waits before failing the test.
+const Timeout = 5 * time.Second
+
+// ServeFunc serves the Hub on the listener until the context is done.
+type ServeFunc[T any] func(ctx context.Context, h hub.HubOf[T], l net.Listener) error
+
+// Serve starts a Hub and a server for it on a loopback address, which is returned.
+// They are stopped when the test ends: first the server, then the Hub.
+func Serve[T any](tb testing.TB, serve ServeFunc[T], opts ...hub.Option) (hub.HubOf[T], string) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	h, done := hub.NewOf[T](opts...)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+
+	go func() {
+		_ = serve(ctx, h, l)
+		close(served)
+	}()
+
+	tb.Cleanup(func() {
+		cancel()
+		<-served
+		close(h)
+		<-done
+	})
+
+	return h, l.Addr().String()
+}
+
+// WaitConns waits until the Hub has the given number of Conns, so the commands of
+// different clients are executed in order. The test fails if this takes longer than
+// Timeout.
+func WaitConns[T any](tb testing.TB, h hub.HubOf[T], n int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(Timeout)
+	for {
+		got := len(h.Inspect().Conns)
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("Expected %d Conns, got %d after %s", n, got, Timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Dial connects to the address over TCP. The connection is closed when the test ends.
+func Dial(tb testing.TB, addr string) net.Conn {
+	tb.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
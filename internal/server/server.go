@@ -0,0 +1,74 @@
+// Package server provides the parts shared by the servers which speak a protocol
+// over a net.Conn on behalf of a Hub.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/tmaxmax/hub"
+)
+
+// Serve accepts connections on the listener and serves each of them in its own goroutine,
+// until the context is done or the listener fails. The listener is closed and all the
+// connections are served to completion before Serve returns the context's error or the
+// listener's.
+func Serve(ctx context.Context, l net.Listener, serve func(ctx context.Context, c net.Conn)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(ctx, c)
+		}()
+	}
+}
+
+// Command sends the command to the Hub, unless the context is done first.
+func Command(ctx context.Context, h hub.Hub, cmd interface{}) {
+	select {
+	case h <- cmd:
+	case <-ctx.Done():
+	}
+}
+
+// Encode returns strings and byte slices as they are and encodes the other messages as JSON.
+func Encode(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case string:
+		return []byte(m), nil
+	case []byte:
+		return m, nil
+	default:
+		return json.Marshal(m)
+	}
+}
+
+// Policy returns the Policy of the clients' Conns. The servers never let the Hub wait
+// for a client, so the default and Block are replaced with DisconnectOnFull.
+func Policy(p hub.Policy) hub.Policy {
+	if p == hub.Block {
+		return hub.DisconnectOnFull
+	}
+	return p
+}
@@ -1,21 +1,111 @@
 package hub
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
 type (
-	counter      Number
-	connRefCount struct {
+	counter             Number
+	connRefCount[T any] struct {
 		topics   counter
 		messages counter
 		keep     bool
+		envelope bool
+		filter   func(T) bool
+		queue    *queue[T]
+		durable  *durable
+		status   *Status
+		// ackTimeout is positive if the connection is in ack mode. pending holds the
+		// messages it hasn't acknowledged yet, and acked the sequence number of the
+		// last message acknowledged from each topic.
+		ackTimeout  time.Duration
+		maxAttempts Number
+		pending     map[*pending[T]]struct{}
+		acked       map[Topic]uint64
+		// removed is closed when the connection is removed, so the goroutines
+		// watching the connection stop. It is nil if there are none.
+		removed chan struct{}
+		// aborted is closed when the connection must be removed without waiting for the
+		// Hub, which could be waiting itself for the consumer. See abort.
+		aborted     chan struct{}
+		abortOnce   sync.Once
+		abortReason CloseReason
+	}
+	// topicRef is the state of a connection's connection to a topic.
+	topicRef[T any] struct {
+		messages counter
+		filter   func(T) bool
+		// group is the name of the queue group the connection is in, if any.
+		group string
+		// direct is true if the connection was connected to the topic without a Subscription.
+		// subs are the connection's subscriptions which have the topic.
+		direct bool
+		subs   map[*SubscriptionOf[T]]struct{}
 	}
-	manager struct {
-		topics map[Topic]map[Conn]*counter
-		conns  map[Conn]*connRefCount
+	// cancellation is sent by a connection's supervisor when the connection is aborted,
+	// or when one of its subscriptions is canceled.
+	cancellation[T any] struct {
+		conn ConnOf[T]
+		ref  *connRefCount[T]
+		sub  *SubscriptionOf[T]
+	}
+	manager[T any] struct {
+		topics map[Topic]map[ConnOf[T]]*topicRef[T]
+		conns  map[ConnOf[T]]*connRefCount[T]
+		// draining holds the queues of the removed KeepAlive connections, so that
+		// if they are connected again the old queue is flushed before the new one.
+		draining      map[ConnOf[T]]*queue[T]
+		drainingSweep int
+		cancels       chan cancellation[T]
+		acks          *acker[T]
+		stopped       chan struct{}
+		// patterns indexes the Pattern topics in topics.
+		patterns trie
+		retained map[Topic]*entry[T]
+		groups   map[Topic]map[string]*group[T]
+		// seq is the sequence number of the last published message.
+		seq       uint64
+		histories map[Topic]*history[T]
+		configs   map[Topic]topicConfig
+		// patternConfigs holds the configurations sent for patterns, in the order they were sent.
+		patternConfigs []patternConfig
+		opts           options
+		durables       map[string]*durable
+		// dead holds the dead letters that weren't published yet.
+		dead []T
+		// events holds the lifecycle events that weren't handled yet.
+		events []EventOf[T]
+		// hub is the channel the manager receives commands on, to which queries are replied.
+		hub     HubOf[T]
+		inboxes uint64
+		metrics metrics
+		// err is the error that stops the Hub, if there is no error handler.
+		err error
 	}
 )
 
-func newCounter(init Number) *counter {
-	v := counter(init)
-	return &v
+func newTopicRef[T any](t *TopicConnOf[T], sub *SubscriptionOf[T]) *topicRef[T] {
+	if sub != nil {
+		// the subscription counts the messages
+		return &topicRef[T]{filter: t.Filter}
+	}
+	return &topicRef[T]{
+		messages: counter(t.MessageCount),
+		filter:   t.Filter,
+	}
+}
+
+// bind binds the connection's topic to the subscription, or marks it as connected
+// directly if there is no subscription.
+func (tr *topicRef[T]) bind(t *TopicConnOf[T], sub *SubscriptionOf[T]) {
+	if sub == nil {
+		tr.direct = true
+		return
+	}
+	sub.bind(t.Topic, tr, t.MessageCount)
 }
 
 func (c *counter) inc() {
@@ -41,6 +131,11 @@ func (c *counter) reset(init Number) {
 	*c = counter(init)
 }
 
+// accepts reports whether the message passes the filter, if there is one.
+func accepts[T any](filter func(T) bool, msg T) bool {
+	return filter == nil || filter(msg)
+}
+
 func getTopics(initial []Topic, defaultIfNone bool) []Topic {
 	if defaultIfNone && len(initial) == 0 {
 		return []Topic{nil}
@@ -48,87 +143,295 @@ func getTopics(initial []Topic, defaultIfNone bool) []Topic {
 	return initial
 }
 
-func newManager() *manager {
-	return &manager{
-		topics: map[Topic]map[Conn]*counter{},
-		conns:  map[Conn]*connRefCount{},
+func newManager[T any](opts options) *manager[T] {
+	return &manager[T]{
+		opts:     opts,
+		topics:   map[Topic]map[ConnOf[T]]*topicRef[T]{},
+		conns:    map[ConnOf[T]]*connRefCount[T]{},
+		draining: map[ConnOf[T]]*queue[T]{},
+		cancels:  make(chan cancellation[T]),
+		acks:     newAcker[T](),
+		stopped:  make(chan struct{}),
 	}
 }
 
-func (m *manager) close() {
+func (m *manager[T]) close() {
+	close(m.stopped)
+	m.acks.close()
+	for t, conns := range m.topics {
+		for _, tr := range conns {
+			m.release(t, tr)
+		}
+	}
 	for c, ref := range m.conns {
-		if !ref.keep {
-			close(c)
+		m.closeConn(c, ref, ReasonHubClosed)
+	}
+	for _, d := range m.durables {
+		m.saveOffsets(d)
+	}
+	m.handleEvents(false)
+}
+
+// watch disconnects the connection when the context is done.
+func (m *manager[T]) watch(ctx context.Context, c ConnOf[T], ref *connRefCount[T]) {
+	m.supervise(c, ref)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ref.abort(ReasonContextDone)
+		case <-m.stopped:
+		case <-ref.removed:
 		}
+	}()
+}
+
+// cancel disconnects the connection if it wasn't removed after it was aborted,
+// or ends the canceled subscription.
+func (m *manager[T]) cancel(c cancellation[T]) {
+	if c.sub != nil {
+		m.unsubscribe(c.sub, ReasonDisconnected)
+	} else if m.conns[c.conn] == c.ref {
+		m.removeConn(c.conn, c.ref.abortReason)
 	}
 }
 
-func (m *manager) getTopicConns(t Topic) map[Conn]*counter {
+// closeConn closes the connection's channel if KeepAlive wasn't specified. If the connection
+// has a queue, the channel is closed after all the queued messages are delivered.
+func (m *manager[T]) closeConn(c ConnOf[T], ref *connRefCount[T], reason CloseReason) {
+	m.emit(ConnClosed, nil, c, reason)
+	if ref.status != nil {
+		ref.status.close(reason)
+	}
+
+	if ref.removed != nil {
+		close(ref.removed)
+	}
+	if ref.durable != nil {
+		m.saveOffsets(ref.durable)
+	}
+	ref.stopPending()
+
+	if ref.queue == nil {
+		if !ref.keep && reason != ReasonClosedByConsumer {
+			tryClose(c)
+		}
+		return
+	}
+
+	ref.queue.close(ref.keep)
+	if !ref.keep {
+		return
+	}
+
+	m.draining[c] = ref.queue
+	if len(m.draining) > 2*m.drainingSweep {
+		for c, q := range m.draining {
+			if q.finished() {
+				delete(m.draining, c)
+			}
+		}
+		m.drainingSweep = len(m.draining)
+	}
+}
+
+// send delivers the message to the connection. It returns false if the message
+// was not delivered because of the connection's policy. If the message is sent
+// for an entry, the entry is dead-lettered if the message is dropped later.
+func (m *manager[T]) send(c ConnOf[T], ref *connRefCount[T], msg T, e *entry[T]) bool {
+	if ref.queue == nil {
+		switch trySend(c, msg, ref.aborted) {
+		case sent:
+			m.metrics.delivered++
+			return true
+		case aborted:
+			m.removeConn(c, ref.abortReason)
+		case connClosed:
+			m.removeConn(c, ReasonClosedByConsumer)
+		}
+		return false
+	}
+
+	ok, dropped := ref.queue.push(msg, e)
+	if ok {
+		m.metrics.delivered++
+	} else {
+		m.metrics.dropped++
+	}
+	if dropped != nil {
+		m.metrics.dropped++
+		if e := dropped.entry; e != nil {
+			m.deadLetter(e, []Topic{e.topic}, ConnFull, 0)
+		}
+	}
+
+	return ok
+}
+
+func (m *manager[T]) getTopicConns(t Topic) map[ConnOf[T]]*topicRef[T] {
 	if _, ok := m.topics[t]; !ok {
-		m.topics[t] = map[Conn]*counter{}
+		m.topics[t] = map[ConnOf[T]]*topicRef[T]{}
+		if p, ok := t.(Pattern); ok {
+			m.patterns.insert(p)
+		}
+		m.emit(TopicCreated, t, nil, 0)
 	}
 	return m.topics[t]
 }
 
-func (m *manager) connect(c *Connect) {
+func (m *manager[T]) deleteTopic(t Topic) {
+	delete(m.topics, t)
+	delete(m.groups, t)
+	if p, ok := t.(Pattern); ok {
+		m.patterns.remove(p)
+	}
+	m.emit(TopicDeleted, t, nil, 0)
+}
+
+func (m *manager[T]) connect(c *ConnectOf[T]) {
 	m.connectEach(c.toConnectEach())
 }
 
-func (m *manager) connectEach(c *ConnectEach) {
+func (m *manager[T]) connectEach(c *ConnectEachOf[T]) {
 	topics := c.Topics
+	sub := c.Subscription
 	ref, ok := m.conns[c.Conn]
-	if len(topics) == 0 && !ok {
-		topics = []TopicConn{{}}
+	if len(topics) == 0 && (!ok || sub != nil) {
+		topics = []TopicConnOf[T]{{}}
+	}
+	if sub != nil {
+		m.subscribe(sub, c.Conn, c.MessageCount)
 	}
 
+	added := make([]Topic, 0, len(topics))
+
 	if ok {
 		for _, t := range topics {
 			topic := m.getTopicConns(t.Topic)
-			cnt, ok := topic[c.Conn]
-			if ok {
-				cnt.reset(t.MessageCount)
-			} else {
-				topic[c.Conn] = newCounter(t.MessageCount)
+			tr, ok := topic[c.Conn]
+			if !ok {
+				tr = newTopicRef(&t, sub)
+				topic[c.Conn] = tr
 				ref.topics.inc()
+				added = append(added, t.Topic)
+				m.emit(Connected, t.Topic, c.Conn, 0)
+			} else if sub == nil {
+				tr.messages.reset(t.MessageCount)
+				tr.filter = t.Filter
 			}
+			tr.bind(&t, sub)
+			if !ok || sub == nil {
+				m.join(t.Topic, c.Conn, tr, &t)
+			}
+		}
+		if sub == nil {
+			ref.keep = c.KeepAlive
+			ref.filter = c.Filter
+			ref.messages.reset(c.MessageCount)
+		}
+	} else {
+		if c.Envelope {
+			checkWrapper[T]("Envelope", EnvelopeOf[T]{})
+		}
+		if c.Ack {
+			checkWrapper[T]("Ack", &DeliveryOf[T]{})
 		}
-		ref.keep = c.KeepAlive
-		ref.messages.reset(c.MessageCount)
 
-		return
+		ref = &connRefCount[T]{
+			topics:   counter(len(topics)),
+			messages: counter(c.MessageCount),
+			keep:     c.KeepAlive,
+			envelope: c.Envelope,
+			filter:   c.Filter,
+			status:   c.Status.claim(),
+			aborted:  make(chan struct{}),
+		}
+		if sub != nil {
+			ref.messages = 0
+		}
+		if c.Policy != Block {
+			var after <-chan struct{}
+			if q, ok := m.draining[c.Conn]; ok {
+				delete(m.draining, c.Conn)
+				after = q.done
+			}
+			ref.queue = newQueue(c.Conn, c.Policy, c.QueueSize, after, ref)
+		}
+		if c.Durable != "" {
+			ref.durable = m.durable(c.Durable, c.ManualCommit)
+		}
+		if c.Ack {
+			ref.ackTimeout = c.AckTimeout
+			if ref.ackTimeout <= 0 {
+				ref.ackTimeout = DefaultAckTimeout
+			}
+			ref.maxAttempts = c.MaxAttempts
+			ref.pending = map[*pending[T]]struct{}{}
+		}
+		m.conns[c.Conn] = ref
+		for _, t := range topics {
+			tr := newTopicRef(&t, sub)
+			tr.bind(&t, sub)
+			m.getTopicConns(t.Topic)[c.Conn] = tr
+			m.join(t.Topic, c.Conn, tr, &t)
+			added = append(added, t.Topic)
+			m.emit(Connected, t.Topic, c.Conn, 0)
+		}
 	}
 
-	m.conns[c.Conn] = &connRefCount{
-		topics:   counter(len(topics)),
-		messages: counter(c.MessageCount),
-		keep:     c.KeepAlive,
+	if c.Context != nil {
+		m.watch(c.Context, c.Conn, ref)
 	}
-	for _, t := range topics {
-		m.getTopicConns(t.Topic)[c.Conn] = newCounter(t.MessageCount)
+	if ref.queue != nil || ref.status != nil {
+		m.supervise(c.Conn, ref)
+	}
+
+	replay := c.ReplayLast > 0 || c.ReplaySince > 0
+	for _, t := range added {
+		if m.conns[c.Conn] != ref {
+			break
+		}
+
+		if d := ref.durable; d != nil {
+			if m.resume(t, c.Conn, d) {
+				continue
+			}
+			// the messages published from now on are the ones the subscription must consume
+			m.commit(d, t, m.seq, false)
+		}
+
+		if !replay || !m.replay(t, c.Conn, c.ReplayLast, c.ReplaySince) {
+			m.deliverRetained(t, c.Conn)
+		}
 	}
 }
 
-func (m *manager) removeConnFromTopicNoRefCounter(t Topic, c Conn) bool {
+func (m *manager[T]) removeConnFromTopicNoRefCounter(t Topic, c ConnOf[T]) bool {
 	prevLen := len(m.topics[t])
+	if tr, ok := m.topics[t][c]; ok {
+		m.leave(t, c, tr)
+		m.release(t, tr)
+	}
 	delete(m.topics[t], c)
 	currLen := len(m.topics[t])
 
 	if prevLen == currLen {
 		return false
-	} else if currLen == 0 {
-		delete(m.topics, t)
+	}
+
+	m.emit(Disconnected, t, c, 0)
+	if currLen == 0 {
+		m.deleteTopic(t)
 	}
 
 	return true
 }
 
-func (m *manager) removeConnFromTopicRefCountOnly(c Conn) bool {
+func (m *manager[T]) removeConnFromTopicRefCountOnly(c ConnOf[T], reason CloseReason) bool {
 	ref := m.conns[c]
 	if ref.topics.dec() {
 		delete(m.conns, c)
-		if !ref.keep {
-			close(c)
-		}
+		m.closeConn(c, ref, reason)
 
 		return true
 	}
@@ -140,31 +443,33 @@ func (m *manager) removeConnFromTopicRefCountOnly(c Conn) bool {
 // Then it decrements the connection's topic counter and deletes the connection if it isn't connected to any topics.
 // It also closes the connection channel if at connection KeepAlive wasn't specified. It returns true if the
 // connection was removed.
-func (m *manager) removeConnFromTopic(t Topic, c Conn) bool {
+func (m *manager[T]) removeConnFromTopic(t Topic, c ConnOf[T], reason CloseReason) bool {
 	if !m.removeConnFromTopicNoRefCounter(t, c) {
 		return false
 	}
-	return m.removeConnFromTopicRefCountOnly(c)
+	return m.removeConnFromTopicRefCountOnly(c, reason)
+}
+
+func (m *manager[T]) disconnectAll(d DisconnectAllOf[T]) {
+	m.removeConn(ConnOf[T](d), ReasonDisconnected)
 }
 
-func (m *manager) disconnectAll(d DisconnectAll) {
-	c := Conn(d)
+// removeConn disconnects the connection from all its topics and closes it.
+func (m *manager[T]) removeConn(c ConnOf[T], reason CloseReason) {
 	ref, ok := m.conns[c]
 	if !ok {
 		return
 	}
 
-	if !ref.keep {
-		close(c)
-	}
-	delete(m.conns, c)
-
 	for t := range m.topics {
 		m.removeConnFromTopicNoRefCounter(t, c)
 	}
+
+	delete(m.conns, c)
+	m.closeConn(c, ref, reason)
 }
 
-func (m *manager) disconnect(d *Disconnect) {
+func (m *manager[T]) disconnect(d *DisconnectOf[T]) {
 	if _, ok := m.conns[d.Conn]; !ok {
 		return
 	}
@@ -174,47 +479,264 @@ func (m *manager) disconnect(d *Disconnect) {
 			continue
 		}
 
-		if m.removeConnFromTopic(t, d.Conn) {
+		if m.removeConnFromTopic(t, d.Conn, ReasonDisconnected) {
 			break
 		}
 	}
 }
 
-func (m *manager) closeTopics(c Close) {
+func (m *manager[T]) closeTopics(c Close) {
 	for _, t := range getTopics(c, true) {
-		conns, ok := m.topics[t]
+		p, ok := t.(Pattern)
 		if !ok {
+			m.closeTopic(t)
 			continue
 		}
 
-		delete(m.topics, t)
-		for c := range conns {
-			m.removeConnFromTopicRefCountOnly(c)
+		for t := range m.topics {
+			switch v := t.(type) {
+			case string:
+				if p.Match(v) {
+					m.closeTopic(t)
+				}
+			case Pattern:
+				if p.covers(v) {
+					m.closeTopic(t)
+				}
+			}
+		}
+	}
+}
+
+func (m *manager[T]) closeTopic(t Topic) {
+	conns, ok := m.topics[t]
+	if !ok {
+		return
+	}
+
+	for c, tr := range conns {
+		m.release(t, tr)
+		m.emit(Disconnected, t, c, 0)
+	}
+	m.deleteTopic(t)
+	for c := range conns {
+		m.removeConnFromTopicRefCountOnly(c, ReasonTopicClosed)
+	}
+}
+
+func (m *manager[T]) closeAllTopics() {
+	for t := range m.topics {
+		m.closeTopic(t)
+	}
+}
+
+// fail passes the error to the error handler, if there is one, or otherwise stops the Hub.
+func (m *manager[T]) fail(err error) {
+	if m.opts.onError != nil {
+		m.opts.onError(err)
+	} else if m.err == nil {
+		m.err = err
+	}
+}
+
+// report passes the error to the error handler, if there is one, without stopping the Hub.
+func (m *manager[T]) report(err error) {
+	if m.opts.onError != nil {
+		m.opts.onError(err)
+	}
+}
+
+func (m *manager[T]) message(msg *MessageOf[T]) {
+	m.seq++
+	delivered := m.metrics.delivered
+	now := time.Now()
+	topics := getTopics(msg.Topics, true)
+	subscribed := !m.opts.deadLetters
+
+	if m.opts.store != nil {
+		var persisted []string
+		for _, t := range topics {
+			if s, ok := t.(string); ok && m.config(t).persist {
+				persisted = append(persisted, s)
+			}
+		}
+
+		if len(persisted) > 0 {
+			m.persist(msg.Message, persisted, m.seq, now)
+		}
+	}
+
+	for _, t := range topics {
+		e := &entry[T]{msg: msg.Message, topic: t, seq: m.seq, time: now}
+		if !subscribed {
+			subscribed = m.subscribed(t, msg.Retain)
+		}
+		if msg.Retain {
+			m.retain(e)
+		}
+		m.record(e)
+
+		m.publish(t, e)
+
+		if s, ok := t.(string); ok {
+			for _, p := range m.patterns.match(s) {
+				m.publish(p, e)
+			}
+		}
+	}
+
+	if !subscribed {
+		m.deadLetter(&entry[T]{msg: msg.Message, seq: m.seq, time: now}, topics, NoSubscribers, 0)
+	}
+
+	if msg.Receivers != nil {
+		select {
+		case msg.Receivers <- int(m.metrics.delivered - delivered):
+		default:
 		}
 	}
 }
 
-func (m *manager) closeAllTopics() {
-	for t, conns := range m.topics {
-		delete(m.topics, t)
-		for c := range conns {
-			m.removeConnFromTopicRefCountOnly(c)
+// publish sends the message to the connections of the given topic, and to one member
+// of each of its queue groups.
+func (m *manager[T]) publish(t Topic, e *entry[T]) {
+	for c, tr := range m.topics[t] {
+		if tr.group == "" {
+			m.deliver(t, c, tr, e)
+		}
+	}
+
+	for _, g := range m.groups[t] {
+		if c, ok := m.pick(t, g, e.msg); ok {
+			m.deliver(t, c, m.topics[t][c], e)
 		}
 	}
 }
 
-func (m *manager) message(msg *Message) {
-	for _, t := range getTopics(msg.Topics, true) {
-		for c, cnt := range m.topics[t] {
-			c <- msg.Message
+// checkWrapper panics if a Conn of type ConnOf[T] can't receive the wrapper
+// the given option sends instead of the messages.
+func checkWrapper[T any](option string, wrapper interface{}) {
+	if _, ok := wrapper.(T); !ok {
+		panic(fmt.Sprintf("hub: %s requires a Conn of interface type, not %T", option, ConnOf[T](nil)))
+	}
+}
 
-			if m.conns[c].messages.dec() {
-				for t := range m.topics {
-					m.removeConnFromTopic(t, c)
+// value returns the value that is sent to the connection for the given entry,
+// received through the topic the connection is connected to.
+func (ref *connRefCount[T]) value(t Topic, e *entry[T]) T {
+	if !ref.envelope {
+		return e.msg
+	}
+	return interface{}(ref.envelopeFor(t, e)).(T)
+}
+
+func (ref *connRefCount[T]) envelopeFor(t Topic, e *entry[T]) EnvelopeOf[T] {
+	p, _ := t.(Pattern)
+
+	return EnvelopeOf[T]{
+		Message:  e.msg,
+		Topic:    e.topic,
+		Pattern:  p,
+		Sequence: e.seq,
+		Time:     e.time,
+	}
+}
+
+// deliver sends the message published on the given topic to the connection, if it passes
+// the connection's filters, and updates its counters. It returns false if the connection
+// isn't connected to the topic anymore after the delivery.
+func (m *manager[T]) deliver(t Topic, c ConnOf[T], tr *topicRef[T], e *entry[T]) bool {
+	ref := m.conns[c]
+	if !accepts(tr.filter, e.msg) || !accepts(ref.filter, e.msg) {
+		return true
+	}
+
+	var sent bool
+	if ref.ackTimeout > 0 {
+		sent = m.transmit(&pending[T]{conn: c, ref: ref, topic: t, entry: *e})
+	} else {
+		sent = m.send(c, ref, ref.value(t, e), e)
+	}
+
+	if m.conns[c] != ref {
+		// the connection was aborted or closed by the consumer while sending
+		return false
+	}
+
+	if !sent {
+		m.deadLetter(e, []Topic{e.topic}, ConnFull, 0)
+		if ref.queue.policy == DisconnectOnFull {
+			m.removeConn(c, ReasonQueueFull)
+			return false
+		}
+		return true
+	}
+
+	if d := ref.durable; d != nil && !d.manual && ref.ackTimeout == 0 {
+		m.commit(d, t, e.seq, false)
+	}
+
+	if ref.messages.dec() {
+		for t := range m.topics {
+			m.removeConnFromTopic(t, c, ReasonMessageCount)
+		}
+		return false
+	} else if tr.messages.dec() {
+		m.removeConnFromTopic(t, c, ReasonMessageCount)
+		return false
+	}
+
+	if len(tr.subs) > 0 {
+		m.consume(t, tr)
+		return m.topics[t][c] == tr
+	}
+
+	return true
+}
+
+// retain stores the message as the retained message of its topic.
+func (m *manager[T]) retain(e *entry[T]) {
+	if m.retained == nil {
+		m.retained = map[Topic]*entry[T]{}
+	}
+	m.retained[e.topic] = e
+}
+
+// clearRetained forgets the retained messages of the given topics.
+func (m *manager[T]) clearRetained(c ClearRetained) {
+	for _, t := range getTopics(c, true) {
+		if p, ok := t.(Pattern); ok {
+			for t := range m.retained {
+				if s, ok := t.(string); ok && p.Match(s) {
+					delete(m.retained, t)
 				}
-			} else if cnt.dec() {
-				m.removeConnFromTopic(t, c)
 			}
 		}
+		delete(m.retained, t)
+	}
+}
+
+// deliverRetained sends to the connection the retained message of the topic it has just
+// connected to. If the topic is a Pattern, the retained messages of all the topics it
+// matches are sent.
+func (m *manager[T]) deliverRetained(t Topic, c ConnOf[T]) {
+	tr, ok := m.topics[t][c]
+	if !ok || len(m.retained) == 0 {
+		return
+	}
+
+	if e, ok := m.retained[t]; ok && !m.deliver(t, c, tr, e) {
+		return
+	}
+
+	p, ok := t.(Pattern)
+	if !ok {
+		return
+	}
+
+	for rt, e := range m.retained {
+		if s, ok := rt.(string); ok && p.Match(s) && !m.deliver(t, c, tr, e) {
+			return
+		}
 	}
 }
@@ -0,0 +1,470 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// Will is the message a server publishes when the connection of a client ends
+	// without a DISCONNECT packet.
+	Will struct {
+		Topic   string
+		Payload []byte
+		QoS     byte
+		Retain  bool
+	}
+
+	// Message is a message published or received by a Client.
+	Message struct {
+		Topic   string
+		Payload []byte
+		QoS     byte
+		Retain  bool
+		// Duplicate is set on received messages which may have been received before.
+		Duplicate bool
+	}
+
+	// ClientConfig configures a Client.
+	ClientConfig struct {
+		// ClientID identifies the client to the server. If it is empty, the server chooses one.
+		ClientID string
+		Username string
+		Password []byte
+		// If KeepAlive is positive, the client pings the server at this interval, and the
+		// server disconnects the client if it receives no packets for one and a half intervals.
+		KeepAlive time.Duration
+		Will      *Will
+	}
+
+	// Client is a minimal MQTT 3.1.1 client, which always starts a clean session.
+	// Create one using Dial.
+	Client struct {
+		conn     net.Conn
+		messages chan Message
+		done     chan struct{}
+
+		wmu sync.Mutex
+		w   *bufio.Writer
+
+		mu sync.Mutex
+		// acks receive the acknowledgements of the packets sent, by packet identifier.
+		acks   map[uint16]chan packet
+		nextID uint16
+		err    error
+	}
+
+	// ConnectError is returned by Dial when the server refuses the connection.
+	// It is the return code of the CONNACK packet.
+	ConnectError byte
+)
+
+// ErrClosed is returned by the methods of a Client whose connection was closed using
+// Disconnect or Close.
+var ErrClosed = errors.New("mqtt: client closed")
+
+func (e ConnectError) Error() string {
+	switch byte(e) {
+	case connBadProtocol:
+		return "mqtt: connection refused: unacceptable protocol version"
+	case connBadIdentifier:
+		return "mqtt: connection refused: identifier rejected"
+	case connUnavailable:
+		return "mqtt: connection refused: server unavailable"
+	case connBadCredentials:
+		return "mqtt: connection refused: bad user name or password"
+	case connNotAuthorized:
+		return "mqtt: connection refused: not authorized"
+	default:
+		return fmt.Sprintf("mqtt: connection refused: code %d", byte(e))
+	}
+}
+
+// Dial connects to the server at the given address and sends it the CONNECT packet.
+// The context is used only until the server accepts the connection.
+func Dial(ctx context.Context, network, addr string, cfg ClientConfig) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := connect(ctx, conn, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func connect(ctx context.Context, conn net.Conn, cfg ClientConfig) (*Client, error) {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock the handshake
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	r, err := handshake(conn, cfg)
+
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:     conn,
+		messages: make(chan Message),
+		done:     make(chan struct{}),
+		w:        bufio.NewWriter(conn),
+		acks:     map[uint16]chan packet{},
+	}
+
+	go c.read(r)
+	if cfg.KeepAlive > 0 {
+		go c.ping(cfg.KeepAlive)
+	}
+
+	return c, nil
+}
+
+// handshake sends the CONNECT packet and reads the CONNACK. It returns the reader
+// of the connection.
+func handshake(conn net.Conn, cfg ClientConfig) (*bufio.Reader, error) {
+	flags := connectCleanSession
+
+	var payload encoder
+	payload.string(cfg.ClientID)
+	if w := cfg.Will; w != nil {
+		flags |= connectWill | w.QoS<<3
+		if w.Retain {
+			flags |= connectWillRetain
+		}
+		payload.string(w.Topic)
+		payload.bytes(w.Payload)
+	}
+	if cfg.Username != "" {
+		flags |= connectUsername
+		payload.string(cfg.Username)
+	}
+	if cfg.Password != nil {
+		flags |= connectPassword
+		payload.bytes(cfg.Password)
+	}
+
+	var e encoder
+	e.string("MQTT")
+	e.byte(protocolLevel)
+	e.byte(flags)
+	e.uint16(uint16(cfg.KeepAlive / time.Second))
+	e.raw(payload.buf)
+
+	if _, err := conn.Write(e.frame(typeConnect, 0)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if p.kind != typeConnack || len(p.body) != 2 {
+		return nil, ErrMalformedPacket
+	}
+	if code := p.body[1]; code != connAccepted {
+		return nil, ConnectError(code)
+	}
+
+	return r, nil
+}
+
+// Messages returns the channel on which the messages published to the client's subscriptions
+// are received. It must be read from, or the client stops reading from the connection. It is
+// closed when the connection ends.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Err returns the error that ended the connection, or nil if it didn't end.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Publish publishes the message. If its QoS is 1 or 2, it waits until the server
+// acknowledges the message.
+func (c *Client) Publish(ctx context.Context, m Message) error {
+	var flags byte = m.QoS << 1
+	if m.Retain {
+		flags |= flagRetain
+	}
+
+	if m.QoS == 0 {
+		var e encoder
+		e.string(m.Topic)
+		e.raw(m.Payload)
+		return c.write(e.frame(typePublish, flags))
+	}
+
+	id, acks := c.register()
+	defer c.unregister(id)
+
+	var e encoder
+	e.string(m.Topic)
+	e.uint16(id)
+	e.raw(m.Payload)
+	if err := c.write(e.frame(typePublish, flags)); err != nil {
+		return err
+	}
+
+	if m.QoS == 1 {
+		_, err := c.wait(ctx, acks, typePuback)
+		return err
+	}
+
+	if _, err := c.wait(ctx, acks, typePubrec); err != nil {
+		return err
+	}
+
+	var rel encoder
+	rel.uint16(id)
+	if err := c.write(rel.frame(typePubrel, 0x2)); err != nil {
+		return err
+	}
+
+	_, err := c.wait(ctx, acks, typePubcomp)
+	return err
+}
+
+// Subscribe subscribes the client to the topic filters with the given QoS, and returns
+// the return codes of the server: the QoS granted for each filter, or 0x80 if the
+// subscription failed.
+func (c *Client) Subscribe(ctx context.Context, qos byte, filters ...string) ([]byte, error) {
+	id, acks := c.register()
+	defer c.unregister(id)
+
+	var e encoder
+	e.uint16(id)
+	for _, f := range filters {
+		e.string(f)
+		e.byte(qos)
+	}
+	if err := c.write(e.frame(typeSubscribe, 0x2)); err != nil {
+		return nil, err
+	}
+
+	p, err := c.wait(ctx, acks, typeSuback)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.body[2:], nil
+}
+
+// Unsubscribe unsubscribes the client from the topic filters.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	id, acks := c.register()
+	defer c.unregister(id)
+
+	var e encoder
+	e.uint16(id)
+	for _, f := range filters {
+		e.string(f)
+	}
+	if err := c.write(e.frame(typeUnsubscribe, 0x2)); err != nil {
+		return err
+	}
+
+	_, err := c.wait(ctx, acks, typeUnsuback)
+	return err
+}
+
+// Disconnect sends the DISCONNECT packet and closes the connection, so the server
+// discards the client's will.
+func (c *Client) Disconnect() error {
+	err := c.write([]byte{typeDisconnect << 4, 0})
+	c.fail(ErrClosed)
+	return err
+}
+
+// Close closes the connection without sending the DISCONNECT packet, so the server
+// publishes the client's will.
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// register returns a new packet identifier and the channel its acknowledgements are sent on.
+func (c *Client) register() (uint16, chan packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		c.nextID++
+		if _, used := c.acks[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+
+	acks := make(chan packet, 1)
+	c.acks[c.nextID] = acks
+
+	return c.nextID, acks
+}
+
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.acks, id)
+}
+
+// wait waits for the acknowledgement of the given type.
+func (c *Client) wait(ctx context.Context, acks chan packet, kind byte) (packet, error) {
+	select {
+	case p := <-acks:
+		if p.kind != kind {
+			c.fail(ErrMalformedPacket)
+			return packet{}, ErrMalformedPacket
+		}
+		return p, nil
+	case <-c.done:
+		return packet{}, c.Err()
+	case <-ctx.Done():
+		return packet{}, ctx.Err()
+	}
+}
+
+func (c *Client) read(r *bufio.Reader) {
+	defer close(c.messages)
+
+	for {
+		p, err := readPacket(r)
+		if err == nil {
+			err = c.handle(p)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Client) handle(p packet) error {
+	d := decoder{buf: p.body}
+
+	switch p.kind {
+	case typePublish:
+		m := Message{
+			QoS:       (p.flags & flagQoS) >> 1,
+			Retain:    p.flags&flagRetain != 0,
+			Duplicate: p.flags&flagDup != 0,
+		}
+		m.Topic = d.string()
+		var id uint16
+		if m.QoS > 0 {
+			id = d.uint16()
+		}
+		m.Payload = append([]byte(nil), d.rest()...)
+		// the client never subscribes with QoS 2
+		if d.err != nil || m.QoS > 1 {
+			return ErrMalformedPacket
+		}
+
+		select {
+		case c.messages <- m:
+		case <-c.done:
+			return nil
+		}
+
+		if m.QoS == 1 {
+			var e encoder
+			e.uint16(id)
+			return c.write(e.frame(typePuback, 0))
+		}
+	case typePuback, typePubrec, typePubcomp, typeSuback, typeUnsuback:
+		id := d.uint16()
+		if d.err != nil {
+			return ErrMalformedPacket
+		}
+
+		c.mu.Lock()
+		acks := c.acks[id]
+		c.mu.Unlock()
+
+		if acks != nil {
+			select {
+			case acks <- p:
+			default:
+			}
+		}
+	case typePingresp:
+	default:
+		return ErrMalformedPacket
+	}
+
+	return nil
+}
+
+// ping sends PINGREQ packets at the given interval.
+func (c *Client) ping(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if c.write([]byte{typePingreq << 4, 0}) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) write(p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+
+	if _, err := c.w.Write(p); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// fail ends the connection with the given error, unless it has already ended.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+	_ = c.conn.Close()
+}
@@ -0,0 +1,728 @@
+/*
+Package mqtt is a front-end to a Hub which speaks MQTT 3.1.1, so MQTT clients can publish
+and subscribe to its topics, and a minimal client for it.
+
+The topic names are string topics and the topic filters with wildcards are Patterns, which
+have the same syntax. The published messages are byte slices. Messages published with the
+retain flag are retained by the Hub, and the last will of a client is published when its
+connection ends without a DISCONNECT packet.
+
+Messages are published with QoS 0, 1 or 2 and subscriptions are granted at most QoS 1.
+As the Hub doesn't keep the QoS of a message, the messages are sent with the QoS of the
+subscription. Each topic filter a client subscribes to is a Conn, which for QoS 1 is in ack
+mode: the messages not acknowledged with PUBACK are sent again after hub.DefaultAckTimeout.
+Sessions aren't persisted, so the server behaves as if all clients set CleanSession.
+*/
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/server"
+)
+
+type (
+	// Option configures a server.
+	Option func(*options)
+
+	options struct {
+		encode    func(interface{}) ([]byte, error)
+		policy    hub.Policy
+		queueSize hub.Number
+	}
+
+	session struct {
+		hub  hub.Hub
+		opts options
+		conn net.Conn
+		reg  *registry
+		id   string
+		// ctx is canceled when the session ends. The Conns are connected with it,
+		// so they are removed from the Hub.
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		wmu sync.Mutex
+		w   *bufio.Writer
+
+		mu   sync.Mutex
+		subs map[string]*subscription
+		// inflight are the QoS 1 messages sent to the client, by packet identifier.
+		inflight map[uint16]inflight
+		ids      map[deliveryKey]uint16
+		nextID   uint16
+		// received are the identifiers of the QoS 2 messages whose PUBREL wasn't received.
+		received map[uint16]bool
+		will     *Will
+		err      error
+
+		wg sync.WaitGroup
+	}
+
+	// subscription is the Conn of a topic filter.
+	subscription struct {
+		conn   hub.Conn
+		status *hub.Status
+		qos    byte
+		// since is the time the subscription was made at. Older messages are retained ones.
+		since time.Time
+	}
+
+	// deliveryKey identifies a message delivered to a subscription, so it is sent again
+	// with the same packet identifier.
+	deliveryKey struct {
+		sub      *subscription
+		topic    hub.Topic
+		sequence uint64
+	}
+
+	inflight struct {
+		key      deliveryKey
+		delivery *hub.Delivery
+	}
+
+	// registry holds the sessions of a server by client identifier.
+	registry struct {
+		mu       sync.Mutex
+		sessions map[string]*session
+	}
+)
+
+// connectTimeout is how long a server waits for the CONNECT packet.
+const connectTimeout = 10 * time.Second
+
+// ErrSessionTakenOver is returned by ServeConn when the client is disconnected because
+// another client has connected with the same identifier.
+var ErrSessionTakenOver = errors.New("mqtt: session taken over")
+
+// WithEncoder sets the function which encodes the messages sent to the subscribers.
+// By default, strings and byte slices are sent as they are and the other messages
+// are encoded as JSON.
+func WithEncoder(fn func(interface{}) ([]byte, error)) Option {
+	return func(o *options) {
+		o.encode = fn
+	}
+}
+
+// WithQueue sets the Policy and the QueueSize of the subscribers' Conns. By default,
+// slow subscribers are disconnected: the Policy is DisconnectOnFull, and the Hub never
+// waits for the clients. If the Policy is Block, the default is used.
+func WithQueue(p hub.Policy, size hub.Number) Option {
+	return func(o *options) {
+		o.policy, o.queueSize = p, size
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them using ServeConn,
+// until the context is done or the listener fails. When a client connects with the
+// identifier of a connected client, the latter is disconnected. The listener is closed
+// and all the connections are served to completion before Serve returns the context's
+// error or the listener's.
+func Serve(ctx context.Context, h hub.Hub, l net.Listener, opts ...Option) error {
+	reg := &registry{sessions: map[string]*session{}}
+
+	return server.Serve(ctx, l, func(ctx context.Context, c net.Conn) {
+		_ = serveConn(ctx, h, c, reg, opts)
+	})
+}
+
+// ServeConn executes on the Hub the packets received on the connection until the client
+// disconnects, the context is done or an error occurs. Then the connection is closed, the
+// client's Conns are removed from the Hub and, unless the client has sent DISCONNECT, its
+// last will is published. It returns nil if the client has sent DISCONNECT, or the context's
+// error or the one that occurred otherwise. If the client was disconnected because one of
+// its Conns was removed from the Hub, the error is the hub.CloseReason.
+func ServeConn(ctx context.Context, h hub.Hub, c net.Conn, opts ...Option) error {
+	return serveConn(ctx, h, c, nil, opts)
+}
+
+func serveConn(ctx context.Context, h hub.Hub, c net.Conn, reg *registry, opts []Option) error {
+	o := options{encode: server.Encode}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.policy = server.Policy(o.policy)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session{
+		hub:      h,
+		opts:     o,
+		conn:     c,
+		reg:      reg,
+		ctx:      ctx,
+		cancel:   cancel,
+		w:        bufio.NewWriter(c),
+		subs:     map[string]*subscription{},
+		inflight: map[uint16]inflight{},
+		ids:      map[deliveryKey]uint16{},
+		received: map[uint16]bool{},
+	}
+
+	defer s.wg.Wait()
+	defer c.Close()
+	defer cancel()
+
+	go func() {
+		// unblock the read when the session ends
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	err := s.serve(bufio.NewReader(c))
+
+	s.mu.Lock()
+	serr, will := s.err, s.will
+	s.mu.Unlock()
+
+	if will != nil && serr != hub.ReasonHubClosed && parent.Err() == nil {
+		// the session's context is done, so the will is published unless the server stops
+		for _, cmd := range publication(will.Topic, will.Payload, will.Retain) {
+			select {
+			case h <- cmd:
+			case <-parent.Done():
+			}
+		}
+	}
+	if s.reg != nil && s.id != "" {
+		s.reg.remove(s)
+	}
+
+	switch {
+	case serr != nil:
+		return serr
+	case parent.Err() != nil:
+		return parent.Err()
+	default:
+		return err
+	}
+}
+
+func (s *session) serve(r *bufio.Reader) error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+
+	p, err := readPacket(r)
+	if err != nil {
+		return err
+	}
+	if p.kind != typeConnect {
+		return ErrMalformedPacket
+	}
+
+	keepAlive, err := s.connect(p)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if keepAlive > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+
+		if err := s.handle(p); err != nil {
+			if err == errDisconnect {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// errDisconnect ends the session after the DISCONNECT packet.
+var errDisconnect = errors.New("mqtt: disconnect")
+
+// connect handles the CONNECT packet and returns the keep alive interval requested by the client.
+func (s *session) connect(p packet) (time.Duration, error) {
+	d := decoder{buf: p.body}
+	name := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := time.Duration(d.uint16()) * time.Second
+	if d.err != nil || name != "MQTT" {
+		return 0, ErrMalformedPacket
+	}
+	if level != protocolLevel {
+		s.connack(connBadProtocol)
+		return 0, ErrMalformedPacket
+	}
+	if flags&connectReserved != 0 || (flags&connectUsername == 0 && flags&connectPassword != 0) {
+		return 0, ErrMalformedPacket
+	}
+
+	id := d.string()
+
+	var will *Will
+	if flags&connectWill != 0 {
+		will = &Will{QoS: (flags & connectWillQoS) >> 3, Retain: flags&connectWillRetain != 0}
+		will.Topic = d.string()
+		will.Payload = append([]byte(nil), d.bytes()...)
+		if will.QoS > 2 || !validTopic(will.Topic) {
+			return 0, ErrMalformedPacket
+		}
+	} else if flags&(connectWillQoS|connectWillRetain) != 0 {
+		return 0, ErrMalformedPacket
+	}
+	// credentials aren't checked
+	if flags&connectUsername != 0 {
+		_ = d.string()
+	}
+	if flags&connectPassword != 0 {
+		_ = d.bytes()
+	}
+	if !d.done() {
+		return 0, ErrMalformedPacket
+	}
+
+	if id == "" {
+		if flags&connectCleanSession == 0 {
+			s.connack(connBadIdentifier)
+			return 0, ErrMalformedPacket
+		}
+		id = newClientID()
+	}
+
+	s.id = id
+	if s.reg != nil {
+		s.reg.add(s)
+	}
+
+	s.mu.Lock()
+	s.will = will
+	s.mu.Unlock()
+
+	s.connack(connAccepted)
+
+	return keepAlive, nil
+}
+
+func newClientID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return "hub-" + hex.EncodeToString(b[:])
+}
+
+func (s *session) connack(code byte) {
+	var e encoder
+	// the session is never present, as it isn't persisted
+	e.byte(0)
+	e.byte(code)
+	s.write(e.frame(typeConnack, 0))
+}
+
+func (s *session) handle(p packet) error {
+	d := decoder{buf: p.body}
+
+	switch p.kind {
+	case typePublish:
+		return s.handlePublish(p.flags, &d)
+	case typePuback:
+		id := d.uint16()
+		if !d.done() || p.flags != 0 {
+			return ErrMalformedPacket
+		}
+		s.acknowledge(id)
+	case typePubrel:
+		id := d.uint16()
+		if !d.done() || p.flags != 0x2 {
+			return ErrMalformedPacket
+		}
+
+		s.mu.Lock()
+		delete(s.received, id)
+		s.mu.Unlock()
+
+		s.ack(typePubcomp, id)
+	case typeSubscribe:
+		return s.handleSubscribe(p.flags, &d)
+	case typeUnsubscribe:
+		return s.handleUnsubscribe(p.flags, &d)
+	case typePingreq:
+		if len(p.body) != 0 {
+			return ErrMalformedPacket
+		}
+		s.write([]byte{typePingresp << 4, 0})
+	case typeDisconnect:
+		if len(p.body) != 0 {
+			return ErrMalformedPacket
+		}
+
+		s.mu.Lock()
+		s.will = nil
+		s.mu.Unlock()
+
+		return errDisconnect
+	default:
+		// the server never sends QoS 2 messages, so it never receives PUBREC or PUBCOMP
+		return ErrMalformedPacket
+	}
+
+	return s.ctx.Err()
+}
+
+func (s *session) handlePublish(flags byte, d *decoder) error {
+	qos := (flags & flagQoS) >> 1
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	payload := append([]byte(nil), d.rest()...)
+	if d.err != nil || qos > 2 || !validTopic(topic) || (qos > 0 && id == 0) {
+		return ErrMalformedPacket
+	}
+
+	switch qos {
+	case 0:
+		s.publish(topic, payload, flags&flagRetain != 0)
+	case 1:
+		s.publish(topic, payload, flags&flagRetain != 0)
+		s.ack(typePuback, id)
+	case 2:
+		s.mu.Lock()
+		duplicate := s.received[id]
+		s.received[id] = true
+		s.mu.Unlock()
+
+		// the message is published only once, even if the client sends it again
+		if !duplicate {
+			s.publish(topic, payload, flags&flagRetain != 0)
+		}
+		s.ack(typePubrec, id)
+	}
+
+	return s.ctx.Err()
+}
+
+// publish publishes the message to the topic.
+func (s *session) publish(topic string, payload []byte, retain bool) {
+	for _, cmd := range publication(topic, payload, retain) {
+		s.command(cmd)
+	}
+}
+
+// publication returns the commands which publish the message to the topic. A retained
+// message without payload clears the topic's retained message, and isn't retained itself.
+func publication(topic string, payload []byte, retain bool) []interface{} {
+	msg := hub.Message{Message: payload, Topics: []hub.Topic{topic}, Retain: retain}
+	if retain && len(payload) == 0 {
+		msg.Retain = false
+		return []interface{}{hub.ClearRetained{topic}, msg}
+	}
+	return []interface{}{msg}
+}
+
+func (s *session) handleSubscribe(flags byte, d *decoder) error {
+	id := d.uint16()
+	if d.err != nil || flags != 0x2 || len(d.buf) == 0 {
+		return ErrMalformedPacket
+	}
+
+	var filters []string
+	var codes []byte
+	for len(d.buf) > 0 {
+		filter := d.string()
+		qos := d.byte()
+		if d.err != nil || qos > 2 {
+			return ErrMalformedPacket
+		}
+
+		if !validFilter(filter) {
+			codes = append(codes, subFailure)
+			continue
+		}
+		if qos > 1 {
+			qos = 1
+		}
+
+		filters = append(filters, filter)
+		codes = append(codes, qos)
+	}
+
+	// the filters are subscribed to before SUBACK, so the messages published after it
+	// are received; they wait in the Conns' queues until SUBACK is written
+	subs := make([]*subscription, len(filters))
+	i := 0
+	for _, code := range codes {
+		if code != subFailure {
+			subs[i] = s.subscribe(filters[i], code)
+			i++
+		}
+	}
+
+	var e encoder
+	e.uint16(id)
+	e.raw(codes)
+	s.write(e.frame(typeSuback, 0))
+
+	for i, sub := range subs {
+		s.wg.Add(1)
+		go s.forward(filters[i], sub)
+	}
+
+	return s.ctx.Err()
+}
+
+// subscribe connects a Conn to the topic filter and returns its subscription, whose
+// messages must then be forwarded. An existing subscription to the same filter is
+// replaced, so the retained messages are sent again.
+func (s *session) subscribe(filter string, qos byte) *subscription {
+	sub := &subscription{conn: make(hub.Conn), status: &hub.Status{}, qos: qos, since: time.Now()}
+
+	s.mu.Lock()
+	if old, ok := s.subs[filter]; ok {
+		old.status.Leave()
+	}
+	s.subs[filter] = sub
+	s.mu.Unlock()
+
+	var t hub.Topic = filter
+	if !validTopic(filter) {
+		t = hub.Pattern(filter)
+	}
+
+	s.command(hub.Connect{
+		Conn:      sub.conn,
+		Topics:    []hub.Topic{t},
+		Policy:    s.opts.policy,
+		QueueSize: s.opts.queueSize,
+		Envelope:  qos == 0,
+		Ack:       qos == 1,
+		Context:   s.ctx,
+		Status:    sub.status,
+	})
+
+	return sub
+}
+
+func (s *session) handleUnsubscribe(flags byte, d *decoder) error {
+	id := d.uint16()
+	if d.err != nil || flags != 0x2 || len(d.buf) == 0 {
+		return ErrMalformedPacket
+	}
+
+	var filters []string
+	for len(d.buf) > 0 {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil {
+		return ErrMalformedPacket
+	}
+
+	s.mu.Lock()
+	for _, f := range filters {
+		if sub, ok := s.subs[f]; ok {
+			delete(s.subs, f)
+			sub.status.Leave()
+		}
+	}
+	s.mu.Unlock()
+
+	s.ack(typeUnsuback, id)
+
+	return s.ctx.Err()
+}
+
+// acknowledge settles the QoS 1 message with the given packet identifier.
+func (s *session) acknowledge(id uint16) {
+	s.mu.Lock()
+	m, ok := s.inflight[id]
+	if ok {
+		delete(s.inflight, id)
+		delete(s.ids, m.key)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		m.delivery.Ack()
+	}
+}
+
+// ack writes a packet which has only a packet identifier.
+func (s *session) ack(kind byte, id uint16) {
+	var e encoder
+	e.uint16(id)
+	s.write(e.frame(kind, 0))
+}
+
+// command sends the command to the Hub, unless the session ends meanwhile.
+func (s *session) command(cmd interface{}) {
+	server.Command(s.ctx, s.hub, cmd)
+}
+
+// forward sends the messages received by the subscription's Conn to the client.
+func (s *session) forward(filter string, sub *subscription) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-sub.conn:
+			if !ok {
+				s.ended(sub)
+				return
+			}
+
+			s.mu.Lock()
+			active := s.subs[filter] == sub
+			s.mu.Unlock()
+			if active {
+				s.send(sub, msg)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send writes the PUBLISH packet of a message received by the subscription.
+func (s *session) send(sub *subscription, msg interface{}) {
+	var env hub.Envelope
+	d, ok := msg.(*hub.Delivery)
+	if ok {
+		env = d.EnvelopeOf
+	} else {
+		env = msg.(hub.Envelope)
+	}
+
+	topic, ok := env.Topic.(string)
+	if !ok {
+		// the message was published to a topic which isn't an MQTT topic
+		if d != nil {
+			d.Ack()
+		}
+		return
+	}
+	payload, err := s.opts.encode(env.Message)
+	if err != nil {
+		if d != nil {
+			d.Ack()
+		}
+		return
+	}
+
+	var flags byte
+	if env.Time.Before(sub.since) {
+		flags |= flagRetain
+	}
+
+	var e encoder
+	e.string(topic)
+	if d != nil {
+		id, ok := s.packetID(deliveryKey{sub: sub, topic: env.Topic, sequence: env.Sequence}, d)
+		if !ok {
+			// too many messages in flight, so it is sent again later
+			return
+		}
+		if d.Attempt > 1 {
+			flags |= flagDup
+		}
+		flags |= 1 << 1
+		e.uint16(id)
+	}
+	e.raw(payload)
+
+	s.write(e.frame(typePublish, flags))
+}
+
+// packetID returns the packet identifier of a QoS 1 message, which is the same for all
+// its deliveries. It returns false if all the identifiers are in use.
+func (s *session) packetID(key deliveryKey, d *hub.Delivery) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.ids[key]
+	if !ok {
+		if len(s.inflight) == 1<<16-1 {
+			return 0, false
+		}
+		for {
+			s.nextID++
+			if _, used := s.inflight[s.nextID]; s.nextID != 0 && !used {
+				break
+			}
+		}
+		id = s.nextID
+		s.ids[key] = id
+	}
+	s.inflight[id] = inflight{key: key, delivery: d}
+
+	return id, true
+}
+
+// ended handles the removal of the subscription's Conn from the Hub.
+func (s *session) ended(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, m := range s.inflight {
+		if m.key.sub == sub {
+			delete(s.inflight, id)
+			delete(s.ids, m.key)
+		}
+	}
+
+	switch reason := sub.status.Reason(); reason {
+	case hub.ReasonQueueFull, hub.ReasonHubClosed:
+		if s.err == nil {
+			s.err = reason
+		}
+		s.cancel()
+	default:
+		// MQTT has no way to tell the client that it was unsubscribed
+		for f, sb := range s.subs {
+			if sb == sub {
+				delete(s.subs, f)
+			}
+		}
+	}
+}
+
+// write writes the packet to the client.
+func (s *session) write(p []byte) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if _, err := s.w.Write(p); err == nil {
+		_ = s.w.Flush()
+	}
+}
+
+// add registers the session, disconnecting the one with the same client identifier.
+func (r *registry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.sessions[s.id]; ok {
+		old.mu.Lock()
+		if old.err == nil {
+			old.err = ErrSessionTakenOver
+		}
+		old.mu.Unlock()
+		old.cancel()
+	}
+	r.sessions[s.id] = s
+}
+
+func (r *registry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[s.id] == s {
+		delete(r.sessions, s.id)
+	}
+}
@@ -0,0 +1,227 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/mqtt"
+)
+
+func serve(tb testing.TB, opts ...mqtt.Option) (hub.Hub, string) {
+	tb.Helper()
+
+	return hubtest.Serve(tb, func(ctx context.Context, h hub.Hub, l net.Listener) error {
+		return mqtt.Serve(ctx, h, l, opts...)
+	})
+}
+
+func dial(tb testing.TB, addr string, cfg mqtt.ClientConfig) *mqtt.Client {
+	tb.Helper()
+
+	c, err := mqtt.Dial(context.Background(), "tcp", addr, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = c.Close() })
+
+	return c
+}
+
+func subscribe(tb testing.TB, c *mqtt.Client, qos byte, filters ...string) []byte {
+	tb.Helper()
+
+	codes, err := c.Subscribe(context.Background(), qos, filters...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return codes
+}
+
+func publish(tb testing.TB, c *mqtt.Client, m mqtt.Message) {
+	tb.Helper()
+
+	if err := c.Publish(context.Background(), m); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// receive returns the given number of messages received by the client, sorted by topic,
+// as messages received through different subscriptions can be received in any order.
+func receive(tb testing.TB, c *mqtt.Client, n int) []mqtt.Message {
+	tb.Helper()
+
+	var msgs []mqtt.Message
+	for len(msgs) < n {
+		select {
+		case m, ok := <-c.Messages():
+			if !ok {
+				tb.Fatalf("Connection ended after %d messages: %v", len(msgs), c.Err())
+			}
+			msgs = append(msgs, m)
+		case <-time.After(5 * time.Second):
+			tb.Fatalf("Timed out after %d messages", len(msgs))
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
+
+func checkMessages(tb testing.TB, got []mqtt.Message, expected ...mqtt.Message) {
+	tb.Helper()
+
+	if !reflect.DeepEqual(got, expected) {
+		tb.Fatalf("Invalid messages.\nExpected %+v\nGot %+v", expected, got)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	h, addr := serve(t)
+
+	sub := dial(t, addr, mqtt.ClientConfig{ClientID: "sub"})
+	if codes := subscribe(t, sub, 0, "A", "a/#/b"); !bytes.Equal(codes, []byte{0, 0x80}) {
+		t.Fatalf("Invalid return codes %v", codes)
+	}
+	// QoS 2 is downgraded
+	if codes := subscribe(t, sub, 2, "B/+"); !bytes.Equal(codes, []byte{1}) {
+		t.Fatalf("Invalid return codes %v", codes)
+	}
+
+	// the filters are subscribed to once SUBACK is received
+	pub := dial(t, addr, mqtt.ClientConfig{})
+	publish(t, pub, mqtt.Message{Topic: "A", Payload: []byte("First")})
+	publish(t, pub, mqtt.Message{Topic: "B/1", Payload: []byte("Second"), QoS: 1})
+	publish(t, pub, mqtt.Message{Topic: "C", Payload: []byte("Third"), QoS: 1})
+	// the message is sent with the QoS of the subscription
+	publish(t, pub, mqtt.Message{Topic: "B/2", Payload: []byte("Fourth"), QoS: 2})
+
+	checkMessages(t, receive(t, sub, 3),
+		mqtt.Message{Topic: "A", Payload: []byte("First")},
+		mqtt.Message{Topic: "B/1", Payload: []byte("Second"), QoS: 1},
+		mqtt.Message{Topic: "B/2", Payload: []byte("Fourth"), QoS: 1},
+	)
+
+	if err := sub.Unsubscribe(context.Background(), "A", "D"); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.WaitConns(t, h, 1)
+
+	// messages from the Hub which aren't byte slices are encoded
+	h <- hub.Message{Message: map[string]int{"fifth": 5}, Topics: []hub.Topic{"B/3"}}
+	checkMessages(t, receive(t, sub, 1), mqtt.Message{Topic: "B/3", Payload: []byte(`{"fifth":5}`), QoS: 1})
+
+	if err := sub.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.WaitConns(t, h, 0)
+
+	if err := sub.Publish(context.Background(), mqtt.Message{Topic: "A"}); err != mqtt.ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	h, addr := serve(t)
+
+	pub := dial(t, addr, mqtt.ClientConfig{})
+	publish(t, pub, mqtt.Message{Topic: "R/1", Payload: []byte("First"), QoS: 1, Retain: true})
+	publish(t, pub, mqtt.Message{Topic: "R/2", Payload: []byte("Second"), QoS: 1, Retain: true})
+
+	sub := dial(t, addr, mqtt.ClientConfig{})
+	subscribe(t, sub, 1, "R/+")
+	checkMessages(t, receive(t, sub, 2),
+		mqtt.Message{Topic: "R/1", Payload: []byte("First"), QoS: 1, Retain: true},
+		mqtt.Message{Topic: "R/2", Payload: []byte("Second"), QoS: 1, Retain: true},
+	)
+
+	// the retained message is cleared, and the subscribers still receive the empty message
+	publish(t, pub, mqtt.Message{Topic: "R/1", QoS: 1, Retain: true})
+	checkMessages(t, receive(t, sub, 1), mqtt.Message{Topic: "R/1", QoS: 1})
+	if h.Inspect().Topics["R/1"].Retained {
+		t.Fatal("Expected the retained message to be cleared")
+	}
+
+	// subscribing again replaces the subscription, so the retained messages are sent again
+	subscribe(t, sub, 0, "R/+")
+	checkMessages(t, receive(t, sub, 1), mqtt.Message{Topic: "R/2", Payload: []byte("Second"), Retain: true})
+	hubtest.WaitConns(t, h, 1)
+}
+
+func TestWill(t *testing.T) {
+	_, addr := serve(t)
+
+	sub := dial(t, addr, mqtt.ClientConfig{})
+	subscribe(t, sub, 0, "wills/#")
+
+	will := &mqtt.Will{Topic: "wills/first", Payload: []byte("gone")}
+	first := dial(t, addr, mqtt.ClientConfig{ClientID: "first", Will: will})
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, receive(t, sub, 1), mqtt.Message{Topic: "wills/first", Payload: []byte("gone")})
+
+	// the will is discarded when the client disconnects
+	second := dial(t, addr, mqtt.ClientConfig{ClientID: "second", Will: &mqtt.Will{Topic: "wills/second"}})
+	if err := second.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the will is published when the session is taken over
+	third := dial(t, addr, mqtt.ClientConfig{ClientID: "third", Will: &mqtt.Will{Topic: "wills/third", Payload: []byte("replaced")}})
+	dial(t, addr, mqtt.ClientConfig{ClientID: "third"})
+	checkMessages(t, receive(t, sub, 1), mqtt.Message{Topic: "wills/third", Payload: []byte("replaced")})
+
+	if _, ok := <-third.Messages(); ok {
+		t.Fatal("Expected the connection to be closed")
+	}
+	if err := third.Err(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected the connection to be closed by the server, got %v", err)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	_, addr := serve(t)
+
+	for name, tc := range map[string]struct {
+		connect  []byte
+		expected byte
+	}{
+		"protocol level": {
+			connect:  []byte{0x10, 12, 0, 4, 'M', 'Q', 'T', 'T', 3, 0x02, 0, 60, 0, 0},
+			expected: 1,
+		},
+		"empty identifier": {
+			connect:  []byte{0x10, 12, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x00, 0, 60, 0, 0},
+			expected: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(tc.connect); err != nil {
+				t.Fatal(err)
+			}
+
+			connack, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(connack, []byte{0x20, 2, 0, tc.expected}) {
+				t.Fatalf("Invalid CONNACK %v", connack)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// The control packet types.
+const (
+	typeConnect byte = iota + 1
+	typeConnack
+	typePublish
+	typePuback
+	typePubrec
+	typePubrel
+	typePubcomp
+	typeSubscribe
+	typeSuback
+	typeUnsubscribe
+	typeUnsuback
+	typePingreq
+	typePingresp
+	typeDisconnect
+)
+
+// The flags of a PUBLISH packet.
+const (
+	flagRetain byte = 0x01
+	flagQoS    byte = 0x06
+	flagDup    byte = 0x08
+)
+
+// The flags of a CONNECT packet.
+const (
+	connectReserved     byte = 0x01
+	connectCleanSession byte = 0x02
+	connectWill         byte = 0x04
+	connectWillQoS      byte = 0x18
+	connectWillRetain   byte = 0x20
+	connectPassword     byte = 0x40
+	connectUsername     byte = 0x80
+)
+
+// The return codes of a CONNACK packet.
+const (
+	connAccepted byte = iota
+	connBadProtocol
+	connBadIdentifier
+	connUnavailable
+	connBadCredentials
+	connNotAuthorized
+)
+
+// subFailure is the return code of a SUBACK packet for a rejected topic filter.
+const subFailure byte = 0x80
+
+// protocolLevel is the level of MQTT 3.1.1.
+const protocolLevel = 4
+
+// MaxPacketSize is the maximum size of a packet received by a server or a client.
+// The connection is closed when a larger packet is received.
+const MaxPacketSize = 16 << 20
+
+// ErrMalformedPacket is returned when a packet that doesn't follow the protocol is received.
+var ErrMalformedPacket = errors.New("mqtt: malformed packet")
+
+type (
+	// packet is a control packet, without the remaining length of its fixed header.
+	packet struct {
+		kind  byte
+		flags byte
+		body  []byte
+	}
+
+	// encoder builds the variable header and the payload of a packet.
+	encoder struct {
+		buf []byte
+	}
+
+	// decoder reads the fields of a packet. After the first error, it returns zero values.
+	decoder struct {
+		buf []byte
+		err error
+	}
+)
+
+// readPacket reads a packet whose size isn't larger than MaxPacketSize.
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var size, shift uint
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, unexpectedEOF(err)
+		}
+		size |= uint(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return packet{}, ErrMalformedPacket
+		}
+		shift += 7
+	}
+	if size > MaxPacketSize {
+		return packet{}, ErrMalformedPacket
+	}
+
+	p := packet{kind: header >> 4, flags: header & 0x0F, body: make([]byte, size)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, unexpectedEOF(err)
+	}
+
+	return p, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// frame returns the packet with the given type and flags, whose variable header and payload
+// were built by the encoder.
+func (e *encoder) frame(kind, flags byte) []byte {
+	n := len(e.buf)
+	header := []byte{kind<<4 | flags}
+	for {
+		b := byte(n & 0x7F)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		header = append(header, b)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(header, e.buf...)
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint16(uint16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.uint16(uint16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// raw appends the bytes without their length, as for the payload of a PUBLISH packet.
+func (e *encoder) raw(v []byte) {
+	e.buf = append(e.buf, v...)
+}
+
+func (d *decoder) fail() {
+	d.err = ErrMalformedPacket
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.buf) < 2 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if n > len(d.buf) {
+		d.fail()
+		return nil
+	}
+	v := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+// string reads a UTF-8 encoded string, which mustn't contain null characters.
+func (d *decoder) string() string {
+	b := d.bytes()
+	if !utf8.Valid(b) || strings.ContainsRune(string(b), 0) {
+		d.fail()
+		return ""
+	}
+	return string(b)
+}
+
+// rest returns the remaining bytes, as the payload of a PUBLISH packet.
+func (d *decoder) rest() []byte {
+	v := d.buf
+	d.buf = nil
+	return v
+}
+
+// done reports whether the packet was read entirely without errors.
+func (d *decoder) done() bool {
+	return d.err == nil && len(d.buf) == 0
+}
+
+// validTopic reports whether the string can be the topic of a PUBLISH packet.
+func validTopic(t string) bool {
+	return t != "" && !strings.ContainsAny(t, "+#")
+}
+
+// validFilter reports whether the string is a valid topic filter: the multi-level wildcard
+// can be only the last level, and the wildcards must occupy an entire level.
+func validFilter(f string) bool {
+	if f == "" {
+		return false
+	}
+
+	levels := strings.Split(f, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+
+	return true
+}
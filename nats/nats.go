@@ -0,0 +1,546 @@
+/*
+Package nats is a front-end to a Hub which speaks a subset of the NATS client protocol,
+so scripts and NATS clients can publish and subscribe to its topics.
+
+The supported operations are CONNECT, PUB, SUB, UNSUB, PING and PONG, and the server sends
+INFO, MSG, PING, PONG, +OK and -ERR. Headers aren't supported, and the echo, authentication
+and TLS options of CONNECT are ignored.
+
+The tokens of a subject are the levels of a topic, so the subject "orders.eu" is the topic
+"orders/eu". The subjects with wildcards are Patterns, in which "*" is "+" and ">" is "+/#".
+Subjects can't contain the characters "/", "+" and "#", and the messages published to topics
+which aren't subjects are skipped. Subscriptions with a queue group join the topic's queue
+group with the same name.
+
+The messages published by the clients are byte slices, or a Msg if they have a reply subject.
+Each subscription is a Conn, and the maximum number of messages given to UNSUB is its
+MessageCount.
+*/
+package nats
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/server"
+)
+
+type (
+	// Msg is the message published by a client which has given a reply subject.
+	// The other messages are published as byte slices.
+	Msg struct {
+		Data  []byte
+		Reply string
+	}
+
+	// Option configures a server.
+	Option func(*options)
+
+	options struct {
+		encode       func(interface{}) ([]byte, error)
+		policy       hub.Policy
+		queueSize    hub.Number
+		pingInterval time.Duration
+	}
+
+	session struct {
+		hub  hub.Hub
+		opts options
+		conn net.Conn
+		// ctx is canceled when the session ends. The Conns are connected with it,
+		// so they are removed from the Hub.
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		wmu sync.Mutex
+		w   *bufio.Writer
+
+		mu      sync.Mutex
+		subs    map[string]*subscription
+		verbose bool
+		// pings is the number of PINGs the client hasn't answered yet.
+		pings int
+		err   error
+
+		wg sync.WaitGroup
+	}
+
+	// subscription is the Conn of a SUB.
+	subscription struct {
+		conn   hub.Conn
+		status *hub.Status
+		topic  hub.Topic
+		queue  string
+		// max is the number of messages after which the subscription ends, if positive,
+		// and received is the number of messages received.
+		max      int
+		received int
+	}
+)
+
+const (
+	// DefaultPingInterval is the interval at which the server pings the clients when no
+	// interval is given.
+	DefaultPingInterval = 2 * time.Minute
+	// maxPingsOut is the number of unanswered PINGs after which a client is disconnected.
+	maxPingsOut = 2
+)
+
+// WithEncoder sets the function which encodes the messages sent to the subscribers.
+// By default, strings and byte slices are sent as they are, a Msg is sent with its
+// reply subject and the other messages are encoded as JSON.
+func WithEncoder(fn func(interface{}) ([]byte, error)) Option {
+	return func(o *options) {
+		o.encode = fn
+	}
+}
+
+// WithQueue sets the Policy and the QueueSize of the subscribers' Conns. By default,
+// as NATS does with slow consumers, slow subscribers are disconnected: the Policy is
+// DisconnectOnFull, and the Hub never waits for the clients. If the Policy is Block,
+// the default is used.
+func WithQueue(p hub.Policy, size hub.Number) Option {
+	return func(o *options) {
+		o.policy, o.queueSize = p, size
+	}
+}
+
+// WithPingInterval sets the interval at which the server pings the clients. A client which
+// doesn't answer two consecutive PINGs is disconnected. If the interval isn't positive,
+// DefaultPingInterval is used.
+func WithPingInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pingInterval = d
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them using ServeConn,
+// until the context is done or the listener fails. The listener is closed and all the
+// connections are served to completion before Serve returns the context's error or the
+// listener's.
+func Serve(ctx context.Context, h hub.Hub, l net.Listener, opts ...Option) error {
+	return server.Serve(ctx, l, func(ctx context.Context, c net.Conn) {
+		_ = ServeConn(ctx, h, c, opts...)
+	})
+}
+
+// ServeConn executes on the Hub the operations received on the connection until the client
+// closes the connection, the context is done or an error occurs. Then the connection is
+// closed and the client's Conns are removed from the Hub. It returns nil if the client has
+// closed the connection, or the context's error or the one that occurred otherwise. If the
+// client was disconnected because one of its Conns was removed from the Hub, the error is
+// the hub.CloseReason.
+func ServeConn(ctx context.Context, h hub.Hub, c net.Conn, opts ...Option) error {
+	o := options{encode: server.Encode}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.policy = server.Policy(o.policy)
+	if o.pingInterval <= 0 {
+		o.pingInterval = DefaultPingInterval
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session{
+		hub:    h,
+		opts:   o,
+		conn:   c,
+		ctx:    ctx,
+		cancel: cancel,
+		w:      bufio.NewWriter(c),
+		subs:   map[string]*subscription{},
+	}
+
+	defer s.wg.Wait()
+	defer c.Close()
+	defer cancel()
+
+	go func() {
+		// unblock the read when the session ends
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	s.info()
+
+	s.wg.Add(1)
+	go s.ping()
+
+	err := s.read(bufio.NewReaderSize(c, maxControlLine))
+
+	s.mu.Lock()
+	serr := s.err
+	s.mu.Unlock()
+
+	switch {
+	case serr != nil:
+		return serr
+	case parent.Err() != nil:
+		return parent.Err()
+	case err == io.EOF:
+		return nil
+	default:
+		return err
+	}
+}
+
+// info sends the INFO operation, which tells the client about the server.
+func (s *session) info() {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	info := map[string]interface{}{
+		"server_id":   strings.ToUpper(hex.EncodeToString(id[:])),
+		"server_name": "hub",
+		"version":     "1.0.0",
+		"proto":       1,
+		"headers":     false,
+		"max_payload": MaxPayload,
+	}
+	if addr, ok := s.conn.LocalAddr().(*net.TCPAddr); ok {
+		info["host"], info["port"] = addr.IP.String(), addr.Port
+	}
+
+	data, _ := json.Marshal(info)
+	s.write("INFO " + string(data) + "\r\n")
+}
+
+func (s *session) read(r *bufio.Reader) error {
+	for {
+		line, err := readLine(r)
+		if err == nil {
+			err = s.execute(r, line)
+		}
+
+		var perr protocolError
+		if errors.As(err, &perr) {
+			s.fail(string(perr), perr)
+			return perr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) execute(r *bufio.Reader, line string) error {
+	op, rest := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		op, rest = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	args := strings.Fields(rest)
+
+	switch strings.ToUpper(op) {
+	case "CONNECT":
+		var opts struct {
+			Verbose bool `json:"verbose"`
+		}
+		if err := json.Unmarshal([]byte(rest), &opts); err != nil {
+			return protocolError(errParser)
+		}
+
+		s.mu.Lock()
+		s.verbose = opts.Verbose
+		s.mu.Unlock()
+
+		s.ok()
+	case "PUB":
+		if len(args) != 2 && len(args) != 3 {
+			return protocolError(errParser)
+		}
+		size, err := strconv.Atoi(args[len(args)-1])
+		if err != nil || size < 0 {
+			return protocolError(errParser)
+		}
+		if size > MaxPayload {
+			return protocolError(errMaxPayload)
+		}
+		payload, err := readPayload(r, size)
+		if err != nil {
+			return err
+		}
+
+		var reply string
+		if len(args) == 3 {
+			reply = args[1]
+		}
+		s.publish(args[0], reply, payload)
+	case "SUB":
+		if len(args) != 2 && len(args) != 3 {
+			return protocolError(errParser)
+		}
+
+		var queue string
+		if len(args) == 3 {
+			queue = args[1]
+		}
+		s.subscribe(args[0], queue, args[len(args)-1])
+	case "UNSUB":
+		if len(args) != 1 && len(args) != 2 {
+			return protocolError(errParser)
+		}
+
+		max := 0
+		if len(args) == 2 {
+			var err error
+			if max, err = strconv.Atoi(args[1]); err != nil {
+				return protocolError(errParser)
+			}
+		}
+		s.unsubscribe(args[0], max)
+	case "PING":
+		s.write("PONG\r\n")
+	case "PONG":
+		s.mu.Lock()
+		s.pings = 0
+		s.mu.Unlock()
+	case "":
+	default:
+		return protocolError(errUnknownOperation)
+	}
+
+	return s.ctx.Err()
+}
+
+// ok acknowledges the operation, if the client has asked for it.
+func (s *session) ok() {
+	s.mu.Lock()
+	verbose := s.verbose
+	s.mu.Unlock()
+
+	if verbose {
+		s.write("+OK\r\n")
+	}
+}
+
+func (s *session) publish(subject, reply string, payload []byte) {
+	t, ok := topic(subject, false)
+	if ok && reply != "" {
+		_, ok = topic(reply, false)
+	}
+	if !ok {
+		s.write("-ERR '" + errInvalidSubject + "'\r\n")
+		return
+	}
+
+	var msg interface{} = payload
+	if reply != "" {
+		msg = Msg{Data: payload, Reply: reply}
+	}
+
+	s.command(hub.Message{Message: msg, Topics: []hub.Topic{t}})
+	s.ok()
+}
+
+// subscribe connects a Conn to the subject's topic. An existing subscription with the
+// same identifier is replaced.
+func (s *session) subscribe(subject, queue, sid string) {
+	t, ok := topic(subject, true)
+	if !ok {
+		s.write("-ERR '" + errInvalidSubject + "'\r\n")
+		return
+	}
+
+	sub := &subscription{conn: make(hub.Conn), status: &hub.Status{}, topic: t, queue: queue}
+
+	s.mu.Lock()
+	if old, ok := s.subs[sid]; ok {
+		old.status.Leave()
+	}
+	s.subs[sid] = sub
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.forward(sid, sub)
+
+	s.command(hub.ConnectEach{
+		Conn:      sub.conn,
+		Topics:    []hub.TopicConn{{Topic: t, Group: queue}},
+		Policy:    s.opts.policy,
+		QueueSize: s.opts.queueSize,
+		Envelope:  true,
+		Context:   s.ctx,
+		Status:    sub.status,
+	})
+	s.ok()
+}
+
+// unsubscribe ends the subscription after it has received max messages in total, or
+// immediately if max isn't positive or the subscription has already received them.
+func (s *session) unsubscribe(sid string, max int) {
+	s.mu.Lock()
+	sub, ok := s.subs[sid]
+	if ok && (max <= 0 || sub.received >= max) {
+		delete(s.subs, sid)
+		sub.status.Leave()
+		ok = false
+	} else if ok {
+		sub.max = max
+	}
+	var remaining int
+	if ok {
+		remaining = max - sub.received
+	}
+	s.mu.Unlock()
+
+	if ok {
+		// the Hub sends at most the remaining messages, but the forwarder stops the
+		// subscription itself, as some of them may already be in the Conn's queue
+		s.command(hub.ConnectEach{
+			Conn:         sub.conn,
+			Topics:       []hub.TopicConn{{Topic: sub.topic, Group: sub.queue}},
+			MessageCount: remaining,
+		})
+	}
+	s.ok()
+}
+
+// command sends the command to the Hub, unless the session ends meanwhile.
+func (s *session) command(cmd interface{}) {
+	server.Command(s.ctx, s.hub, cmd)
+}
+
+// forward sends the messages received by the subscription's Conn to the client.
+func (s *session) forward(sid string, sub *subscription) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-sub.conn:
+			if !ok {
+				s.ended(sid, sub)
+				return
+			}
+
+			s.mu.Lock()
+			active := s.subs[sid] == sub
+			if active {
+				sub.received++
+				if sub.max > 0 && sub.received >= sub.max {
+					delete(s.subs, sid)
+					sub.status.Leave()
+				}
+			}
+			s.mu.Unlock()
+
+			if active {
+				s.send(sid, msg.(hub.Envelope))
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send writes the MSG operation of a message received by a subscription.
+func (s *session) send(sid string, env hub.Envelope) {
+	subject, ok := subject(env.Topic)
+	if !ok {
+		return
+	}
+
+	var reply string
+	var data []byte
+	if m, ok := env.Message.(Msg); ok {
+		reply, data = m.Reply, m.Data
+	} else {
+		var err error
+		if data, err = s.opts.encode(env.Message); err != nil {
+			return
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("MSG " + subject + " " + sid + " ")
+	if reply != "" {
+		b.WriteString(reply + " ")
+	}
+	b.WriteString(strconv.Itoa(len(data)) + "\r\n")
+	b.Write(data)
+	b.WriteString("\r\n")
+
+	s.write(b.String())
+}
+
+// ended handles the removal of the subscription's Conn from the Hub.
+func (s *session) ended(sid string, sub *subscription) {
+	switch reason := sub.status.Reason(); reason {
+	case hub.ReasonQueueFull:
+		s.fail(errSlowConsumer, reason)
+	case hub.ReasonHubClosed:
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = reason
+		}
+		s.mu.Unlock()
+		s.cancel()
+	default:
+		// NATS has no way to tell the client that it was unsubscribed
+		s.mu.Lock()
+		if s.subs[sid] == sub {
+			delete(s.subs, sid)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ping pings the client periodically, and disconnects it if it doesn't answer.
+func (s *session) ping() {
+	defer s.wg.Done()
+
+	t := time.NewTicker(s.opts.pingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			s.pings++
+			stale := s.pings > maxPingsOut
+			s.mu.Unlock()
+
+			if stale {
+				s.fail(errStale, protocolError(errStale))
+				return
+			}
+			s.write("PING\r\n")
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// fail sends the error to the client and ends the session with the given error.
+func (s *session) fail(msg string, err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	s.write(fmt.Sprintf("-ERR '%s'\r\n", msg))
+	s.cancel()
+}
+
+func (s *session) write(data string) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if _, err := s.w.WriteString(data); err == nil {
+		_ = s.w.Flush()
+	}
+}
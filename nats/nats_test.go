@@ -0,0 +1,215 @@
+package nats_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/nats"
+)
+
+// client is a minimal NATS client, which reads the raw operations.
+type client struct {
+	tb   testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func serve(tb testing.TB, opts ...nats.Option) (hub.Hub, string) {
+	tb.Helper()
+
+	return hubtest.Serve(tb, func(ctx context.Context, h hub.Hub, l net.Listener) error {
+		return nats.Serve(ctx, h, l, opts...)
+	})
+}
+
+// dial connects to the server and reads its INFO.
+func dial(tb testing.TB, addr string) *client {
+	tb.Helper()
+
+	conn := hubtest.Dial(tb, addr)
+	c := &client{tb: tb, conn: conn, r: bufio.NewReader(conn)}
+	if info := c.line(); !strings.HasPrefix(info, "INFO {") {
+		tb.Fatalf("Expected INFO, got %q", info)
+	}
+
+	return c
+}
+
+func (c *client) send(ops ...string) {
+	c.tb.Helper()
+
+	if _, err := io.WriteString(c.conn, strings.Join(ops, "\r\n")+"\r\n"); err != nil {
+		c.tb.Fatal(err)
+	}
+}
+
+func (c *client) line() string {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.tb.Fatalf("Expected a line, got error %v", err)
+	}
+
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect reads the given lines.
+func (c *client) expect(lines ...string) {
+	c.tb.Helper()
+
+	for _, expected := range lines {
+		if got := c.line(); got != expected {
+			c.tb.Fatalf("Invalid line.\nExpected %q\nGot %q", expected, got)
+		}
+	}
+}
+
+// expectMessages reads the given number of messages, each a MSG line followed by the
+// payload, and checks that they are the expected ones, in any order, as the messages
+// of different subscriptions can be received in any order. Each message is written as
+// its MSG line and payload separated by a space.
+func (c *client) expectMessages(expected ...string) {
+	c.tb.Helper()
+
+	got := make([]string, 0, len(expected))
+	for range expected {
+		got = append(got, c.line()+" "+c.line())
+	}
+
+	sort.Strings(got)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		c.tb.Fatalf("Invalid messages.\nExpected %q\nGot %q", expected, got)
+	}
+}
+
+func (c *client) expectEOF() {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := c.r.ReadString('\n'); err != io.EOF {
+		c.tb.Fatalf("Expected the connection to be closed, got %q (%v)", line, err)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	h, addr := serve(t)
+
+	sub := dial(t, addr)
+	sub.send(`CONNECT {"verbose": true}`, "SUB foo.* 1", "SUB foo.> 2", "PING")
+	sub.expect("+OK", "+OK", "+OK", "PONG")
+	hubtest.WaitConns(t, h, 2)
+
+	pub := dial(t, addr)
+	pub.send("PUB foo.a 5", "First", "PUB foo.a.b INBOX.1 6", "Second", "PUB foo 5", "Third", "PUB foo.b 6", "Fourth", "PING")
+	pub.expect("PONG")
+
+	sub.expectMessages(
+		"MSG foo.a 1 5 First",
+		"MSG foo.a 2 5 First",
+		"MSG foo.a.b 2 INBOX.1 6 Second",
+		"MSG foo.b 1 6 Fourth",
+		"MSG foo.b 2 6 Fourth",
+	)
+
+	// the Hub's topics are subjects
+	h <- hub.Message{Message: "Fifth", Topics: []hub.Topic{"foo/c"}}
+	h <- hub.Message{Message: "Sixth", Topics: []hub.Topic{"foo/c.d"}}
+	h <- hub.Message{Message: nats.Msg{Data: []byte("Seventh"), Reply: "back"}, Topics: []hub.Topic{"foo/e"}}
+	sub.expectMessages(
+		"MSG foo.c 1 5 Fifth",
+		"MSG foo.c 2 5 Fifth",
+		"MSG foo.e 1 back 7 Seventh",
+		"MSG foo.e 2 back 7 Seventh",
+	)
+
+	sub.send("UNSUB 1", "UNSUB 3")
+	sub.expect("+OK", "+OK")
+	hubtest.WaitConns(t, h, 1)
+}
+
+func TestUnsubMax(t *testing.T) {
+	h, addr := serve(t)
+
+	c := dial(t, addr)
+	c.send("SUB A 1", "PUB A 5", "First", "UNSUB 1 3")
+	c.expect("MSG A 1 5", "First")
+	c.send("PUB A 6", "Second", "PUB A 5", "Third", "PUB A 6", "Fourth")
+	c.expect("MSG A 1 6", "Second", "MSG A 1 5", "Third")
+	hubtest.WaitConns(t, h, 0)
+
+	// the subscription has already received the maximum number of messages
+	c.send("SUB B 2", "PUB B 5", "First")
+	c.expect("MSG B 2 5", "First")
+	c.send("UNSUB 2 1")
+	hubtest.WaitConns(t, h, 0)
+}
+
+func TestQueueGroup(t *testing.T) {
+	h, addr := serve(t)
+
+	c := dial(t, addr)
+	c.send("SUB jobs workers 1", "SUB jobs workers 2", "SUB jobs 3")
+	hubtest.WaitConns(t, h, 3)
+
+	for i := 0; i < 4; i++ {
+		c.send("PUB jobs 1", "x")
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		msg := strings.Fields(c.line())
+		c.line()
+		counts[msg[2]]++
+	}
+
+	if expected := map[string]int{"1": 2, "2": 2, "3": 4}; !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Invalid message counts.\nExpected %v\nGot %v", expected, counts)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	h, addr := serve(t)
+
+	c := dial(t, addr)
+	c.send("PUB foo.* 1", "x", "SUB foo/bar 1", "SUB foo..bar 1", "SUB foo.>.bar 1", "PING")
+	c.expect("-ERR 'Invalid Subject'", "-ERR 'Invalid Subject'", "-ERR 'Invalid Subject'", "-ERR 'Invalid Subject'", "PONG")
+
+	c.send("SUB foo 1")
+	hubtest.WaitConns(t, h, 1)
+	c.send("HPUB foo 0 0")
+	c.expect("-ERR 'Unknown Protocol Operation'")
+	c.expectEOF()
+	hubtest.WaitConns(t, h, 0)
+
+	c = dial(t, addr)
+	c.send("PUB foo 2000000")
+	c.expect("-ERR 'Maximum Payload Violation'")
+	c.expectEOF()
+
+	c = dial(t, addr)
+	c.send("PUB foo 1", "xyz")
+	c.expect("-ERR 'Parser Error'")
+	c.expectEOF()
+}
+
+func TestStaleConnection(t *testing.T) {
+	_, addr := serve(t, nats.WithPingInterval(10*time.Millisecond))
+
+	c := dial(t, addr)
+	c.expect("PING")
+	c.send("PONG")
+	c.expect("PING", "PING", "-ERR 'Stale Connection'")
+	c.expectEOF()
+}
@@ -0,0 +1,114 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/tmaxmax/hub"
+)
+
+const (
+	// MaxPayload is the maximum size of a published message, which is advertised to the
+	// clients. Connections on which larger messages are published are closed.
+	MaxPayload = 1 << 20
+	// maxControlLine is the maximum size of a line without the payload.
+	maxControlLine = 4096
+)
+
+// The errors sent to the clients. The connection is closed after all of them except
+// errInvalidSubject.
+const (
+	errUnknownOperation = "Unknown Protocol Operation"
+	errParser           = "Parser Error"
+	errControlLine      = "Maximum Control Line Exceeded"
+	errMaxPayload       = "Maximum Payload Violation"
+	errInvalidSubject   = "Invalid Subject"
+	errStale            = "Stale Connection"
+	errSlowConsumer     = "Slow Consumer"
+)
+
+// protocolError is an error sent to the client, after which the connection is closed.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "nats: " + strings.ToLower(string(e))
+}
+
+// readLine reads a control line, without its terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxControlLine {
+		return "", protocolError(errControlLine)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))), nil
+}
+
+// readPayload reads a payload of the given size, followed by its terminator.
+func readPayload(r *bufio.Reader, size int) ([]byte, error) {
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(payload, []byte("\r\n")) {
+		return nil, protocolError(errParser)
+	}
+
+	return payload[:size], nil
+}
+
+// topic returns the topic of the subject: its tokens are the levels of the topic.
+// If wildcards are allowed, a subject with wildcards is a Pattern. The wildcard "*"
+// is "+" and ">", which matches one or more tokens, is "+/#". It returns false if
+// the subject is invalid, which includes the subjects with characters that have
+// a meaning in topics.
+func topic(subject string, wildcards bool) (hub.Topic, bool) {
+	if subject == "" || strings.ContainsAny(subject, "/+#") {
+		return nil, false
+	}
+
+	tokens := strings.Split(subject, ".")
+	pattern := false
+	for i, t := range tokens {
+		switch t {
+		case "":
+			return nil, false
+		case "*":
+			tokens[i] = "+"
+			pattern = true
+		case ">":
+			if i != len(tokens)-1 {
+				return nil, false
+			}
+			tokens[i] = "+/#"
+			pattern = true
+		}
+	}
+
+	if pattern {
+		if !wildcards {
+			return nil, false
+		}
+		return hub.Pattern(strings.Join(tokens, "/")), true
+	}
+	return strings.Join(tokens, "/"), true
+}
+
+// subject returns the subject of a topic, or false if the topic isn't a valid subject.
+func subject(t hub.Topic) (string, bool) {
+	s, ok := t.(string)
+	if !ok || s == "" || strings.ContainsAny(s, ". \t\r\n") {
+		return "", false
+	}
+
+	subject := strings.ReplaceAll(s, "/", ".")
+	if strings.HasPrefix(subject, ".") || strings.HasSuffix(subject, ".") || strings.Contains(subject, "..") {
+		return "", false
+	}
+	return subject, true
+}
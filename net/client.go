@@ -0,0 +1,535 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/tmaxmax/hub"
+)
+
+type (
+	// client forwards the commands sent on a Hub channel to a server.
+	client[T any] struct {
+		opts options
+		wmu  sync.Mutex
+		w    *bufio.Writer
+		// stop is closed when the client stops, so the Conns' goroutines stop too.
+		stop chan struct{}
+		wg   sync.WaitGroup
+
+		mu    sync.Mutex
+		ids   map[hub.ConnOf[T]]uint64
+		conns map[uint64]*local[T]
+		next  uint64
+		// draining holds the locals of the KeepAlive Conns the server has closed, so that
+		// if they are connected again their queued messages are delivered first.
+		draining      map[hub.ConnOf[T]]*local[T]
+		drainingSweep int
+	}
+
+	// local is a Conn of a client. The messages received from the server are put in its
+	// queue, from which a goroutine sends them to the Conn, so a slow Conn doesn't delay
+	// the messages of the others, unless its Policy is Block.
+	local[T any] struct {
+		conn   hub.ConnOf[T]
+		policy hub.Policy
+		size   int
+
+		mu       sync.Mutex
+		keep     bool
+		items    []T
+		inFlight bool
+		// closed is set when the Conn is closed by the server, after which the queued
+		// messages are still delivered.
+		closed bool
+		wake   chan struct{}
+		space  chan struct{}
+		done   chan struct{}
+	}
+)
+
+// Dial connects to the server at the given address and returns a Hub channel whose commands
+// are executed by the remote Hub. It also returns a channel that is closed after the Hub
+// channel is closed or the connection to the server is lost, and the Conns are closed.
+//
+// Use Run to find out why the client has stopped.
+func Dial(ctx context.Context, network, address string, opts ...Option) (hub.Hub, <-chan struct{}, error) {
+	return DialOf[interface{}](ctx, network, address, opts...)
+}
+
+// DialOf is the same as Dial, but it returns a HubOf[T].
+func DialOf[T any](ctx context.Context, network, address string, opts ...Option) (hub.HubOf[T], <-chan struct{}, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := make(hub.HubOf[T])
+	done := make(chan struct{})
+
+	go func() {
+		_ = Run(context.Background(), h, c, opts...)
+		close(done)
+	}()
+
+	return h, done, nil
+}
+
+// Run sends the commands received on the Hub channel to the server on the other side of the
+// connection, and sends the messages it sends back to the Conns, until the Hub channel is
+// closed, the context is done or the connection fails. Then the connection and the Conns
+// are closed, unless they were connected with KeepAlive.
+//
+// It returns nil if the Hub channel was closed, or the context's error or the connection's
+// otherwise. In the latter cases the Hub channel isn't closed, as with hub.Run.
+//
+// The Policy and the QueueSize of the Conns are also applied by the client, which queues
+// the messages of each Conn separately: a Conn which doesn't keep up doesn't delay the
+// messages of the others, unless its Policy is Block and its queue is full. A Conn which
+// is disconnected because of the DisconnectOnFull policy is disconnected on the server too.
+//
+// The Hub channel accepts the Connect, ConnectEach, Disconnect, DisconnectAll, Message, Close
+// and CloseAll commands, and messages. As functions and contexts can't be sent over the
+// network, Run panics if a Connect command sets a Filter, a Group, Envelope, ManualCommit,
+// Ack, a Context, a Status or a Subscription, or if a topic isn't a string, a Pattern or nil.
+func Run[T any](ctx context.Context, h hub.HubOf[T], c net.Conn, opts ...Option) error {
+	cl := &client[T]{
+		opts:     newOptions(opts),
+		w:        bufio.NewWriter(c),
+		stop:     make(chan struct{}),
+		ids:      map[hub.ConnOf[T]]uint64{},
+		conns:    map[uint64]*local[T]{},
+		draining: map[hub.ConnOf[T]]*local[T]{},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cl.read(bufio.NewReader(c))
+	}()
+
+	defer func() {
+		close(cl.stop)
+		_ = c.Close()
+		// the Conns are closed by their goroutines, after the reader stops queueing messages
+		<-errs
+		cl.wg.Wait()
+		cl.closeConns()
+	}()
+
+	for {
+		select {
+		case cmd, ok := <-h:
+			if !ok {
+				return nil
+			}
+			if err := cl.send(cmd); err != nil {
+				return err
+			}
+		case err := <-errs:
+			errs <- err
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (cl *client[T]) send(cmd interface{}) error {
+	switch v := cmd.(type) {
+	case hub.MessageOf[T]:
+		return cl.message(&v)
+	case hub.ConnectOf[T]:
+		return cl.connect(toConnectEach(&v))
+	case hub.ConnectEachOf[T]:
+		return cl.connect(&v)
+	case hub.DisconnectOf[T]:
+		id, ok := cl.id(v.Conn)
+		if !ok {
+			return nil
+		}
+		e := newEncoder(opDisconnect)
+		e.uvarint(id)
+		e.topics(v.Topics)
+		return cl.write(e)
+	case hub.DisconnectAllOf[T]:
+		id, ok := cl.id(hub.ConnOf[T](v))
+		if !ok {
+			return nil
+		}
+		e := newEncoder(opDisconnectAll)
+		e.uvarint(id)
+		return cl.write(e)
+	case hub.Close:
+		e := newEncoder(opClose)
+		e.topics(v)
+		return cl.write(e)
+	case hub.CloseAll:
+		return cl.write(newEncoder(opCloseAll))
+	case hub.ConnOf[T]:
+		return cl.connect(&hub.ConnectEachOf[T]{Conn: v})
+	default:
+		msg, ok := v.(T)
+		if !ok && v != nil {
+			panic(fmt.Sprintf("hub/net: invalid command or message of type %T", v))
+		}
+		return cl.message(&hub.MessageOf[T]{Message: msg})
+	}
+}
+
+func toConnectEach[T any](c *hub.ConnectOf[T]) *hub.ConnectEachOf[T] {
+	topics := make([]hub.TopicConnOf[T], 0, len(c.Topics))
+	for _, t := range c.Topics {
+		topics = append(topics, hub.TopicConnOf[T]{Topic: t})
+	}
+
+	return &hub.ConnectEachOf[T]{
+		Conn:         c.Conn,
+		Topics:       topics,
+		MessageCount: c.MessageCount,
+		KeepAlive:    c.KeepAlive,
+		Policy:       c.Policy,
+		QueueSize:    c.QueueSize,
+		Filter:       c.Filter,
+		Envelope:     c.Envelope,
+		ReplayLast:   c.ReplayLast,
+		ReplaySince:  c.ReplaySince,
+		Durable:      c.Durable,
+		ManualCommit: c.ManualCommit,
+		Ack:          c.Ack,
+		Context:      c.Context,
+		Status:       c.Status,
+		Subscription: c.Subscription,
+	}
+}
+
+func (cl *client[T]) connect(c *hub.ConnectEachOf[T]) error {
+	if c.Filter != nil || c.Envelope || c.ManualCommit || c.Ack || c.Context != nil || c.Status != nil || c.Subscription != nil {
+		panic("hub/net: Filter, Envelope, ManualCommit, Ack, Context, Status and Subscription can't be sent over the network")
+	}
+
+	e := newEncoder(opConnect)
+	e.uvarint(cl.register(c))
+	e.varint(int64(c.MessageCount))
+	e.bool(c.KeepAlive)
+	e.varint(int64(c.Policy))
+	e.varint(int64(c.QueueSize))
+	e.varint(int64(c.ReplayLast))
+	e.uvarint(c.ReplaySince)
+	e.string(c.Durable)
+	e.uvarint(uint64(len(c.Topics)))
+	for _, t := range c.Topics {
+		if t.Filter != nil || t.Group != "" {
+			panic("hub/net: Filter and Group can't be sent over the network")
+		}
+		e.topic(t.Topic)
+		e.varint(int64(t.MessageCount))
+	}
+
+	return cl.write(e)
+}
+
+func (cl *client[T]) message(m *hub.MessageOf[T]) error {
+	e := newEncoder(opMessage)
+	e.bool(m.Retain)
+	e.topics(m.Topics)
+
+	data, err := cl.opts.codec.Marshal(m.Message)
+	if err != nil {
+		return err
+	}
+	e.bytes(data)
+
+	return cl.write(e)
+}
+
+func (cl *client[T]) write(e *encoder) error {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+
+	if _, err := cl.w.Write(e.frame()); err != nil {
+		return err
+	}
+	return cl.w.Flush()
+}
+
+// register returns the id of the Conn, which is assigned if the Conn isn't connected yet.
+func (cl *client[T]) register(c *hub.ConnectEachOf[T]) uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	id, ok := cl.ids[c.Conn]
+	if ok {
+		l := cl.conns[id]
+		l.mu.Lock()
+		l.keep = c.KeepAlive
+		l.mu.Unlock()
+
+		return id
+	}
+
+	cl.next++
+	id = cl.next
+	cl.ids[c.Conn] = id
+
+	l := newLocal(c)
+	cl.conns[id] = l
+
+	var after <-chan struct{}
+	if old, ok := cl.draining[c.Conn]; ok {
+		delete(cl.draining, c.Conn)
+		after = old.done
+	}
+
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		l.run(after, cl.stop)
+	}()
+
+	return id
+}
+
+// remove forgets the Conn, whose queued messages are still delivered.
+func (cl *client[T]) remove(id uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	l, ok := cl.conns[id]
+	if !ok {
+		return
+	}
+	delete(cl.conns, id)
+	delete(cl.ids, l.conn)
+
+	if !l.close() {
+		return
+	}
+
+	cl.draining[l.conn] = l
+	if len(cl.draining) > 2*cl.drainingSweep {
+		for c, l := range cl.draining {
+			select {
+			case <-l.done:
+				delete(cl.draining, c)
+			default:
+			}
+		}
+		cl.drainingSweep = len(cl.draining)
+	}
+}
+
+func (cl *client[T]) id(c hub.ConnOf[T]) (uint64, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	id, ok := cl.ids[c]
+	return id, ok
+}
+
+func (cl *client[T]) local(id uint64) (*local[T], bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	l, ok := cl.conns[id]
+	return l, ok
+}
+
+// read sends the messages received from the server to the Conns, and closes the Conns
+// the server has closed.
+func (cl *client[T]) read(r *bufio.Reader) error {
+	for {
+		op, d, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opDeliver:
+			id, data := d.uvarint(), d.bytes()
+			if err := d.end(); err != nil {
+				return err
+			}
+
+			var msg T
+			if err := cl.opts.codec.Unmarshal(data, &msg); err != nil {
+				return err
+			}
+
+			l, ok := cl.local(id)
+			if !ok {
+				continue
+			}
+
+			if !l.push(msg, cl.stop) {
+				cl.remove(id)
+
+				e := newEncoder(opDisconnectAll)
+				e.uvarint(id)
+				if err := cl.write(e); err != nil {
+					return err
+				}
+			}
+		case opClosed:
+			id := d.uvarint()
+			if err := d.end(); err != nil {
+				return err
+			}
+
+			cl.remove(id)
+		default:
+			return ErrMalformedFrame
+		}
+	}
+}
+
+// closeConns forgets the Conns, after their goroutines have stopped and closed them.
+func (cl *client[T]) closeConns() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.conns = map[uint64]*local[T]{}
+	cl.ids = map[hub.ConnOf[T]]uint64{}
+	cl.draining = map[hub.ConnOf[T]]*local[T]{}
+}
+
+func newLocal[T any](c *hub.ConnectEachOf[T]) *local[T] {
+	size := int(c.QueueSize)
+	if size <= 0 {
+		size = hub.DefaultQueueSize
+	}
+
+	return &local[T]{
+		conn:   c.Conn,
+		policy: c.Policy,
+		size:   size,
+		keep:   c.KeepAlive,
+		wake:   make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// push adds the message to the queue, applying the policy if the queue is full. It returns
+// false if the Conn must be disconnected because of the DisconnectOnFull policy.
+func (l *local[T]) push(msg T, stop <-chan struct{}) bool {
+	l.mu.Lock()
+	for len(l.items)+l.count() >= l.size {
+		switch l.policy {
+		case hub.DropNewest:
+			l.mu.Unlock()
+			return true
+		case hub.DropOldest:
+			if len(l.items) == 0 {
+				// the only message is being sent, so the new one is dropped
+				l.mu.Unlock()
+				return true
+			}
+			l.items = l.items[1:]
+		case hub.DisconnectOnFull:
+			l.mu.Unlock()
+			return false
+		default:
+			l.mu.Unlock()
+			select {
+			case <-l.space:
+			case <-stop:
+				return true
+			}
+			l.mu.Lock()
+		}
+	}
+	l.items = append(l.items, msg)
+	l.mu.Unlock()
+
+	signal(l.wake)
+	return true
+}
+
+// count returns 1 if a message is being sent to the Conn, as it occupies a place in the queue.
+func (l *local[T]) count() int {
+	if l.inFlight {
+		return 1
+	}
+	return 0
+}
+
+// close tells the goroutine to close the Conn once the queued messages are delivered.
+// It returns whether the Conn is kept alive.
+func (l *local[T]) close() bool {
+	l.mu.Lock()
+	l.closed = true
+	keep := l.keep
+	l.mu.Unlock()
+
+	signal(l.wake)
+	return keep
+}
+
+// run sends the queued messages to the Conn, after the given channel is closed, until
+// the Conn is closed by the server or the client stops. Then it closes the Conn, unless
+// it was connected with KeepAlive.
+func (l *local[T]) run(after <-chan struct{}, stop <-chan struct{}) {
+	defer func() {
+		l.mu.Lock()
+		keep := l.keep
+		l.mu.Unlock()
+
+		if !keep {
+			close(l.conn)
+		}
+		close(l.done)
+	}()
+
+	if after != nil {
+		select {
+		case <-after:
+		case <-stop:
+			return
+		}
+	}
+
+	for {
+		l.mu.Lock()
+		if len(l.items) == 0 {
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return
+			}
+
+			select {
+			case <-l.wake:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		msg := l.items[0]
+		l.items = l.items[1:]
+		l.inFlight = true
+		l.mu.Unlock()
+
+		select {
+		case l.conn <- msg:
+		case <-stop:
+			return
+		}
+
+		l.mu.Lock()
+		l.inFlight = false
+		l.mu.Unlock()
+		signal(l.space)
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Package net exposes a Hub over the network, so Hubs can be shared between processes.
+
+A server, started with Serve or ServeConn, executes the commands its clients send on a Hub,
+and sends them back the messages their Conns receive. A client is a Hub channel itself,
+created with Dial: the commands sent on it are executed by the remote Hub, and its Conns
+receive the messages as if they were connected to a local Hub.
+
+The messages are encoded using a hub.Codec, which must be the same on both sides. Only
+the topics which are strings, Patterns or the default topic can be sent over the network.
+*/
+package net
+
+import "github.com/tmaxmax/hub"
+
+type (
+	// Option configures a server or a client.
+	Option func(*options)
+
+	options struct {
+		codec   hub.Codec
+		onError func(error)
+	}
+)
+
+// WithCodec sets the Codec used to encode the messages. If it isn't set, or it is nil,
+// hub.JSON is used.
+func WithCodec(c hub.Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors that end the sessions
+// of a server's clients. It may be called concurrently.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.onError = fn
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.codec == nil {
+		o.codec = hub.JSON
+	}
+	return o
+}
@@ -0,0 +1,202 @@
+package net_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	hubnet "github.com/tmaxmax/hub/net"
+)
+
+func checkContents[T any](tb testing.TB, c hub.ConnOf[T], expected ...T) {
+	tb.Helper()
+
+	var got []T
+	for v := range c {
+		got = append(got, v)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		tb.Fatalf("Invalid channel contents.\nExpected %#v\nGot %#v", expected, got)
+	}
+}
+
+func serve[T any](tb testing.TB, opts ...hubnet.Option) (hub.HubOf[T], string) {
+	tb.Helper()
+
+	return hubtest.Serve(tb, func(ctx context.Context, h hub.HubOf[T], l net.Listener) error {
+		return hubnet.Serve(ctx, h, l, opts...)
+	})
+}
+
+func dial[T any](tb testing.TB, addr string, opts ...hubnet.Option) (hub.HubOf[T], <-chan struct{}) {
+	tb.Helper()
+
+	h, done, err := hubnet.DialOf[T](context.Background(), "tcp", addr, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return h, done
+}
+
+func TestClient(t *testing.T) {
+	_, addr := serve[interface{}](t)
+	h, done := dial[interface{}](t, addr)
+
+	conn := make(hub.Conn, 4)
+	h <- hub.Connect{Conn: conn, Topics: []hub.Topic{"A", hub.Pattern("B/+")}, MessageCount: 3}
+	h.Send("First", "A")
+	h.Send("Second", "C")
+	h <- hub.Message{Message: map[string]interface{}{"third": 3.0}, Topics: []hub.Topic{"B/1"}}
+	h.Send("Fourth", "B/2")
+	h.Send("Fifth", "A")
+
+	checkContents[interface{}](t, conn, "First", map[string]interface{}{"third": 3.0}, "Fourth")
+
+	close(h)
+	<-done
+}
+
+func TestClientsShareHub(t *testing.T) {
+	local, addr := serve[int](t)
+	a, aDone := dial[int](t, addr)
+	b, bDone := dial[int](t, addr)
+
+	conn := make(hub.ConnOf[int])
+	a <- hub.ConnectEachOf[int]{Conn: conn, Topics: []hub.TopicConnOf[int]{{Topic: "A", MessageCount: 2}}}
+	hubtest.WaitConns(t, local, 1)
+
+	b.Send(1, "A")
+	for local.Inspect().Published == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	local.Send(2, "A")
+
+	checkContents(t, conn, 1, 2)
+
+	close(a)
+	close(b)
+	<-aDone
+	<-bDone
+}
+
+func TestClientDisconnect(t *testing.T) {
+	local, addr := serve[interface{}](t)
+	h, done := dial[interface{}](t, addr)
+
+	kept, closed := make(hub.Conn, 2), make(hub.Conn, 2)
+	h <- hub.Connect{Conn: kept, Topics: []hub.Topic{"A", "B"}, KeepAlive: true}
+	h <- hub.Connect{Conn: closed, Topics: []hub.Topic{"A"}}
+	h.Disconnect(kept, "B")
+	h.Send("First", "B")
+	h.Send("Second", "A")
+	h.DisconnectAll(kept)
+	h.Close("A")
+
+	checkContents(t, closed, "Second")
+	if msg := <-kept; msg != "Second" {
+		t.Fatalf("Expected the kept Conn to receive the second message, got %v", msg)
+	}
+	if n := len(local.Inspect().Conns); n != 0 {
+		t.Fatalf("Expected no remote Conns, got %d", n)
+	}
+
+	close(h)
+	<-done
+
+	select {
+	case v, ok := <-kept:
+		t.Fatalf("Expected the kept Conn to stay open and empty, got %v, %t", v, ok)
+	default:
+	}
+}
+
+func TestClientSlowConns(t *testing.T) {
+	local, addr := serve[int](t)
+	h, done := dial[int](t, addr)
+
+	slow, full, fast := make(hub.ConnOf[int]), make(hub.ConnOf[int]), make(hub.ConnOf[int], 10)
+	h <- hub.ConnectOf[int]{Conn: slow, Topics: []hub.Topic{"A"}, Policy: hub.DropNewest, QueueSize: 2}
+	h <- hub.ConnectOf[int]{Conn: full, Topics: []hub.Topic{"A"}, Policy: hub.DisconnectOnFull, QueueSize: 2}
+	h <- hub.ConnectOf[int]{Conn: fast, Topics: []hub.Topic{"A"}}
+	hubtest.WaitConns(t, local, 3)
+
+	for i := 0; i < 10; i++ {
+		local.Send(i, "A")
+	}
+
+	// the Conns which don't receive the messages don't delay the others
+	for i := 0; i < 10; i++ {
+		if msg := <-fast; msg != i {
+			t.Fatalf("Expected message %d, got %d", i, msg)
+		}
+	}
+
+	// the full Conn is disconnected on the server too, after its queue is delivered
+	checkContents(t, full, 0, 1)
+	hubtest.WaitConns(t, local, 2)
+
+	if first, second := <-slow, <-slow; first != 0 || second != 1 {
+		t.Fatalf("Expected the slow Conn to receive the first messages, got %d and %d", first, second)
+	}
+
+	close(h)
+	<-done
+	checkContents(t, slow)
+}
+
+func TestServerClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, localDone := hub.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- hubnet.Serve(ctx, local, l)
+	}()
+
+	h, done := dial[interface{}](t, l.Addr().String())
+	conn := h.Connect("A")
+	hubtest.WaitConns(t, local, 1)
+
+	cancel()
+	<-done
+	checkContents(t, conn)
+
+	if err := <-served; err != context.Canceled {
+		t.Fatalf("Expected the server to stop because of the context, got %v", err)
+	}
+	// the remote Conns are removed
+	hubtest.WaitConns(t, local, 0)
+
+	close(local)
+	<-localDone
+}
+
+func TestServeConnMalformed(t *testing.T) {
+	h, done := hub.New()
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- hubnet.ServeConn(context.Background(), h, server)
+	}()
+
+	if _, err := client.Write([]byte{0, 0, 0, 2, 42, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != hubnet.ErrMalformedFrame {
+		t.Fatalf("Expected a malformed frame error, got %v", err)
+	}
+
+	close(h)
+	<-done
+}
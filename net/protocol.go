@@ -0,0 +1,248 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tmaxmax/hub"
+)
+
+// The protocol is made of frames, each prefixed by its length as a big-endian uint32.
+// A frame starts with its opcode, followed by its fields. Integers are varints, and strings
+// and payloads are prefixed by their length. Topics are prefixed by their kind.
+//
+// The client sends the commands, identifying its Conns by numbers it chooses, and the server
+// sends the messages received by the Conns, and tells when a Conn is closed.
+const (
+	// opConnect is followed by the Conn's id, its MessageCount, KeepAlive, Policy, QueueSize,
+	// ReplayLast, ReplaySince and Durable, and by its topics, each with its MessageCount.
+	opConnect byte = iota + 1
+	// opDisconnect is followed by the Conn's id and the topics.
+	opDisconnect
+	// opDisconnectAll is followed by the Conn's id.
+	opDisconnectAll
+	// opMessage is followed by Retain, the topics and the payload.
+	opMessage
+	// opClose is followed by the topics.
+	opClose
+	// opCloseAll has no fields.
+	opCloseAll
+	// opDeliver is followed by the Conn's id and the payload.
+	opDeliver
+	// opClosed is followed by the Conn's id.
+	opClosed
+)
+
+const (
+	topicDefault byte = iota
+	topicString
+	topicPattern
+)
+
+// MaxFrameSize is the maximum size of a frame. Connections on which larger frames are
+// received are closed.
+const MaxFrameSize = 16 << 20
+
+// ErrMalformedFrame is returned when a frame that doesn't follow the protocol is received.
+var ErrMalformedFrame = errors.New("hub/net: malformed frame")
+
+type (
+	// encoder builds a frame.
+	encoder struct {
+		buf []byte
+	}
+
+	// decoder reads the fields of a frame. After the first error, it returns zero values.
+	decoder struct {
+		buf []byte
+		err error
+	}
+)
+
+func newEncoder(op byte) *encoder {
+	// the length is filled in by frame
+	return &encoder{buf: append(make([]byte, 4, 64), op)}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uvarint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.uvarint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// topic panics if the topic can't be sent over the network.
+func (e *encoder) topic(t hub.Topic) {
+	switch v := t.(type) {
+	case nil:
+		e.buf = append(e.buf, topicDefault)
+	case string:
+		e.buf = append(e.buf, topicString)
+		e.string(v)
+	case hub.Pattern:
+		e.buf = append(e.buf, topicPattern)
+		e.string(string(v))
+	default:
+		panic(fmt.Sprintf("hub/net: topics must be strings, Patterns or nil, not %T", t))
+	}
+}
+
+func (e *encoder) topics(topics []hub.Topic) {
+	e.uvarint(uint64(len(topics)))
+	for _, t := range topics {
+		e.topic(t)
+	}
+}
+
+// frame returns the frame, with its length set.
+func (e *encoder) frame() []byte {
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+	return e.buf
+}
+
+func (d *decoder) fail() {
+	d.err = ErrMalformedFrame
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) number() hub.Number {
+	return hub.Number(d.varint())
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	v := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) topic() hub.Topic {
+	switch d.byte() {
+	case topicDefault:
+		return nil
+	case topicString:
+		return d.string()
+	case topicPattern:
+		return hub.Pattern(d.string())
+	default:
+		d.fail()
+		return nil
+	}
+}
+
+// count reads the length of a list whose elements take at least one byte each.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) topics() []hub.Topic {
+	n := d.count()
+	topics := make([]hub.Topic, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		topics = append(topics, d.topic())
+	}
+	return topics
+}
+
+// end returns the decoding error, if any, or ErrMalformedFrame if the frame
+// has unread bytes.
+func (d *decoder) end() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail()
+	}
+	return d.err
+}
+
+// readFrame reads a frame and returns its opcode and a decoder for its fields.
+func readFrame(r *bufio.Reader) (byte, *decoder, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > MaxFrameSize {
+		return 0, nil, ErrMalformedFrame
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	return buf[0], &decoder{buf: buf[1:]}, nil
+}
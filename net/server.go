@@ -0,0 +1,264 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/server"
+)
+
+// session is a client connection served by ServeConn.
+type session[T any] struct {
+	hub  hub.HubOf[T]
+	opts options
+	// ctx is canceled when the session ends. The Conns are connected with it,
+	// so the Hub removes them even if it is waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu    sync.Mutex
+	conns map[uint64]hub.ConnOf[T]
+	err   error
+
+	wg sync.WaitGroup
+}
+
+// Serve accepts connections on the listener and serves each of them using ServeConn,
+// until the context is done or the listener fails. The listener is closed and all the
+// connections are served to completion before Serve returns the context's error or the
+// listener's. The errors that end the sessions are passed to the error handler, if set.
+func Serve[T any](ctx context.Context, h hub.HubOf[T], l net.Listener, opts ...Option) error {
+	o := newOptions(opts)
+
+	return server.Serve(ctx, l, func(ctx context.Context, c net.Conn) {
+		err := ServeConn(ctx, h, c, opts...)
+		if err != nil && ctx.Err() == nil && o.onError != nil {
+			o.onError(err)
+		}
+	})
+}
+
+// ServeConn executes on the Hub the commands received on the connection, and sends back
+// the messages received by the client's Conns, until the client closes the connection,
+// the context is done or an error occurs. Then the connection is closed and the client's
+// Conns are removed from the Hub. It returns nil if the client closed the connection,
+// or the context's error or the one that occurred otherwise.
+//
+// The Conns are connected using the Policy the client requested. With the default Block
+// policy the Hub waits for each message to be sent over the network, so prefer a
+// non-blocking Policy for clients which could be slow.
+func ServeConn[T any](ctx context.Context, h hub.HubOf[T], c net.Conn, opts ...Option) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session[T]{
+		hub:    h,
+		opts:   newOptions(opts),
+		ctx:    ctx,
+		cancel: cancel,
+		w:      bufio.NewWriter(c),
+		conns:  map[uint64]hub.ConnOf[T]{},
+	}
+
+	defer s.wg.Wait()
+	defer c.Close()
+	defer cancel()
+
+	go func() {
+		// unblock the read when the session ends
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	err := s.read(bufio.NewReader(c))
+
+	if serr := s.failure(); serr != nil {
+		return serr
+	}
+	if perr := parent.Err(); perr != nil {
+		return perr
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (s *session[T]) read(r *bufio.Reader) error {
+	for {
+		op, d, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+
+		var cmd interface{}
+
+		switch op {
+		case opConnect:
+			cmd = s.connect(d)
+		case opDisconnect:
+			id, topics := d.uvarint(), d.topics()
+			if c, ok := s.conn(id); ok {
+				cmd = hub.DisconnectOf[T]{Conn: c, Topics: topics}
+			}
+		case opDisconnectAll:
+			if c, ok := s.conn(d.uvarint()); ok {
+				cmd = hub.DisconnectAllOf[T](c)
+			}
+		case opMessage:
+			msg := hub.MessageOf[T]{Retain: d.bool(), Topics: d.topics()}
+			if err := s.opts.codec.Unmarshal(d.bytes(), &msg.Message); err != nil && d.err == nil {
+				return err
+			}
+			cmd = msg
+		case opClose:
+			cmd = hub.Close(d.topics())
+		case opCloseAll:
+			cmd = hub.CloseAll{}
+		default:
+			return ErrMalformedFrame
+		}
+
+		if err := d.end(); err != nil {
+			return err
+		}
+		if cmd == nil {
+			// the Conn was already closed
+			continue
+		}
+
+		select {
+		case s.hub <- cmd:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// connect decodes a Connect command, creating the Conn if the client hasn't connected it yet.
+func (s *session[T]) connect(d *decoder) interface{} {
+	id := d.uvarint()
+	cmd := hub.ConnectEachOf[T]{
+		MessageCount: d.number(),
+		KeepAlive:    d.bool(),
+		Policy:       hub.Policy(d.varint()),
+		QueueSize:    d.number(),
+		ReplayLast:   d.number(),
+		ReplaySince:  d.uvarint(),
+		Durable:      d.string(),
+		Context:      s.ctx,
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		cmd.Topics = append(cmd.Topics, hub.TopicConnOf[T]{Topic: d.topic(), MessageCount: d.number()})
+	}
+	if cmd.Policy < hub.Block || cmd.Policy > hub.DisconnectOnFull {
+		d.fail()
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conns[id]
+	if !ok {
+		c = make(hub.ConnOf[T])
+		s.conns[id] = c
+		s.wg.Add(1)
+		go s.forward(id, c)
+	}
+	cmd.Conn = c
+
+	return cmd
+}
+
+func (s *session[T]) conn(id uint64) (hub.ConnOf[T], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// forward sends to the client the messages received by the Conn, and tells it when
+// the Conn is closed.
+func (s *session[T]) forward(id uint64, c hub.ConnOf[T]) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-c:
+			if !ok {
+				s.closed(id, c)
+				return
+			}
+
+			data, err := s.opts.codec.Marshal(msg)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+
+			e := newEncoder(opDeliver)
+			e.uvarint(id)
+			e.bytes(data)
+			if err := s.write(e); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *session[T]) closed(id uint64, c hub.ConnOf[T]) {
+	s.mu.Lock()
+	if s.conns[id] == c {
+		delete(s.conns, id)
+	}
+	s.mu.Unlock()
+
+	e := newEncoder(opClosed)
+	e.uvarint(id)
+	if err := s.write(e); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *session[T]) write(e *encoder) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if _, err := s.w.Write(e.frame()); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// fail ends the session because of the error, if it hasn't ended already.
+func (s *session[T]) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil && s.ctx.Err() == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+}
+
+func (s *session[T]) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
@@ -0,0 +1,139 @@
+package hub
+
+import "strings"
+
+// Pattern is a Topic that matches hierarchical topics, which are string topics with levels
+// separated by slashes, like "orders/eu/123". Connect to a Pattern to receive the messages
+// published to every string topic it matches, and Close a Pattern to close all the topics
+// and patterns it matches.
+//
+// The "+" level matches exactly one level, and the "#" level, which must be the last one,
+// matches any number of levels, including none: "orders/+/123" matches "orders/eu/123" and
+// "orders/#" matches both "orders" and "orders/eu/123". Wildcards don't match first levels
+// that start with "$", so such topics can be used for special purposes. Elsewhere wildcard
+// characters are matched literally.
+type Pattern string
+
+const (
+	levelSeparator = "/"
+	singleLevel    = "+"
+	multiLevel     = "#"
+)
+
+func (p Pattern) levels() []string {
+	return strings.Split(string(p), levelSeparator)
+}
+
+// Match reports whether the pattern matches the given hierarchical topic.
+func (p Pattern) Match(topic string) bool {
+	return matchLevels(p.levels(), strings.Split(topic, levelSeparator), false)
+}
+
+// covers reports whether all the topics matched by q are also matched by p.
+func (p Pattern) covers(q Pattern) bool {
+	return matchLevels(p.levels(), q.levels(), true)
+}
+
+func matchLevels(pattern, levels []string, wildcards bool) bool {
+	for i, l := range pattern {
+		dollar := i == 0 && len(levels) > 0 && strings.HasPrefix(levels[0], "$")
+
+		if l == multiLevel && i == len(pattern)-1 {
+			return !dollar
+		}
+		if i == len(levels) {
+			return false
+		}
+		if l == singleLevel && !dollar {
+			if wildcards && levels[i] == multiLevel && i == len(levels)-1 {
+				return false
+			}
+			continue
+		}
+		if l != levels[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(levels)
+}
+
+// trie indexes the patterns the connections are connected to by their levels,
+// so the patterns matching a topic are found without checking each of them.
+type trie struct {
+	children map[string]*trie
+	pattern  Pattern
+	terminal bool
+}
+
+func (t *trie) insert(p Pattern) {
+	node := t
+	for _, l := range p.levels() {
+		if node.children == nil {
+			node.children = map[string]*trie{}
+		}
+
+		child, ok := node.children[l]
+		if !ok {
+			child = &trie{}
+			node.children[l] = child
+		}
+		node = child
+	}
+
+	node.pattern = p
+	node.terminal = true
+}
+
+// remove deletes the pattern from the trie and prunes the nodes left without patterns.
+func (t *trie) remove(p Pattern) {
+	t.removeLevels(p.levels())
+}
+
+func (t *trie) removeLevels(levels []string) bool {
+	if len(levels) == 0 {
+		t.terminal = false
+	} else if child, ok := t.children[levels[0]]; ok && child.removeLevels(levels[1:]) {
+		delete(t.children, levels[0])
+	}
+
+	return !t.terminal && len(t.children) == 0
+}
+
+// match returns the patterns that match the given topic.
+func (t *trie) match(topic string) []Pattern {
+	if len(t.children) == 0 {
+		return nil
+	}
+
+	return t.matchLevels(strings.Split(topic, levelSeparator), 0, nil)
+}
+
+func (t *trie) matchLevels(levels []string, i int, matched []Pattern) []Pattern {
+	if i == len(levels) {
+		if t.terminal {
+			matched = append(matched, t.pattern)
+		}
+		if child, ok := t.children[multiLevel]; ok && child.terminal {
+			matched = append(matched, child.pattern)
+		}
+		return matched
+	}
+
+	if child, ok := t.children[levels[i]]; ok {
+		matched = child.matchLevels(levels, i+1, matched)
+	}
+
+	if i == 0 && strings.HasPrefix(levels[0], "$") {
+		return matched
+	}
+
+	if child, ok := t.children[singleLevel]; ok {
+		matched = child.matchLevels(levels, i+1, matched)
+	}
+	if child, ok := t.children[multiLevel]; ok && child.terminal {
+		matched = append(matched, child.pattern)
+	}
+
+	return matched
+}
@@ -0,0 +1,168 @@
+package hub
+
+import "sync"
+
+type (
+	// queue buffers the messages of a Conn that has a non-blocking Policy. A goroutine
+	// forwards the queued messages to the Conn, so the Hub never waits for the consumer.
+	queue[T any] struct {
+		mu       sync.Mutex
+		items    []queued[T]
+		inFlight bool
+		size     int
+		policy   Policy
+		closed   bool
+		keep     bool
+		// abandoned is set when the connection is aborted or its Conn is closed by the consumer,
+		// after which the queued messages are dropped.
+		abandoned bool
+		wake      chan struct{}
+		done      chan struct{}
+	}
+	// queued is a message in a queue. The entry it was sent for is kept, if it's given,
+	// so the message can be dead-lettered if it's dropped.
+	queued[T any] struct {
+		msg   T
+		entry *entry[T]
+	}
+)
+
+func newQueue[T any](c ConnOf[T], policy Policy, size Number, after <-chan struct{}, ref *connRefCount[T]) *queue[T] {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	q := &queue[T]{
+		size:   size,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		if after != nil {
+			<-after
+		}
+		q.run(c, ref)
+	}()
+
+	return q
+}
+
+// full reports whether the queue can't accept another message. The message being
+// currently sent to the Conn also occupies a place, as it wasn't received yet.
+func (q *queue[T]) full() bool {
+	return q.count() >= q.size
+}
+
+func (q *queue[T]) count() int {
+	n := len(q.items)
+	if q.inFlight {
+		n++
+	}
+	return n
+}
+
+// len returns the number of messages the Conn hasn't received yet.
+func (q *queue[T]) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count()
+}
+
+// push adds the message to the queue, applying the policy if the queue is full.
+// It returns false if the message was not queued, and the message dropped to make
+// room for it, if any.
+func (q *queue[T]) push(msg T, e *entry[T]) (bool, *queued[T]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped *queued[T]
+	if q.full() {
+		if q.policy != DropOldest || len(q.items) == 0 {
+			return false, nil
+		}
+		item := q.items[0]
+		dropped = &item
+		q.items[0] = queued[T]{}
+		q.items = q.items[1:]
+	}
+
+	q.items = append(q.items, queued[T]{msg: msg, entry: e})
+	q.signal()
+
+	return true, dropped
+}
+
+func (q *queue[T]) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close tells the queue that no more messages will be pushed. The queued messages are
+// still delivered, after which the Conn is closed if keep is false.
+func (q *queue[T]) close(keep bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.keep = keep
+	q.signal()
+}
+
+func (q *queue[T]) finished() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends the queued messages to the Conn. If the connection is aborted or the Conn
+// is closed by the consumer, the messages are dropped until the queue is closed.
+func (q *queue[T]) run(c ConnOf[T], ref *connRefCount[T]) {
+	defer close(q.done)
+
+	consumerClosed := false
+	for {
+		q.mu.Lock()
+		if q.abandoned {
+			q.items = nil
+		}
+		if len(q.items) == 0 {
+			closed, keep := q.closed, q.keep
+			q.mu.Unlock()
+
+			if closed {
+				if !keep && !consumerClosed {
+					tryClose(c)
+				}
+				return
+			}
+
+			<-q.wake
+			continue
+		}
+
+		msg := q.items[0].msg
+		q.items[0] = queued[T]{}
+		q.items = q.items[1:]
+		q.inFlight = true
+		q.mu.Unlock()
+
+		result := trySend(c, msg, ref.aborted)
+		if result == connClosed {
+			consumerClosed = true
+			ref.abort(ReasonClosedByConsumer)
+		}
+
+		q.mu.Lock()
+		q.inFlight = false
+		q.abandoned = q.abandoned || result != sent
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+package hub
+
+import (
+	"context"
+	"errors"
+)
+
+type (
+	// RequestOf is a command that tells the Hub to publish the given Message to each given
+	// Topic, wrapped in a QueryOf[T], and to send the replies to the Conn. The Conn is
+	// connected to a new inbox topic, from which it receives at most Replies messages,
+	// or all of them if Replies isn't positive, until the Context is done. It is then
+	// disconnected and the inbox is deleted, so late replies are discarded.
+	//
+	// The Conn must not be connected already. It is connected with the DropNewest policy,
+	// so the Hub doesn't wait for a requester that has given up, and with a queue large
+	// enough to hold Replies messages. If no Conn is connected to any of the topics, the
+	// Conn is closed immediately. The Status, if given, tells why the Conn was removed.
+	//
+	// As the responders receive a QueryOf[T], T must be an interface type, or the Hub panics.
+	RequestOf[T any] struct {
+		Conn    ConnOf[T]
+		Message T
+		Topics  []Topic
+		Replies Number
+		Context context.Context
+		Status  *Status
+	}
+
+	// QueryOf is the message received by the responders of a Request. As replying is done
+	// by sending to the Hub, responders that reply from the goroutine receiving from their
+	// Conn should connect with a non-blocking Policy, so the Hub doesn't wait for them
+	// while they wait for the Hub.
+	QueryOf[T any] struct {
+		Message T
+		// The topic to which the replies are published.
+		Inbox Topic
+
+		hub HubOf[T]
+	}
+
+	// Request is the RequestOf command for a Hub.
+	Request = RequestOf[interface{}]
+	// Query is the QueryOf received by the responders of a Request.
+	Query = QueryOf[interface{}]
+
+	// inbox is the topic of a request's replies. Its type is unexported, so it
+	// can't collide with other topics.
+	inbox uint64
+)
+
+// ErrNoResponders is returned by Request and RequestN when the requests aren't answered
+// because no Conn is connected to their topics.
+var ErrNoResponders = errors.New("hub: no responders")
+
+// Reply publishes the reply to the query's inbox. It returns the context's error if the
+// context is done before the Hub receives the reply.
+func (q QueryOf[T]) Reply(ctx context.Context, reply T) error {
+	return q.hub.send(ctx, MessageOf[T]{
+		Message: reply,
+		Topics:  []Topic{q.Inbox},
+	})
+}
+
+func (m *manager[T]) request(r *RequestOf[T]) {
+	checkWrapper[T]("Request", QueryOf[T]{})
+
+	m.inboxes++
+	in := inbox(m.inboxes)
+
+	size := r.Replies
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	m.connectEach(&ConnectEachOf[T]{
+		Conn:         r.Conn,
+		Topics:       []TopicConnOf[T]{{Topic: in}},
+		MessageCount: r.Replies,
+		Policy:       DropNewest,
+		QueueSize:    size,
+		Context:      r.Context,
+		Status:       r.Status,
+	})
+
+	topics := getTopics(r.Topics, true)
+
+	responders := false
+	for _, t := range topics {
+		if m.connected(t) {
+			responders = true
+			break
+		}
+	}
+
+	if !responders {
+		m.disconnect(&DisconnectOf[T]{Conn: r.Conn, Topics: []Topic{in}})
+		return
+	}
+
+	m.metrics.published++
+	m.message(&MessageOf[T]{
+		Message: interface{}(QueryOf[T]{Message: r.Message, Inbox: in, hub: m.hub}).(T),
+		Topics:  topics,
+	})
+}
+
+// Request sends a Request command to the Hub and returns the first reply. It returns the
+// context's error if the context is done before a reply is received, or ErrNoResponders.
+func (h HubOf[T]) Request(ctx context.Context, message T, topics ...Topic) (T, error) {
+	replies, err := h.RequestN(ctx, message, 1, topics...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return replies[0], nil
+}
+
+// RequestN sends a Request command to the Hub and returns the first n replies. If n isn't
+// positive, it returns all the replies received until the context is done, so a context
+// with a deadline should be used. Otherwise, it returns the replies received so far together
+// with the context's error if the context is done before all the replies are received.
+// It returns ErrNoResponders if the requests aren't answered, or ReasonHubClosed if the
+// Hub is closed before all the replies are received.
+func (h HubOf[T]) RequestN(ctx context.Context, message T, n Number, topics ...Topic) ([]T, error) {
+	conn := make(ConnOf[T])
+	status := &Status{}
+
+	err := h.send(ctx, RequestOf[T]{
+		Conn:    conn,
+		Message: message,
+		Topics:  topics,
+		Replies: n,
+		Context: ctx,
+		Status:  status,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []T
+	done := func() ([]T, error) {
+		if n <= 0 {
+			return replies, nil
+		}
+		return replies, ctx.Err()
+	}
+
+	for {
+		select {
+		case reply, ok := <-conn:
+			if !ok {
+				// the inbox is also closed when the context is done or the Hub is closed,
+				// which must not be mistaken for a request without responders
+				if reason := status.Reason(); reason == ReasonHubClosed {
+					return replies, reason
+				} else if reason == ReasonContextDone || ctx.Err() != nil {
+					return done()
+				}
+				if len(replies) == 0 || (n > 0 && len(replies) < n) {
+					return replies, ErrNoResponders
+				}
+				return replies, nil
+			}
+
+			replies = append(replies, reply)
+			if len(replies) == n {
+				return replies, nil
+			}
+		case <-ctx.Done():
+			return done()
+		}
+	}
+}
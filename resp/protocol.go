@@ -0,0 +1,141 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxArgs is the maximum number of arguments of a command.
+	maxArgs = 1 << 20
+	// maxBulkSize is the maximum size of an argument.
+	maxBulkSize = 64 << 20
+)
+
+// ErrProtocol is returned when a client sends something that isn't a command.
+var ErrProtocol = errors.New("resp: protocol error")
+
+// readCommand reads a command, sent either as an array of bulk strings or inline, as a line
+// of space separated arguments. It returns no arguments for empty inline commands.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, ErrProtocol
+	}
+
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, ErrProtocol
+		}
+
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, ErrProtocol
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return nil, ErrProtocol
+		}
+		args = append(args, buf[:size])
+	}
+
+	return args, nil
+}
+
+// readLine reads a line, without its terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return append([]byte(nil), line...), nil
+}
+
+// reply builds a reply for a client using the given protocol version.
+type reply struct {
+	buf   []byte
+	proto int
+}
+
+func (r *reply) line(prefix byte, s string) {
+	r.buf = append(r.buf, prefix)
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *reply) simple(s string) {
+	r.line('+', s)
+}
+
+func (r *reply) error(s string) {
+	r.line('-', s)
+}
+
+func (r *reply) int(n int) {
+	r.line(':', strconv.Itoa(n))
+}
+
+func (r *reply) bulk(b []byte) {
+	r.line('$', strconv.Itoa(len(b)))
+	r.buf = append(r.buf, b...)
+	r.buf = append(r.buf, '\r', '\n')
+}
+
+func (r *reply) bulkString(s string) {
+	r.bulk([]byte(s))
+}
+
+func (r *reply) null() {
+	if r.proto == 3 {
+		r.line('_', "")
+	} else {
+		r.line('$', "-1")
+	}
+}
+
+func (r *reply) array(n int) {
+	r.line('*', strconv.Itoa(n))
+}
+
+// push starts an out-of-band message, which for RESP2 is an array.
+func (r *reply) push(n int) {
+	if r.proto == 3 {
+		r.line('>', strconv.Itoa(n))
+	} else {
+		r.array(n)
+	}
+}
+
+// dict starts a map with n pairs, which for RESP2 is a flat array.
+func (r *reply) dict(n int) {
+	if r.proto == 3 {
+		r.line('%', strconv.Itoa(n))
+	} else {
+		r.array(2 * n)
+	}
+}
@@ -0,0 +1,567 @@
+/*
+Package resp is a front-end to a Hub which speaks the Redis protocol, RESP2 and RESP3, so Redis
+clients and redis-cli can publish and subscribe to its topics.
+
+The supported commands are SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE, PUBLISH,
+PUBSUB CHANNELS, PUBSUB NUMSUB, PUBSUB NUMPAT, PING, HELLO and QUIT. Channels are string
+topics and the patterns are Patterns, so they use the Hub's syntax, like "orders/+/eu",
+instead of glob-style patterns. The published messages are strings.
+
+Each channel or pattern a client subscribes to is a Conn, so the counts returned by PUBLISH
+and PUBSUB include the Conns connected to the Hub by other means.
+*/
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/server"
+)
+
+type (
+	// Option configures a server.
+	Option func(*options)
+
+	options struct {
+		encode    func(interface{}) ([]byte, error)
+		policy    hub.Policy
+		queueSize hub.Number
+	}
+
+	session struct {
+		hub  hub.Hub
+		opts options
+		conn net.Conn
+		// ctx is canceled when the session ends. The Conns are connected with it,
+		// so they are removed from the Hub.
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		wmu sync.Mutex
+		w   *bufio.Writer
+
+		mu    sync.Mutex
+		proto int
+		subs  map[hub.Topic]*subscription
+		err   error
+
+		wg sync.WaitGroup
+	}
+
+	// subscription is the Conn of a channel or a pattern.
+	subscription struct {
+		conn   hub.Conn
+		status *hub.Status
+	}
+)
+
+// errQuit ends the session after the QUIT command.
+var errQuit = errors.New("resp: quit")
+
+// WithEncoder sets the function which encodes the messages sent to the subscribers.
+// By default, strings and byte slices are sent as they are and the other messages
+// are encoded as JSON.
+func WithEncoder(fn func(interface{}) ([]byte, error)) Option {
+	return func(o *options) {
+		o.encode = fn
+	}
+}
+
+// WithQueue sets the Policy and the QueueSize of the subscribers' Conns. By default,
+// as Redis does with its output buffer limits, slow subscribers are disconnected:
+// the Policy is DisconnectOnFull, and the Hub never waits for the clients.
+// If the Policy is Block, the default is used.
+func WithQueue(p hub.Policy, size hub.Number) Option {
+	return func(o *options) {
+		o.policy, o.queueSize = p, size
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them using ServeConn,
+// until the context is done or the listener fails. The listener is closed and all the
+// connections are served to completion before Serve returns the context's error or the
+// listener's.
+func Serve(ctx context.Context, h hub.Hub, l net.Listener, opts ...Option) error {
+	return server.Serve(ctx, l, func(ctx context.Context, c net.Conn) {
+		_ = ServeConn(ctx, h, c, opts...)
+	})
+}
+
+// ServeConn executes on the Hub the commands received on the connection until the client
+// closes the connection or sends QUIT, the context is done or an error occurs. Then the
+// connection is closed and the client's Conns are removed from the Hub. It returns nil if
+// the client has ended the session, or the context's error or the one that occurred
+// otherwise. If the client was disconnected because one of its Conns was removed from
+// the Hub, the error is the hub.CloseReason.
+func ServeConn(ctx context.Context, h hub.Hub, c net.Conn, opts ...Option) error {
+	o := options{encode: server.Encode}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.policy = server.Policy(o.policy)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session{
+		hub:    h,
+		opts:   o,
+		conn:   c,
+		ctx:    ctx,
+		cancel: cancel,
+		w:      bufio.NewWriter(c),
+		proto:  2,
+		subs:   map[hub.Topic]*subscription{},
+	}
+
+	defer s.wg.Wait()
+	defer c.Close()
+	defer cancel()
+
+	go func() {
+		// unblock the read when the session ends
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	err := s.read(bufio.NewReader(c))
+
+	s.mu.Lock()
+	serr := s.err
+	s.mu.Unlock()
+
+	switch {
+	case serr != nil:
+		return serr
+	case parent.Err() != nil:
+		return parent.Err()
+	case err == errQuit, errors.Is(err, io.EOF):
+		return nil
+	default:
+		return err
+	}
+}
+
+func (s *session) read(r *bufio.Reader) error {
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err == ErrProtocol {
+				s.reply(func(r *reply) { r.error("ERR Protocol error") })
+			}
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if err := s.execute(args); err != nil {
+			return err
+		}
+	}
+}
+
+// subscribed reports whether the client is subscribed to a channel or a pattern.
+func (s *session) subscribed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subs) > 0
+}
+
+func (s *session) protocol() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.proto
+}
+
+func (s *session) execute(args [][]byte) error {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	if s.protocol() == 2 && s.subscribed() {
+		switch name {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT":
+		default:
+			s.reply(func(r *reply) {
+				r.error(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+			})
+			return nil
+		}
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return s.arity(name)
+		}
+		s.ping(args)
+	case "HELLO":
+		s.hello(args)
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) == 0 {
+			return s.arity(name)
+		}
+		for _, a := range args {
+			s.subscribe(name == "PSUBSCRIBE", string(a))
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		s.unsubscribe(name == "PUNSUBSCRIBE", args)
+	case "PUBLISH":
+		if len(args) != 2 {
+			return s.arity(name)
+		}
+		s.publish(string(args[0]), string(args[1]))
+	case "PUBSUB":
+		if len(args) == 0 {
+			return s.arity(name)
+		}
+		s.pubsub(strings.ToUpper(string(args[0])), args[1:])
+	case "QUIT":
+		s.reply(func(r *reply) { r.simple("OK") })
+		return errQuit
+	default:
+		s.reply(func(r *reply) { r.error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name))) })
+	}
+
+	return s.ctx.Err()
+}
+
+func (s *session) arity(name string) error {
+	s.reply(func(r *reply) {
+		r.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	})
+	return nil
+}
+
+func (s *session) ping(args [][]byte) {
+	subscribed := s.subscribed()
+
+	s.reply(func(r *reply) {
+		if r.proto == 2 && subscribed {
+			r.array(2)
+			r.bulkString("pong")
+			if len(args) == 1 {
+				r.bulk(args[0])
+			} else {
+				r.bulkString("")
+			}
+		} else if len(args) == 1 {
+			r.bulk(args[0])
+		} else {
+			r.simple("PONG")
+		}
+	})
+}
+
+func (s *session) hello(args [][]byte) {
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil || (v != 2 && v != 3) {
+			s.reply(func(r *reply) { r.error("NOPROTO unsupported protocol version") })
+			return
+		}
+
+		s.mu.Lock()
+		s.proto = v
+		s.mu.Unlock()
+	}
+
+	s.reply(func(r *reply) {
+		r.dict(6)
+		r.bulkString("server")
+		r.bulkString("hub")
+		r.bulkString("version")
+		r.bulkString("1.0.0")
+		r.bulkString("proto")
+		r.int(r.proto)
+		r.bulkString("mode")
+		r.bulkString("standalone")
+		r.bulkString("role")
+		r.bulkString("master")
+		r.bulkString("modules")
+		r.array(0)
+	})
+}
+
+func (s *session) subscribe(pattern bool, name string) {
+	kind := "subscribe"
+	var t hub.Topic = name
+	if pattern {
+		kind, t = "psubscribe", hub.Pattern(name)
+	}
+
+	s.mu.Lock()
+	_, ok := s.subs[t]
+	var sub *subscription
+	if !ok {
+		sub = &subscription{conn: make(hub.Conn), status: &hub.Status{}}
+		s.subs[t] = sub
+	}
+	count := len(s.subs)
+	s.mu.Unlock()
+
+	// the Conn is connected before the reply, so the messages published after it
+	// are received; they wait in the Conn's queue until the reply is written
+	if !ok {
+		s.command(hub.Connect{
+			Conn:      sub.conn,
+			Topics:    []hub.Topic{t},
+			Policy:    s.opts.policy,
+			QueueSize: s.opts.queueSize,
+			Envelope:  true,
+			Context:   s.ctx,
+			Status:    sub.status,
+		})
+	}
+
+	s.reply(func(r *reply) {
+		r.push(3)
+		r.bulkString(kind)
+		r.bulkString(name)
+		r.int(count)
+	})
+
+	if !ok {
+		s.wg.Add(1)
+		go s.forward(t, sub)
+	}
+}
+
+func (s *session) unsubscribe(pattern bool, args [][]byte) {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+
+	topics := make([]hub.Topic, 0, len(args))
+	for _, a := range args {
+		if pattern {
+			topics = append(topics, hub.Pattern(a))
+		} else {
+			topics = append(topics, string(a))
+		}
+	}
+
+	s.mu.Lock()
+	if len(topics) == 0 {
+		for t := range s.subs {
+			if _, ok := t.(hub.Pattern); ok == pattern {
+				topics = append(topics, t)
+			}
+		}
+		sort.Slice(topics, func(i, j int) bool {
+			return fmt.Sprint(topics[i]) < fmt.Sprint(topics[j])
+		})
+	}
+
+	counts := make([]int, 0, len(topics))
+	for _, t := range topics {
+		if sub, ok := s.subs[t]; ok {
+			delete(s.subs, t)
+			sub.status.Leave()
+		}
+		counts = append(counts, len(s.subs))
+	}
+	count := len(s.subs)
+	s.mu.Unlock()
+
+	s.reply(func(r *reply) {
+		if len(topics) == 0 {
+			r.push(3)
+			r.bulkString(kind)
+			r.null()
+			r.int(count)
+			return
+		}
+
+		for i, t := range topics {
+			r.push(3)
+			r.bulkString(kind)
+			r.bulkString(fmt.Sprint(t))
+			r.int(counts[i])
+		}
+	})
+}
+
+func (s *session) publish(channel, msg string) {
+	receivers := make(chan int, 1)
+	s.command(hub.Message{Message: msg, Topics: []hub.Topic{channel}, Receivers: receivers})
+
+	select {
+	case n := <-receivers:
+		s.reply(func(r *reply) { r.int(n) })
+	case <-s.ctx.Done():
+	}
+}
+
+// topics returns the Hub's topics, or nil if the session ends before the Hub replies.
+func (s *session) topics() map[hub.Topic]hub.TopicStats {
+	stats := make(chan hub.Stats, 1)
+	s.command(hub.Inspect(stats))
+
+	select {
+	case st := <-stats:
+		return st.Topics
+	case <-s.ctx.Done():
+		return nil
+	}
+}
+
+func (s *session) pubsub(sub string, args [][]byte) {
+	switch sub {
+	case "CHANNELS":
+		if len(args) > 1 {
+			_ = s.arity("pubsub|channels")
+			return
+		}
+
+		var channels []string
+		for t, ts := range s.topics() {
+			c, ok := t.(string)
+			if ok && ts.Subscribers > 0 && (len(args) == 0 || hub.Pattern(args[0]).Match(c)) {
+				channels = append(channels, c)
+			}
+		}
+		sort.Strings(channels)
+
+		s.reply(func(r *reply) {
+			r.array(len(channels))
+			for _, c := range channels {
+				r.bulkString(c)
+			}
+		})
+	case "NUMSUB":
+		topics := s.topics()
+
+		s.reply(func(r *reply) {
+			r.dict(len(args))
+			for _, a := range args {
+				r.bulk(a)
+				r.int(topics[string(a)].Subscribers)
+			}
+		})
+	case "NUMPAT":
+		n := 0
+		for t, ts := range s.topics() {
+			if _, ok := t.(hub.Pattern); ok && ts.Subscribers > 0 {
+				n++
+			}
+		}
+
+		s.reply(func(r *reply) { r.int(n) })
+	default:
+		s.reply(func(r *reply) {
+			r.error(fmt.Sprintf("ERR unknown subcommand '%s'", strings.ToLower(sub)))
+		})
+	}
+}
+
+// command sends the command to the Hub, unless the session ends meanwhile.
+func (s *session) command(cmd interface{}) {
+	server.Command(s.ctx, s.hub, cmd)
+}
+
+// forward sends the messages received by the subscription's Conn to the client.
+func (s *session) forward(t hub.Topic, sub *subscription) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-sub.conn:
+			if !ok {
+				s.ended(t, sub)
+				return
+			}
+
+			s.mu.Lock()
+			active := s.subs[t] == sub
+			s.mu.Unlock()
+			if !active {
+				// the client has unsubscribed, but the Hub hasn't removed the Conn yet
+				continue
+			}
+
+			env := msg.(hub.Envelope)
+			data, err := s.opts.encode(env.Message)
+			if err != nil {
+				continue
+			}
+			channel, _ := env.Topic.(string)
+
+			s.reply(func(r *reply) {
+				if p, ok := t.(hub.Pattern); ok {
+					r.push(4)
+					r.bulkString("pmessage")
+					r.bulkString(string(p))
+				} else {
+					r.push(3)
+					r.bulkString("message")
+				}
+				r.bulkString(channel)
+				r.bulk(data)
+			})
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// ended handles the removal of the subscription's Conn from the Hub.
+func (s *session) ended(t hub.Topic, sub *subscription) {
+	switch reason := sub.status.Reason(); reason {
+	case hub.ReasonLeft, hub.ReasonContextDone:
+		// the client has unsubscribed or the session has ended
+	case hub.ReasonQueueFull, hub.ReasonHubClosed:
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = reason
+		}
+		s.mu.Unlock()
+		s.cancel()
+	default:
+		// the topic was closed, so the client is unsubscribed
+		kind := "unsubscribe"
+		if _, ok := t.(hub.Pattern); ok {
+			kind = "punsubscribe"
+		}
+
+		s.mu.Lock()
+		if s.subs[t] == sub {
+			delete(s.subs, t)
+		}
+		count := len(s.subs)
+		s.mu.Unlock()
+
+		s.reply(func(r *reply) {
+			r.push(3)
+			r.bulkString(kind)
+			r.bulkString(fmt.Sprint(t))
+			r.int(count)
+		})
+	}
+}
+
+// reply writes the reply built by fn using the client's protocol version.
+func (s *session) reply(fn func(*reply)) {
+	r := reply{proto: s.protocol()}
+	fn(&r)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if _, err := s.w.Write(r.buf); err == nil {
+		_ = s.w.Flush()
+	}
+}
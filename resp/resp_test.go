@@ -0,0 +1,300 @@
+package resp_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/resp"
+)
+
+// client is a minimal Redis client, which reads the raw replies.
+type client struct {
+	tb   testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func serve(tb testing.TB, opts ...resp.Option) (hub.Hub, string) {
+	tb.Helper()
+
+	return hubtest.Serve(tb, func(ctx context.Context, h hub.Hub, l net.Listener) error {
+		return resp.Serve(ctx, h, l, opts...)
+	})
+}
+
+func dial(tb testing.TB, addr string) *client {
+	tb.Helper()
+
+	conn := hubtest.Dial(tb, addr)
+	return &client{tb: tb, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send sends the command as an array of bulk strings.
+func (c *client) send(args ...string) {
+	c.tb.Helper()
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.tb.Fatal(err)
+	}
+}
+
+// expect reads the given lines, which are written without their terminators.
+func (c *client) expect(lines ...string) {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range lines {
+		got, err := c.r.ReadString('\n')
+		if err != nil {
+			c.tb.Fatalf("Expected %q, got error %v", expected, err)
+		}
+		if got != expected+"\r\n" {
+			c.tb.Fatalf("Invalid reply line.\nExpected %q\nGot %q", expected+"\r\n", got)
+		}
+	}
+}
+
+func (c *client) expectEOF() {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := c.r.ReadString('\n'); err != io.EOF {
+		c.tb.Fatalf("Expected the connection to be closed, got %q (%v)", line, err)
+	}
+}
+
+// expectPushes reads the given number of replies, which are arrays of bulk strings, and
+// checks that they are the expected ones, in any order. Each expected reply is written as
+// its elements separated by spaces.
+func (c *client) expectPushes(expected ...string) {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	left := append([]string(nil), expected...)
+	for range expected {
+		got := c.readArray()
+		found := false
+		for i, e := range left {
+			if e == got {
+				left = append(left[:i], left[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.tb.Fatalf("Unexpected reply %q, expected one of %q", got, left)
+		}
+	}
+}
+
+// readArray reads an array or push reply of bulk strings and returns its elements
+// separated by spaces.
+func (c *client) readArray() string {
+	c.tb.Helper()
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.tb.Fatal(err)
+	}
+	if len(line) < 3 || (line[0] != '*' && line[0] != '>') {
+		c.tb.Fatalf("Expected an array, got %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	elems := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := c.r.ReadString('\n'); err != nil {
+			c.tb.Fatal(err)
+		}
+		elem, err := c.r.ReadString('\n')
+		if err != nil {
+			c.tb.Fatal(err)
+		}
+		elems = append(elems, strings.TrimSuffix(elem, "\r\n"))
+	}
+
+	return strings.Join(elems, " ")
+}
+
+func TestSubscribe(t *testing.T) {
+	h, addr := serve(t)
+
+	sub := dial(t, addr)
+	sub.send("SUBSCRIBE", "A", "B")
+	sub.expect("*3", "$9", "subscribe", "$1", "A", ":1", "*3", "$9", "subscribe", "$1", "B", ":2")
+	sub.send("PSUBSCRIBE", "C/+")
+	sub.expect("*3", "$10", "psubscribe", "$3", "C/+", ":3")
+
+	// the channels are subscribed to once the replies are received
+	pub := dial(t, addr)
+	pub.send("PUBLISH", "A", "First")
+	pub.expect(":1")
+	pub.send("PUBLISH", "C/1", "Second")
+	pub.expect(":1")
+	pub.send("PUBLISH", "D", "Third")
+	pub.expect(":0")
+
+	// each channel and pattern is a Conn, so their messages can be received in any order
+	sub.expectPushes("message A First", "pmessage C/+ C/1 Second")
+
+	sub.send("UNSUBSCRIBE", "A")
+	sub.expect("*3", "$11", "unsubscribe", "$1", "A", ":2")
+	hubtest.WaitConns(t, h, 2)
+
+	pub.send("PUBLISH", "A", "Fourth")
+	pub.expect(":0")
+	pub.send("PUBLISH", "B", "Fifth")
+	pub.expect(":1")
+	sub.expect("*3", "$7", "message", "$1", "B", "$5", "Fifth")
+
+	sub.send("UNSUBSCRIBE")
+	sub.expect("*3", "$11", "unsubscribe", "$1", "B", ":1")
+	sub.send("PUNSUBSCRIBE")
+	sub.expect("*3", "$12", "punsubscribe", "$3", "C/+", ":0")
+	sub.send("UNSUBSCRIBE")
+	sub.expect("*3", "$11", "unsubscribe", "$-1", ":0")
+	hubtest.WaitConns(t, h, 0)
+
+	// no longer subscribed, so any command can be sent
+	sub.send("PUBLISH", "A", "Sixth")
+	sub.expect(":0")
+
+	sub.send("QUIT")
+	sub.expect("+OK")
+	sub.expectEOF()
+}
+
+func TestSubscribedMode(t *testing.T) {
+	h, addr := serve(t)
+
+	c := dial(t, addr)
+	if _, err := io.WriteString(c.conn, "PING\r\nPING hello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("+PONG", "$5", "hello")
+
+	c.send("SUBSCRIBE", "A")
+	c.expect("*3", "$9", "subscribe", "$1", "A", ":1")
+	c.send("PING")
+	c.expect("*2", "$4", "pong", "$0", "")
+	c.send("PUBLISH", "A", "First")
+	c.expect("-ERR Can't execute 'publish': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	c.send("PUBSUB", "CHANNELS")
+	c.expect("-ERR Can't execute 'pubsub': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+
+	hubtest.WaitConns(t, h, 1)
+	h <- hub.Message{Message: []byte("Second"), Topics: []hub.Topic{"A"}}
+	c.expect("*3", "$7", "message", "$1", "A", "$6", "Second")
+
+	// the topic is closed, so the client is unsubscribed
+	h.Close("A")
+	c.expect("*3", "$11", "unsubscribe", "$1", "A", ":0")
+
+	c.send("GET", "A")
+	c.expect("-ERR unknown command 'get'")
+}
+
+func TestRESP3(t *testing.T) {
+	h, addr := serve(t)
+
+	c := dial(t, addr)
+	c.send("HELLO", "4")
+	c.expect("-NOPROTO unsupported protocol version")
+	c.send("HELLO", "3")
+	c.expect(
+		"%6",
+		"$6", "server", "$3", "hub",
+		"$7", "version", "$5", "1.0.0",
+		"$5", "proto", ":3",
+		"$4", "mode", "$10", "standalone",
+		"$4", "role", "$6", "master",
+		"$7", "modules", "*0",
+	)
+
+	c.send("SUBSCRIBE", "A")
+	c.expect(">3", "$9", "subscribe", "$1", "A", ":1")
+
+	// in RESP3 the client can send any command when subscribed
+	c.send("PUBLISH", "A", "First")
+	// the reply can be written before or after the message
+	if line, _ := c.r.Peek(1); line[0] == ':' {
+		c.expect(":1", ">3", "$7", "message", "$1", "A", "$5", "First")
+	} else {
+		c.expect(">3", "$7", "message", "$1", "A", "$5", "First", ":1")
+	}
+	c.send("PUBSUB", "NUMSUB", "A", "B")
+	c.expect("%2", "$1", "A", ":1", "$1", "B", ":0")
+	c.send("PING")
+	c.expect("+PONG")
+
+	c.send("UNSUBSCRIBE", "B")
+	c.expect(">3", "$11", "unsubscribe", "$1", "B", ":1")
+	c.send("PUNSUBSCRIBE")
+	c.expect(">3", "$12", "punsubscribe", "_", ":1")
+
+	hubtest.WaitConns(t, h, 1)
+}
+
+func TestPubSub(t *testing.T) {
+	h, addr := serve(t)
+
+	sub := dial(t, addr)
+	sub.send("SUBSCRIBE", "orders/eu", "orders/us", "users")
+	sub.expect(
+		"*3", "$9", "subscribe", "$9", "orders/eu", ":1",
+		"*3", "$9", "subscribe", "$9", "orders/us", ":2",
+		"*3", "$9", "subscribe", "$5", "users", ":3",
+	)
+	sub.send("PSUBSCRIBE", "orders/+", "#")
+	sub.expect(
+		"*3", "$10", "psubscribe", "$8", "orders/+", ":4",
+		"*3", "$10", "psubscribe", "$1", "#", ":5",
+	)
+	hubtest.WaitConns(t, h, 5)
+
+	c := dial(t, addr)
+	c.send("PUBSUB", "CHANNELS")
+	c.expect("*3", "$9", "orders/eu", "$9", "orders/us", "$5", "users")
+	c.send("PUBSUB", "CHANNELS", "orders/+")
+	c.expect("*2", "$9", "orders/eu", "$9", "orders/us")
+	c.send("PUBSUB", "NUMSUB", "users", "none")
+	c.expect("*4", "$5", "users", ":1", "$4", "none", ":0")
+	c.send("PUBSUB", "NUMPAT")
+	c.expect(":2")
+	c.send("PUBSUB", "HELP")
+	c.expect("-ERR unknown subcommand 'help'")
+
+	// the channel's subscriber and both patterns receive the message
+	c.send("PUBLISH", "orders/eu", "First")
+	c.expect(":3")
+	sub.expectPushes(
+		"message orders/eu First",
+		"pmessage orders/+ orders/eu First",
+		"pmessage # orders/eu First",
+	)
+}
+
+func TestProtocolError(t *testing.T) {
+	_, addr := serve(t)
+
+	c := dial(t, addr)
+	if _, err := io.WriteString(c.conn, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("-ERR Protocol error")
+	c.expectEOF()
+}
@@ -0,0 +1,193 @@
+/*
+Package sse streams the messages of a Hub to HTTP clients, such as browsers, as Server-Sent Events.
+
+Each request connects a new Conn to the Hub. The topics and the number of messages to receive
+are taken from the query parameters: for example, "/events?topic=news&pattern=orders/%2B&count=10"
+streams the first 10 messages published to "news" or to the topics matching "orders/+".
+*/
+package sse
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tmaxmax/hub"
+)
+
+type (
+	// HandlerOf is an http.Handler that streams the messages received by a Conn as events.
+	// The Conn is connected to the topics given by the query parameters and is removed
+	// from the Hub when the client disconnects, as if DisconnectAll was sent. The response
+	// ends after the Conn is closed.
+	//
+	// If the Conn can receive EnvelopeOf[T] values, which is the case for a Hub, each event has
+	// the message's sequence number as its id. When a client reconnects with a Last-Event-ID,
+	// it first receives the messages it missed from the histories of the topics, if they are
+	// configured to keep one.
+	HandlerOf[T any] struct {
+		Hub hub.HubOf[T]
+		// Encode returns the data of the event for the message. If it is nil, the message
+		// is encoded as JSON. Newlines in the data are sent as multiple data lines.
+		Encode func(T) ([]byte, error)
+		// The Policy and the QueueSize of the Conns. Prefer a non-blocking Policy,
+		// so the Hub doesn't wait for slow clients.
+		Policy    hub.Policy
+		QueueSize hub.Number
+		// If Heartbeat is positive, a comment is sent at this interval, so proxies
+		// don't close idle connections.
+		Heartbeat time.Duration
+	}
+
+	// Handler is the HandlerOf for a Hub.
+	Handler = HandlerOf[interface{}]
+)
+
+// The query parameters read by the handlers. TopicParam and PatternParam can be repeated.
+// If there are no topics, the Conn is connected to the default topic. If CountParam is
+// given, it is the MessageCount of the Conn.
+const (
+	TopicParam   = "topic"
+	PatternParam = "pattern"
+	CountParam   = "count"
+)
+
+func (h *HandlerOf[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "sse: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "sse: streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var topics []hub.Topic
+	for _, t := range q[TopicParam] {
+		topics = append(topics, t)
+	}
+	for _, p := range q[PatternParam] {
+		topics = append(topics, hub.Pattern(p))
+	}
+
+	var count hub.Number
+	if s := q.Get(CountParam); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "sse: invalid "+CountParam, http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	_, envelope := interface{}(hub.EnvelopeOf[T]{}).(T)
+
+	var since uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" && envelope {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "sse: invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	ctx := r.Context()
+	conn := make(hub.ConnOf[T])
+
+	select {
+	case h.Hub <- hub.ConnectOf[T]{
+		Conn:         conn,
+		Topics:       topics,
+		MessageCount: count,
+		Policy:       h.Policy,
+		QueueSize:    h.QueueSize,
+		Envelope:     envelope,
+		ReplaySince:  since,
+		Context:      ctx,
+	}:
+	case <-ctx.Done():
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	var heartbeat <-chan time.Time
+	if h.Heartbeat > 0 {
+		t := time.NewTicker(h.Heartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case msg, ok := <-conn:
+			if !ok {
+				return
+			}
+
+			buf.Reset()
+			if err := h.event(&buf, msg, envelope); err != nil {
+				return
+			}
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return
+			}
+		case <-heartbeat:
+			if _, err := io.WriteString(w, ":\n\n"); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		f.Flush()
+	}
+}
+
+// event writes the event for the message, which is wrapped in an envelope if envelope is true.
+func (h *HandlerOf[T]) event(buf *bytes.Buffer, msg T, envelope bool) error {
+	if envelope {
+		e := interface{}(msg).(hub.EnvelopeOf[T])
+		buf.WriteString("id: ")
+		buf.WriteString(strconv.FormatUint(e.Sequence, 10))
+		buf.WriteByte('\n')
+		msg = e.Message
+	}
+
+	var data []byte
+	var err error
+	if h.Encode != nil {
+		data, err = h.Encode(msg)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	// "\r\n", "\r" and "\n" all end lines, so the data can't add fields or end the event
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package sse_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/sse"
+)
+
+func get(tb testing.TB, ctx context.Context, url string, lastEventID string) *http.Response {
+	tb.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return res
+}
+
+func checkBody(tb testing.TB, body io.Reader, expected string) {
+	tb.Helper()
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if string(got) != expected {
+		tb.Fatalf("Invalid stream.\nExpected %q\nGot %q", expected, got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&sse.Handler{Hub: h})
+	defer s.Close()
+
+	res := get(t, context.Background(), s.URL+"?topic=A&pattern=B/%2B&count=3", "")
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+
+	hubtest.WaitConns(t, h, 1)
+	h.Send("First", "A")
+	h.Send("Second", "C")
+	h.Send(map[string]int{"third": 3}, "B/1")
+	h.Send("Fourth", "A")
+	h.Send("Fifth", "A")
+
+	checkBody(t, res.Body, "id: 1\ndata: \"First\"\n\nid: 3\ndata: {\"third\":3}\n\nid: 4\ndata: \"Fourth\"\n\n")
+
+	close(h)
+	<-done
+}
+
+func TestHandlerResume(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&sse.Handler{Hub: h})
+	defer s.Close()
+
+	h <- hub.ConfigureTopics{Topics: []hub.Topic{"A"}, History: 10}
+	h.Send("First", "A")
+	h.Send("Second", "A")
+	h.Send("Third", "A")
+
+	res := get(t, context.Background(), s.URL+"?topic=A&count=2", "1")
+	defer res.Body.Close()
+
+	checkBody(t, res.Body, "id: 2\ndata: \"Second\"\n\nid: 3\ndata: \"Third\"\n\n")
+
+	res = get(t, context.Background(), s.URL+"?topic=A", "invalid")
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid Last-Event-ID to be rejected, got %s", res.Status)
+	}
+
+	close(h)
+	<-done
+}
+
+func TestHandlerClientDisconnect(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&sse.Handler{Hub: h})
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := get(t, ctx, s.URL+"?topic=A", "")
+	defer res.Body.Close()
+
+	hubtest.WaitConns(t, h, 1)
+	h.Send("First", "A")
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil || line != "id: 1\n" {
+		t.Fatalf("Expected the first event, got %q, %v", line, err)
+	}
+
+	cancel()
+	hubtest.WaitConns(t, h, 0)
+
+	close(h)
+	<-done
+}
+
+func TestHandlerTyped(t *testing.T) {
+	h, done := hub.NewOf[string]()
+	s := httptest.NewServer(&sse.HandlerOf[string]{
+		Hub: h,
+		Encode: func(s string) ([]byte, error) {
+			return []byte(strings.ToUpper(s)), nil
+		},
+		Policy:    hub.DropOldest,
+		Heartbeat: time.Hour,
+	})
+	defer s.Close()
+
+	res := get(t, context.Background(), s.URL+"?count=2", "")
+	defer res.Body.Close()
+
+	hubtest.WaitConns(t, h, 1)
+	h.Send("first\nline")
+	// a bare CR ends a line too, so it can't be used to inject fields
+	h.Send("second\rid: 9\r\n\revent: x")
+
+	checkBody(t, res.Body, "data: FIRST\ndata: LINE\n\ndata: SECOND\ndata: ID: 9\ndata: \ndata: EVENT: X\n\n")
+
+	res = get(t, context.Background(), s.URL+"?count=many", "")
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid count to be rejected, got %s", res.Status)
+	}
+
+	close(h)
+	<-done
+}
@@ -0,0 +1,154 @@
+package hub
+
+type (
+	// InspectOf is a command that tells the Hub to send on the channel a snapshot of its state.
+	InspectOf[T any] chan<- StatsOf[T]
+
+	// StatsOf is a snapshot of the state of a Hub. The inboxes of the Requests in progress
+	// and their Conns aren't included.
+	StatsOf[T any] struct {
+		// The topics to which at least a Conn is connected, or which have a retained message
+		// or a history.
+		Topics map[Topic]TopicStats
+		Conns  map[ConnOf[T]]ConnStats
+		// The number of messages published to the Hub since it was started, including the
+		// Requests. The dead letters and the lifecycle events the Hub publishes itself
+		// aren't counted.
+		Published uint64
+		// The number of messages sent to Conns, or put in their queues. Redeliveries are counted.
+		Delivered uint64
+		// The number of messages not delivered because of the Conns' policies.
+		Dropped uint64
+	}
+
+	// TopicStats is the state of a topic.
+	TopicStats struct {
+		// The number of Conns connected to the topic itself. For a string topic, the Conns
+		// connected to the Patterns matching it are not counted.
+		Subscribers int
+		// The number of members of each queue group of the topic.
+		Groups map[string]int
+		// Whether the topic has a retained message.
+		Retained bool
+		// The number of messages in the topic's history kept in memory.
+		History int
+	}
+
+	// ConnStats is the state of a Conn.
+	ConnStats struct {
+		// The number of messages the Conn will still receive from each topic it is connected to,
+		// or 0 if it isn't limited.
+		Topics map[Topic]Number
+		// The total number of messages the Conn will still receive, or 0 if it isn't limited.
+		Remaining Number
+		KeepAlive bool
+		// The number of messages waiting in the Conn's queue, including the one being sent.
+		Queued int
+		// The number of messages the Conn hasn't acknowledged yet.
+		Unacked int
+		// The name of the Conn's durable subscription, if any.
+		Durable string
+	}
+
+	// Inspect is the InspectOf command for a Hub.
+	Inspect = InspectOf[interface{}]
+	// Stats is the StatsOf a Hub.
+	Stats = StatsOf[interface{}]
+
+	// metrics are the cumulative counters of the Hub.
+	metrics struct {
+		published uint64
+		delivered uint64
+		dropped   uint64
+	}
+)
+
+func (m *manager[T]) inspect(c InspectOf[T]) {
+	s := StatsOf[T]{
+		Topics:    map[Topic]TopicStats{},
+		Conns:     make(map[ConnOf[T]]ConnStats, len(m.conns)),
+		Published: m.metrics.published,
+		Delivered: m.metrics.delivered,
+		Dropped:   m.metrics.dropped,
+	}
+
+	for t, conns := range m.topics {
+		if _, ok := t.(inbox); ok {
+			continue
+		}
+
+		ts := s.Topics[t]
+		ts.Subscribers = len(conns)
+		if groups := m.groups[t]; len(groups) > 0 {
+			ts.Groups = make(map[string]int, len(groups))
+			for name, g := range groups {
+				ts.Groups[name] = len(g.members)
+			}
+		}
+		s.Topics[t] = ts
+
+		for c, tr := range conns {
+			cs, ok := s.Conns[c]
+			if !ok {
+				ref := m.conns[c]
+				cs = ConnStats{
+					Topics:    map[Topic]Number{},
+					Remaining: Number(ref.messages),
+					KeepAlive: ref.keep,
+					Queued:    ref.load() - len(ref.pending),
+					Unacked:   len(ref.pending),
+				}
+				if ref.durable != nil {
+					cs.Durable = ref.durable.name
+				}
+				s.Conns[c] = cs
+			}
+			cs.Topics[t] = tr.remaining(t)
+		}
+	}
+
+	for t := range m.retained {
+		ts := s.Topics[t]
+		ts.Retained = true
+		s.Topics[t] = ts
+	}
+	for t, h := range m.histories {
+		ts := s.Topics[t]
+		ts.History = h.len
+		s.Topics[t] = ts
+	}
+
+	c <- s
+}
+
+// remaining returns the number of messages the connection will still receive from the
+// topic, or 0 if it isn't limited. The connection stays connected to the topic until
+// it and all its subscriptions have received their messages.
+func (tr *topicRef[T]) remaining(t Topic) Number {
+	var n Number
+	if tr.direct {
+		if tr.messages == 0 {
+			return 0
+		}
+		n = Number(tr.messages)
+	}
+
+	for s := range tr.subs {
+		r := s.remaining(t)
+		if r == 0 {
+			return 0
+		}
+		if r > n {
+			n = r
+		}
+	}
+
+	return n
+}
+
+// Inspect is a shortcut for sending an Inspect command to the Hub and receiving the snapshot.
+func (h HubOf[T]) Inspect() StatsOf[T] {
+	c := make(chan StatsOf[T], 1)
+	h <- InspectOf[T](c)
+	return <-c
+}
@@ -0,0 +1,88 @@
+package hub
+
+import "sync"
+
+// Status tells why a Conn was removed from the Hub. Pass a new Status when connecting the Conn,
+// and after its channel is closed, or after Done is closed if KeepAlive was set, check its Reason.
+// The zero value is ready to use. A Status must not be used for more than one connection:
+// the connections after the first one ignore it.
+type Status struct {
+	once      sync.Once
+	claimOnce sync.Once
+	done      chan struct{}
+	reason    CloseReason
+	leave     chan struct{}
+	leaveOnce sync.Once
+}
+
+func (s *Status) init() {
+	s.once.Do(func() {
+		s.done = make(chan struct{})
+		s.leave = make(chan struct{})
+	})
+}
+
+// Leave tells the Hub to remove the Conn, as if DisconnectAll was sent. Unlike sending
+// DisconnectAll, it never blocks, so it can be called from the goroutine receiving from
+// the Conn even if the Hub is waiting for it to receive a message. The Conn's channel is
+// closed afterwards, unless KeepAlive was set, so it should still be drained.
+func (s *Status) Leave() {
+	s.init()
+	s.leaveOnce.Do(func() {
+		close(s.leave)
+	})
+}
+
+func (s *Status) left() <-chan struct{} {
+	s.init()
+	return s.leave
+}
+
+// Done returns a channel that is closed when the Conn is removed from the Hub. If the Conn
+// has a queue, the queued messages may still be delivered afterwards.
+func (s *Status) Done() <-chan struct{} {
+	s.init()
+	return s.done
+}
+
+// Reason returns why the Conn was removed from the Hub, or 0 if it wasn't removed yet.
+func (s *Status) Reason() CloseReason {
+	select {
+	case <-s.Done():
+		return s.reason
+	default:
+		return 0
+	}
+}
+
+// Err returns nil if the Conn wasn't removed from the Hub yet, or otherwise the reason
+// it was removed for, as an error.
+func (s *Status) Err() error {
+	if r := s.Reason(); r != 0 {
+		return r
+	}
+	return nil
+}
+
+// claim returns the Status if it is used by a connection for the first time, or nil otherwise,
+// so that a Status which is used again is ignored.
+func (s *Status) claim() *Status {
+	if s == nil {
+		return nil
+	}
+
+	claimed := false
+	s.claimOnce.Do(func() {
+		claimed = true
+	})
+	if !claimed {
+		return nil
+	}
+	return s
+}
+
+func (s *Status) close(reason CloseReason) {
+	s.init()
+	s.reason = reason
+	close(s.done)
+}
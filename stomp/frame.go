@@ -0,0 +1,185 @@
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxFrameSize is the maximum size of the body of a frame received by the server.
+	// The connection is closed when a larger frame is received.
+	MaxFrameSize = 16 << 20
+	// maxHeaders is the maximum number of headers of a frame.
+	maxHeaders = 128
+	// maxLine is the maximum size of the command or of a header line.
+	maxLine = 8 << 10
+)
+
+// ErrMalformedFrame is returned when a frame that doesn't follow the protocol is received.
+var ErrMalformedFrame = errors.New("stomp: malformed frame")
+
+type (
+	// frame is a STOMP frame. When a header is repeated, only its first value is used.
+	frame struct {
+		command string
+		headers []header
+		body    []byte
+	}
+
+	header struct {
+		name, value string
+	}
+)
+
+func (f *frame) get(name string) string {
+	for _, h := range f.headers {
+		if h.name == name {
+			return h.value
+		}
+	}
+	return ""
+}
+
+func (f *frame) set(name, value string) {
+	f.headers = append(f.headers, header{name, value})
+}
+
+var (
+	escaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	unescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+// readFrame reads a frame. The EOLs sent before it, which are heart-beats, are skipped,
+// and beat is called for each of them and before reading the frame.
+func readFrame(r *bufio.Reader, beat func()) (*frame, error) {
+	var line string
+	for {
+		beat()
+
+		var err error
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if line != "" {
+			break
+		}
+	}
+
+	f := &frame{command: line}
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if line == "" {
+			break
+		}
+		if len(f.headers) == maxHeaders {
+			return nil, ErrMalformedFrame
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, ErrMalformedFrame
+		}
+		name, value := line[:i], line[i+1:]
+		// the headers of CONNECT frames aren't escaped, for compatibility with STOMP 1.0
+		if f.command != "CONNECT" {
+			if !validEscapes(name) || !validEscapes(value) {
+				return nil, ErrMalformedFrame
+			}
+			name, value = unescaper.Replace(name), unescaper.Replace(value)
+		}
+		f.set(name, value)
+	}
+
+	if l := f.get("content-length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > MaxFrameSize {
+			return nil, ErrMalformedFrame
+		}
+
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if f.body[n] != 0 {
+			return nil, ErrMalformedFrame
+		}
+		f.body = f.body[:n]
+	} else {
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if b == 0 {
+				break
+			}
+			if len(f.body) == MaxFrameSize {
+				return nil, ErrMalformedFrame
+			}
+			f.body = append(f.body, b)
+		}
+	}
+
+	return f, nil
+}
+
+// readLine reads a line, without its EOL.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLine {
+		return "", ErrMalformedFrame
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// validEscapes reports whether the backslashes of the header only start the escape
+// sequences defined by the protocol.
+func validEscapes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			continue
+		}
+		if i+1 == len(s) || !strings.ContainsRune(`\rnc`, rune(s[i+1])) {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// bytes returns the encoded frame. The headers of CONNECTED frames aren't escaped.
+func (f *frame) bytes() []byte {
+	var b strings.Builder
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+	for _, h := range f.headers {
+		if f.command == "CONNECTED" {
+			b.WriteString(h.name + ":" + h.value)
+		} else {
+			b.WriteString(escaper.Replace(h.name) + ":" + escaper.Replace(h.value))
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+
+	return []byte(b.String())
+}
@@ -0,0 +1,740 @@
+/*
+Package stomp is a front-end to a Hub which speaks STOMP 1.2, so STOMP clients can send
+messages to its topics and subscribe to them.
+
+The destinations are string topics. When subscribing, the destinations with "+" or "#" levels
+are Patterns, so "/topic/orders/#" receives the messages sent to all the orders. Messages
+can't be sent to such destinations.
+
+The messages sent with a text content type are published as strings, and the others as byte
+slices. The subscribers receive strings and byte slices as they are, with the content type
+"text/plain;charset=utf-8" for strings and none for byte slices, and the other messages
+encoded as JSON.
+
+Each subscription is a Conn. The subscriptions with the ack mode "client" or
+"client-individual" are in ack mode: ACK acknowledges the message, or for "client" all the
+messages received before it too, and NACK delivers the message again. The messages that
+aren't acknowledged are delivered again after the ack timeout, with a new ack header, and
+their previous ack headers are forgotten. The frames sent in transactions are executed when
+the transaction is committed.
+*/
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/server"
+)
+
+type (
+	// Option configures a server.
+	Option func(*options)
+
+	options struct {
+		encode    func(interface{}) ([]byte, string, error)
+		policy    hub.Policy
+		queueSize hub.Number
+		// send and receive are the heart-beat intervals offered to the clients.
+		send, receive time.Duration
+		ackTimeout    time.Duration
+	}
+
+	session struct {
+		hub  hub.Hub
+		opts options
+		conn net.Conn
+		// ctx is canceled when the session ends. The Conns are connected with it,
+		// so they are removed from the Hub.
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		wmu sync.Mutex
+		w   *bufio.Writer
+		// wrote tells whether a frame was written since the last heart-beat.
+		wrote bool
+
+		mu   sync.Mutex
+		subs map[string]*subscription
+		// pending are the messages of the subscriptions in ack mode which weren't
+		// acknowledged yet, by ack header.
+		pending map[string]pending
+		nextAck uint64
+		// txs are the frames of the transactions in progress.
+		txs map[string][]*frame
+		err error
+
+		wg sync.WaitGroup
+	}
+
+	// subscription is the Conn of a SUBSCRIBE.
+	subscription struct {
+		conn   hub.Conn
+		status *hub.Status
+		// cumulative is set for the ack mode "client".
+		cumulative bool
+		// acks are the ack headers of the pending messages, by sequence number, so the
+		// previous ack header of a message delivered again is forgotten.
+		acks map[uint64]string
+	}
+
+	pending struct {
+		sub      *subscription
+		ack      uint64
+		delivery *hub.Delivery
+	}
+
+	// protocolError is sent to the client in an ERROR frame, after which the connection
+	// is closed.
+	protocolError struct {
+		message string
+		receipt string
+		// headers are added to the ERROR frame.
+		headers []header
+	}
+)
+
+const (
+	// DefaultHeartBeat is the heart-beat interval offered to the clients in both directions
+	// when no interval is given.
+	DefaultHeartBeat = 10 * time.Second
+	// connectTimeout is how long a server waits for the CONNECT frame.
+	connectTimeout = 10 * time.Second
+	// version is the supported protocol version.
+	version = "1.2"
+)
+
+// errDisconnect ends the session after the DISCONNECT frame.
+var errDisconnect = errors.New("stomp: disconnect")
+
+func (e *protocolError) Error() string {
+	return "stomp: " + e.message
+}
+
+// WithEncoder sets the function which encodes the messages sent to the subscribers, and
+// returns their content type, which can be empty. By default, strings are sent as they are
+// with the content type "text/plain;charset=utf-8", byte slices are sent as they are without
+// a content type and the other messages are encoded as JSON.
+func WithEncoder(fn func(interface{}) ([]byte, string, error)) Option {
+	return func(o *options) {
+		o.encode = fn
+	}
+}
+
+// WithQueue sets the Policy and the QueueSize of the subscribers' Conns. By default,
+// slow subscribers are disconnected: the Policy is DisconnectOnFull, and the Hub never
+// waits for the clients. If the Policy is Block, the default is used.
+func WithQueue(p hub.Policy, size hub.Number) Option {
+	return func(o *options) {
+		o.policy, o.queueSize = p, size
+	}
+}
+
+// WithHeartBeat sets the heart-beat intervals the server offers to the clients: the
+// interval at which it can send heart-beats and the one at which it wants to receive
+// them. A zero interval disables heart-beating in that direction. The intervals used
+// are the largest of the server's and the client's, as the protocol says.
+func WithHeartBeat(send, receive time.Duration) Option {
+	return func(o *options) {
+		o.send, o.receive = send, receive
+	}
+}
+
+// WithAckTimeout sets the time the subscriptions in ack mode have to acknowledge a message
+// before it is delivered again. By default, it is hub.DefaultAckTimeout.
+func WithAckTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.ackTimeout = d
+	}
+}
+
+func encode(v interface{}) ([]byte, string, error) {
+	data, err := server.Encode(v)
+	switch v.(type) {
+	case string:
+		return data, "text/plain;charset=utf-8", err
+	case []byte:
+		return data, "", err
+	default:
+		return data, "application/json", err
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them using ServeConn,
+// until the context is done or the listener fails. The listener is closed and all the
+// connections are served to completion before Serve returns the context's error or the
+// listener's.
+func Serve(ctx context.Context, h hub.Hub, l net.Listener, opts ...Option) error {
+	return server.Serve(ctx, l, func(ctx context.Context, c net.Conn) {
+		_ = ServeConn(ctx, h, c, opts...)
+	})
+}
+
+// ServeConn executes on the Hub the frames received on the connection until the client
+// disconnects, the context is done or an error occurs. Then the connection is closed and
+// the client's Conns are removed from the Hub. It returns nil if the client has sent
+// DISCONNECT, or the context's error or the one that occurred otherwise. If the client was
+// disconnected because one of its Conns was removed from the Hub, the error is the
+// hub.CloseReason.
+func ServeConn(ctx context.Context, h hub.Hub, c net.Conn, opts ...Option) error {
+	o := options{
+		encode:  encode,
+		send:    DefaultHeartBeat,
+		receive: DefaultHeartBeat,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.policy = server.Policy(o.policy)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session{
+		hub:     h,
+		opts:    o,
+		conn:    c,
+		ctx:     ctx,
+		cancel:  cancel,
+		w:       bufio.NewWriter(c),
+		subs:    map[string]*subscription{},
+		pending: map[string]pending{},
+		txs:     map[string][]*frame{},
+	}
+
+	defer s.wg.Wait()
+	defer c.Close()
+	defer cancel()
+
+	go func() {
+		// unblock the read when the session ends
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	err := s.serve(bufio.NewReaderSize(c, maxLine))
+
+	var perr *protocolError
+	if errors.As(err, &perr) {
+		s.fail(perr)
+	} else if err == ErrMalformedFrame {
+		s.fail(&protocolError{message: "malformed frame"})
+	}
+
+	s.mu.Lock()
+	serr := s.err
+	s.mu.Unlock()
+
+	switch {
+	case serr != nil:
+		return serr
+	case parent.Err() != nil:
+		return parent.Err()
+	case err == errDisconnect:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (s *session) serve(r *bufio.Reader) error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+
+	f, err := readFrame(r, func() {})
+	if err != nil {
+		return err
+	}
+
+	receive, err := s.connect(f)
+	if err != nil {
+		return err
+	}
+
+	beat := func() {
+		if receive > 0 {
+			// some tolerance is allowed, as the protocol advises
+			_ = s.conn.SetReadDeadline(time.Now().Add(2 * receive))
+		} else {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	for {
+		f, err := readFrame(r, beat)
+		if err != nil {
+			return err
+		}
+		if err := s.handle(f); err != nil {
+			return err
+		}
+	}
+}
+
+// connect handles the CONNECT frame and returns the interval at which the client
+// sends heart-beats.
+func (s *session) connect(f *frame) (time.Duration, error) {
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		return 0, &protocolError{message: "expected a CONNECT frame"}
+	}
+
+	supported := false
+	for _, v := range strings.Split(f.get("accept-version"), ",") {
+		supported = supported || v == version
+	}
+	if !supported {
+		return 0, &protocolError{
+			message: "supported protocol versions are " + version,
+			headers: []header{{"version", version}},
+		}
+	}
+
+	var cx, cy time.Duration
+	if hb := f.get("heart-beat"); hb != "" {
+		var ok bool
+		if cx, cy, ok = parseHeartBeat(hb); !ok {
+			return 0, &protocolError{message: "invalid heart-beat header"}
+		}
+	}
+
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	connected := &frame{command: "CONNECTED"}
+	connected.set("version", version)
+	connected.set("heart-beat", strconv.FormatInt(s.opts.send.Milliseconds(), 10)+","+strconv.FormatInt(s.opts.receive.Milliseconds(), 10))
+	connected.set("server", "hub/1.0.0")
+	connected.set("session", hex.EncodeToString(id[:]))
+	s.write(connected)
+
+	if send := negotiate(s.opts.send, cy); send > 0 {
+		s.wg.Add(1)
+		go s.heartBeat(send)
+	}
+
+	return negotiate(cx, s.opts.receive), nil
+}
+
+// parseHeartBeat parses the value of a heart-beat header.
+func parseHeartBeat(hb string) (time.Duration, time.Duration, bool) {
+	parts := strings.Split(hb, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	x, err1 := strconv.ParseUint(parts[0], 10, 32)
+	y, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond, true
+}
+
+// negotiate returns the heart-beat interval used, given the interval offered by the sender
+// and the one wanted by the receiver.
+func negotiate(send, receive time.Duration) time.Duration {
+	if send == 0 || receive == 0 {
+		return 0
+	}
+	if send > receive {
+		return send
+	}
+	return receive
+}
+
+func (s *session) handle(f *frame) error {
+	receipt := f.get("receipt")
+
+	switch f.command {
+	case "SEND", "ACK", "NACK":
+		if tx := f.get("transaction"); tx != "" {
+			s.mu.Lock()
+			frames, ok := s.txs[tx]
+			if ok {
+				s.txs[tx] = append(frames, f)
+			}
+			s.mu.Unlock()
+
+			if !ok {
+				return &protocolError{message: "unknown transaction " + tx, receipt: receipt}
+			}
+			break
+		}
+		if err := s.execute(f); err != nil {
+			return err
+		}
+	case "SUBSCRIBE":
+		if err := s.subscribe(f); err != nil {
+			return err
+		}
+	case "UNSUBSCRIBE":
+		id := f.get("id")
+		if id == "" {
+			return &protocolError{message: "missing id header", receipt: receipt}
+		}
+		s.unsubscribe(id)
+	case "BEGIN", "COMMIT", "ABORT":
+		if err := s.transaction(f); err != nil {
+			return err
+		}
+	case "DISCONNECT":
+		s.receipt(receipt)
+		return errDisconnect
+	default:
+		return &protocolError{message: "unknown command " + f.command, receipt: receipt}
+	}
+
+	s.receipt(receipt)
+
+	return s.ctx.Err()
+}
+
+// execute executes a SEND, ACK or NACK frame.
+func (s *session) execute(f *frame) error {
+	receipt := f.get("receipt")
+
+	if f.command != "SEND" {
+		id := f.get("id")
+		if id == "" {
+			return &protocolError{message: "missing id header", receipt: receipt}
+		}
+		s.acknowledge(id, f.command == "ACK")
+		return nil
+	}
+
+	dest := f.get("destination")
+	if dest == "" || pattern(dest) {
+		return &protocolError{message: "invalid destination " + strconv.Quote(dest), receipt: receipt}
+	}
+
+	var msg interface{} = f.body
+	if strings.HasPrefix(f.get("content-type"), "text/") {
+		msg = string(f.body)
+	}
+	s.command(hub.Message{Message: msg, Topics: []hub.Topic{dest}})
+
+	return nil
+}
+
+func (s *session) transaction(f *frame) error {
+	receipt := f.get("receipt")
+	tx := f.get("transaction")
+	if tx == "" {
+		return &protocolError{message: "missing transaction header", receipt: receipt}
+	}
+
+	s.mu.Lock()
+	frames, ok := s.txs[tx]
+	if f.command == "BEGIN" {
+		if !ok {
+			s.txs[tx] = nil
+		}
+	} else {
+		delete(s.txs, tx)
+	}
+	s.mu.Unlock()
+
+	if ok == (f.command == "BEGIN") {
+		if ok {
+			return &protocolError{message: "transaction " + tx + " already started", receipt: receipt}
+		}
+		return &protocolError{message: "unknown transaction " + tx, receipt: receipt}
+	}
+
+	if f.command == "COMMIT" {
+		for _, f := range frames {
+			if err := s.execute(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// pattern reports whether the destination has wildcard levels.
+func pattern(dest string) bool {
+	for _, l := range strings.Split(dest, "/") {
+		if l == "+" || l == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) subscribe(f *frame) error {
+	receipt := f.get("receipt")
+	id, dest := f.get("id"), f.get("destination")
+	if id == "" || dest == "" {
+		return &protocolError{message: "missing id or destination header", receipt: receipt}
+	}
+
+	mode := f.get("ack")
+	if mode == "" {
+		mode = "auto"
+	}
+	if mode != "auto" && mode != "client" && mode != "client-individual" {
+		return &protocolError{message: "invalid ack mode " + strconv.Quote(mode), receipt: receipt}
+	}
+
+	var t hub.Topic = dest
+	if pattern(dest) {
+		if strings.Contains(dest, "#/") && !strings.HasSuffix(dest, "/#") {
+			return &protocolError{message: "invalid destination " + strconv.Quote(dest), receipt: receipt}
+		}
+		t = hub.Pattern(dest)
+	}
+
+	sub := &subscription{
+		conn:       make(hub.Conn),
+		status:     &hub.Status{},
+		cumulative: mode == "client",
+		acks:       map[uint64]string{},
+	}
+
+	s.mu.Lock()
+	_, exists := s.subs[id]
+	if !exists {
+		s.subs[id] = sub
+	}
+	s.mu.Unlock()
+
+	if exists {
+		return &protocolError{message: "subscription " + id + " already exists", receipt: receipt}
+	}
+
+	s.wg.Add(1)
+	go s.forward(id, sub)
+
+	s.command(hub.Connect{
+		Conn:       sub.conn,
+		Topics:     []hub.Topic{t},
+		Policy:     s.opts.policy,
+		QueueSize:  s.opts.queueSize,
+		Envelope:   mode == "auto",
+		Ack:        mode != "auto",
+		AckTimeout: s.opts.ackTimeout,
+		Context:    s.ctx,
+		Status:     sub.status,
+	})
+
+	return nil
+}
+
+func (s *session) unsubscribe(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub, ok := s.subs[id]; ok {
+		delete(s.subs, id)
+		s.release(sub)
+		sub.status.Leave()
+	}
+}
+
+// release forgets the pending messages of the subscription.
+func (s *session) release(sub *subscription) {
+	for ack, p := range s.pending {
+		if p.sub == sub {
+			delete(s.pending, ack)
+		}
+	}
+}
+
+// acknowledge acknowledges the message with the given ack header, or delivers it again.
+// For the subscriptions with the ack mode "client", the messages received before it are
+// acknowledged too. Unknown messages are ignored, as they may have been acknowledged or
+// delivered again.
+func (s *session) acknowledge(ack string, ok bool) {
+	s.mu.Lock()
+	p, found := s.pending[ack]
+	var settled []*hub.Delivery
+	if found {
+		for a, q := range s.pending {
+			if q.sub == p.sub && (q.ack == p.ack || (p.sub.cumulative && q.ack < p.ack)) {
+				delete(s.pending, a)
+				delete(q.sub.acks, q.delivery.Sequence)
+				settled = append(settled, q.delivery)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range settled {
+		if ok {
+			d.Ack()
+		} else {
+			d.Nack()
+		}
+	}
+}
+
+// receipt sends a RECEIPT frame, if the client has asked for one.
+func (s *session) receipt(id string) {
+	if id == "" {
+		return
+	}
+
+	f := &frame{command: "RECEIPT"}
+	f.set("receipt-id", id)
+	s.write(f)
+}
+
+// command sends the command to the Hub, unless the session ends meanwhile.
+func (s *session) command(cmd interface{}) {
+	server.Command(s.ctx, s.hub, cmd)
+}
+
+// forward sends the messages received by the subscription's Conn to the client.
+func (s *session) forward(id string, sub *subscription) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-sub.conn:
+			if !ok {
+				s.ended(id, sub)
+				return
+			}
+
+			s.mu.Lock()
+			active := s.subs[id] == sub
+			s.mu.Unlock()
+			if active {
+				s.send(id, sub, msg)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send writes the MESSAGE frame of a message received by the subscription.
+func (s *session) send(id string, sub *subscription, msg interface{}) {
+	var env hub.Envelope
+	d, ok := msg.(*hub.Delivery)
+	if ok {
+		env = d.EnvelopeOf
+	} else {
+		env = msg.(hub.Envelope)
+	}
+
+	dest, ok := env.Topic.(string)
+	body, contentType, err := s.opts.encode(env.Message)
+	if !ok || err != nil {
+		// the message can't be sent, so it isn't delivered again
+		if d != nil {
+			d.Ack()
+		}
+		return
+	}
+
+	f := &frame{command: "MESSAGE", body: body}
+	f.set("subscription", id)
+	f.set("message-id", strconv.FormatUint(env.Sequence, 10))
+	f.set("destination", dest)
+	if d != nil {
+		s.mu.Lock()
+		s.nextAck++
+		ack := strconv.FormatUint(s.nextAck, 10)
+		if prev, ok := sub.acks[env.Sequence]; ok {
+			delete(s.pending, prev)
+		}
+		sub.acks[env.Sequence] = ack
+		s.pending[ack] = pending{sub: sub, ack: s.nextAck, delivery: d}
+		s.mu.Unlock()
+
+		f.set("ack", ack)
+	}
+	if contentType != "" {
+		f.set("content-type", contentType)
+	}
+	f.set("content-length", strconv.Itoa(len(body)))
+
+	s.write(f)
+}
+
+// ended handles the removal of the subscription's Conn from the Hub.
+func (s *session) ended(id string, sub *subscription) {
+	switch reason := sub.status.Reason(); reason {
+	case hub.ReasonQueueFull, hub.ReasonHubClosed:
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = reason
+		}
+		s.mu.Unlock()
+		s.fail(&protocolError{message: reason.Error()})
+	default:
+		// STOMP has no way to tell the client that it was unsubscribed
+		s.mu.Lock()
+		if s.subs[id] == sub {
+			delete(s.subs, id)
+		}
+		s.release(sub)
+		s.mu.Unlock()
+	}
+}
+
+// heartBeat sends a heart-beat at the given interval, if no frame was sent meanwhile.
+func (s *session) heartBeat(interval time.Duration) {
+	defer s.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.wmu.Lock()
+			if !s.wrote {
+				if _, err := s.w.WriteString("\n"); err == nil {
+					_ = s.w.Flush()
+				}
+			}
+			s.wrote = false
+			s.wmu.Unlock()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// fail sends the error to the client in an ERROR frame and ends the session.
+func (s *session) fail(e *protocolError) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = e
+	}
+	s.mu.Unlock()
+
+	f := &frame{command: "ERROR", body: []byte(e.message)}
+	f.set("message", e.message)
+	if e.receipt != "" {
+		f.set("receipt-id", e.receipt)
+	}
+	f.set("content-type", "text/plain")
+	f.set("content-length", strconv.Itoa(len(f.body)))
+	f.headers = append(f.headers, e.headers...)
+
+	s.write(f)
+	s.cancel()
+}
+
+func (s *session) write(f *frame) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.wrote = true
+	if _, err := s.w.Write(f.bytes()); err == nil {
+		_ = s.w.Flush()
+	}
+}
@@ -0,0 +1,366 @@
+package stomp_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/stomp"
+)
+
+type (
+	// client is a minimal STOMP client.
+	client struct {
+		tb   testing.TB
+		conn net.Conn
+		r    *bufio.Reader
+	}
+
+	// frame is a frame received by a client. Its headers are written as "name:value".
+	frame struct {
+		command string
+		headers []string
+		body    string
+	}
+)
+
+func serve(tb testing.TB, opts ...stomp.Option) (hub.Hub, string) {
+	tb.Helper()
+
+	return hubtest.Serve(tb, func(ctx context.Context, h hub.Hub, l net.Listener) error {
+		return stomp.Serve(ctx, h, l, opts...)
+	})
+}
+
+// dial connects to the server and sends the CONNECT frame with the given headers,
+// without expecting a reply.
+func dial(tb testing.TB, addr string, headers ...string) *client {
+	tb.Helper()
+
+	conn := hubtest.Dial(tb, addr)
+	c := &client{tb: tb, conn: conn, r: bufio.NewReader(conn)}
+	c.send("CONNECT", "", headers...)
+
+	return c
+}
+
+// connect connects to the server and checks that the connection is accepted.
+func connect(tb testing.TB, addr string) *client {
+	tb.Helper()
+
+	c := dial(tb, addr, "accept-version:1.1,1.2", "host:localhost", "heart-beat:0,0")
+	c.expect(frame{command: "CONNECTED", headers: []string{"heart-beat:10000,10000", "server:hub/1.0.0", "version:1.2"}})
+
+	return c
+}
+
+func (c *client) send(command, body string, headers ...string) {
+	c.tb.Helper()
+
+	data := command + "\n" + strings.Join(headers, "\n")
+	if len(headers) > 0 {
+		data += "\n"
+	}
+	data += "\n" + body + "\x00"
+
+	if _, err := io.WriteString(c.conn, data); err != nil {
+		c.tb.Fatal(err)
+	}
+}
+
+// read reads a frame, skipping the heart-beats. Its headers are sorted, and the
+// session header is removed, as it is random.
+func (c *client) read() frame {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var f frame
+	for f.command == "" {
+		f.command = c.line()
+	}
+
+	length := -1
+	for {
+		h := c.line()
+		if h == "" {
+			break
+		}
+		if strings.HasPrefix(h, "content-length:") {
+			length, _ = strconv.Atoi(strings.TrimPrefix(h, "content-length:"))
+		}
+		if !strings.HasPrefix(h, "session:") {
+			f.headers = append(f.headers, h)
+		}
+	}
+	sort.Strings(f.headers)
+
+	var body []byte
+	if length >= 0 {
+		body = make([]byte, length+1)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			c.tb.Fatal(err)
+		}
+	} else {
+		var err error
+		if body, err = c.r.ReadBytes(0); err != nil {
+			c.tb.Fatal(err)
+		}
+	}
+	if body[len(body)-1] != 0 {
+		c.tb.Fatalf("Frame body %q isn't terminated by a null byte", body)
+	}
+	f.body = string(body[:len(body)-1])
+
+	return f
+}
+
+func (c *client) line() string {
+	c.tb.Helper()
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.tb.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// expect reads the given frames, whose headers must be sorted.
+func (c *client) expect(frames ...frame) {
+	c.tb.Helper()
+
+	for _, expected := range frames {
+		if got := c.read(); !reflect.DeepEqual(got, expected) {
+			c.tb.Fatalf("Invalid frame.\nExpected %+v\nGot %+v", expected, got)
+		}
+	}
+}
+
+func (c *client) expectEOF() {
+	c.tb.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c.r); err != nil {
+		c.tb.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func receipt(id string) frame {
+	return frame{command: "RECEIPT", headers: []string{"receipt-id:" + id}}
+}
+
+// message returns a MESSAGE frame with the given headers and a content-length header.
+func message(body string, headers ...string) frame {
+	headers = append(headers, "content-length:"+strconv.Itoa(len(body)))
+	sort.Strings(headers)
+
+	return frame{command: "MESSAGE", headers: headers, body: body}
+}
+
+func TestSendSubscribe(t *testing.T) {
+	h, addr := serve(t)
+
+	sub := connect(t, addr)
+	sub.send("SUBSCRIBE", "", "id:0", "destination:/topic/a", "receipt:r1")
+	sub.send("SUBSCRIBE", "", "id:1", "destination:/topic/+")
+	sub.expect(receipt("r1"))
+	hubtest.WaitConns(t, h, 2)
+
+	pub := connect(t, addr)
+	pub.send("SEND", "First", "destination:/topic/a", "content-type:text/plain", "receipt:r2")
+	pub.expect(receipt("r2"))
+
+	// the subscriptions' messages can be received in any order
+	first, second := sub.read(), sub.read()
+	if first.headers[len(first.headers)-1] > second.headers[len(second.headers)-1] {
+		first, second = second, first
+	}
+	for i, f := range []frame{first, second} {
+		expected := message("First", "content-type:text/plain;charset=utf-8", "destination:/topic/a", "message-id:1", "subscription:"+strconv.Itoa(i))
+		if !reflect.DeepEqual(f, expected) {
+			t.Fatalf("Invalid frame.\nExpected %+v\nGot %+v", expected, f)
+		}
+	}
+
+	sub.send("UNSUBSCRIBE", "", "id:0", "receipt:r3")
+	sub.expect(receipt("r3"))
+	hubtest.WaitConns(t, h, 1)
+
+	// the body of a frame with a content-length can contain null bytes
+	pub.send("SEND", "Sec\x00ond", "destination:/topic/b", "content-length:7")
+	sub.expect(message("Sec\x00ond", "destination:/topic/b", "message-id:2", "subscription:1"))
+
+	h <- hub.Message{Message: map[string]int{"third": 3}, Topics: []hub.Topic{"/topic/c"}}
+	sub.expect(message(`{"third":3}`, "content-type:application/json", "destination:/topic/c", "message-id:3", "subscription:1"))
+
+	sub.send("DISCONNECT", "", "receipt:bye")
+	sub.expect(receipt("bye"))
+	sub.expectEOF()
+	hubtest.WaitConns(t, h, 0)
+}
+
+func TestAck(t *testing.T) {
+	h, addr := serve(t)
+
+	c := connect(t, addr)
+	c.send("SUBSCRIBE", "", "id:0", "destination:A", "ack:client-individual")
+	c.send("SUBSCRIBE", "", "id:1", "destination:B", "ack:client", "receipt:r1")
+	c.expect(receipt("r1"))
+	hubtest.WaitConns(t, h, 2)
+
+	c.send("SEND", "First", "destination:A")
+	c.expect(message("First", "ack:1", "destination:A", "message-id:1", "subscription:0"))
+
+	// the message is delivered again
+	c.send("NACK", "", "id:1")
+	c.expect(message("First", "ack:2", "destination:A", "message-id:1", "subscription:0"))
+	c.send("ACK", "", "id:2")
+
+	c.send("SEND", "Second", "destination:B")
+	c.expect(message("Second", "ack:3", "destination:B", "message-id:2", "subscription:1"))
+	c.send("SEND", "Third", "destination:B")
+	c.expect(message("Third", "ack:4", "destination:B", "message-id:3", "subscription:1"))
+
+	// both messages are acknowledged
+	c.send("ACK", "", "id:4", "receipt:r2")
+	c.expect(receipt("r2"))
+
+	for conn, stats := range h.Inspect().Conns {
+		for stats.Unacked != 0 {
+			time.Sleep(time.Millisecond)
+			stats = h.Inspect().Conns[conn]
+		}
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	h, addr := serve(t, stomp.WithAckTimeout(50*time.Millisecond))
+
+	c := connect(t, addr)
+	c.send("SUBSCRIBE", "", "id:0", "destination:A", "ack:client-individual", "receipt:r1")
+	c.expect(receipt("r1"))
+	hubtest.WaitConns(t, h, 1)
+
+	// the message isn't acknowledged in time, so it is delivered again
+	c.send("SEND", "First", "destination:A")
+	c.expect(
+		message("First", "ack:1", "destination:A", "message-id:1", "subscription:0"),
+		message("First", "ack:2", "destination:A", "message-id:1", "subscription:0"),
+	)
+
+	// the previous ack header is forgotten, so the message is delivered again, which can
+	// happen before the receipt is sent
+	c.send("ACK", "", "id:1", "receipt:r2")
+	got := []frame{c.read(), c.read()}
+	if got[0].command != "RECEIPT" {
+		got[0], got[1] = got[1], got[0]
+	}
+	expected := []frame{receipt("r2"), message("First", "ack:3", "destination:A", "message-id:1", "subscription:0")}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Invalid frames.\nExpected %+v\nGot %+v", expected, got)
+	}
+
+	c.send("ACK", "", "id:3", "receipt:r3")
+	c.expect(receipt("r3"))
+
+	for conn, stats := range h.Inspect().Conns {
+		for stats.Unacked != 0 {
+			time.Sleep(time.Millisecond)
+			stats = h.Inspect().Conns[conn]
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	h, addr := serve(t)
+
+	c := connect(t, addr)
+	c.send("SUBSCRIBE", "", "id:0", "destination:A")
+	hubtest.WaitConns(t, h, 1)
+
+	c.send("BEGIN", "", "transaction:tx1")
+	c.send("BEGIN", "", "transaction:tx2")
+	c.send("SEND", "First", "destination:A", "transaction:tx1")
+	c.send("SEND", "Second", "destination:A", "transaction:tx2")
+	c.send("SEND", "Third", "destination:A")
+	c.expect(message("Third", "destination:A", "message-id:1", "subscription:0"))
+
+	c.send("ABORT", "", "transaction:tx2")
+	c.send("COMMIT", "", "transaction:tx1")
+	c.expect(message("First", "destination:A", "message-id:2", "subscription:0"))
+
+	c.send("COMMIT", "", "transaction:tx2", "receipt:r1")
+	c.expect(frame{
+		command: "ERROR",
+		headers: []string{"content-length:23", "content-type:text/plain", "message:unknown transaction tx2", "receipt-id:r1"},
+		body:    "unknown transaction tx2",
+	})
+	c.expectEOF()
+}
+
+func TestErrors(t *testing.T) {
+	_, addr := serve(t)
+
+	c := dial(t, addr, "accept-version:1.0,1.1")
+	c.expect(frame{
+		command: "ERROR",
+		headers: []string{"content-length:35", "content-type:text/plain", "message:supported protocol versions are 1.2", "version:1.2"},
+		body:    "supported protocol versions are 1.2",
+	})
+	c.expectEOF()
+
+	c = connect(t, addr)
+	c.send("SEND", "First", "destination:a/+")
+	c.expect(frame{
+		command: "ERROR",
+		headers: []string{"content-length:25", "content-type:text/plain", "message:invalid destination \"a/+\""},
+		body:    `invalid destination "a/+"`,
+	})
+	c.expectEOF()
+
+	c = connect(t, addr)
+	c.send("SUBSCRIBE", "", "id:0", "destination:a", "ack:sometimes")
+	c.expect(frame{
+		command: "ERROR",
+		headers: []string{"content-length:28", "content-type:text/plain", "message:invalid ack mode \"sometimes\""},
+		body:    `invalid ack mode "sometimes"`,
+	})
+	c.expectEOF()
+
+	c = connect(t, addr)
+	if _, err := io.WriteString(c.conn, "SEND\ndestination:a\\t\n\n\x00"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(frame{
+		command: "ERROR",
+		headers: []string{"content-length:15", "content-type:text/plain", "message:malformed frame"},
+		body:    "malformed frame",
+	})
+	c.expectEOF()
+}
+
+func TestHeartBeat(t *testing.T) {
+	_, addr := serve(t, stomp.WithHeartBeat(10*time.Millisecond, 20*time.Millisecond))
+
+	c := dial(t, addr, "accept-version:1.2", "heart-beat:5,5")
+	c.expect(frame{command: "CONNECTED", headers: []string{"heart-beat:10,20", "server:hub/1.0.0", "version:1.2"}})
+
+	// the client doesn't send heart-beats, so the server closes the connection after
+	// sending some of its own
+	rest, err := io.ReadAll(c.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) == 0 || strings.Trim(string(rest), "\n") != "" {
+		t.Fatalf("Expected only heart-beats, got %q", rest)
+	}
+}
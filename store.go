@@ -0,0 +1,112 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type (
+	// Record is a message published to persisted topics, as saved in a Store.
+	Record struct {
+		// The sequence number the Hub assigned to the message.
+		Sequence uint64
+		// The time the Hub received the message at.
+		Time time.Time
+		// The persisted topics the message was published to.
+		Topics []string
+		// The message, encoded using the Hub's Codec.
+		Data []byte
+	}
+
+	// Store saves the messages published to persisted topics, so they can be replayed
+	// even after the Hub is restarted. Configure the topics to persist using ConfigureTopics,
+	// and set the Hub's Store using WithStore.
+	//
+	// The Hub calls a Store only from the goroutine it runs on, but doesn't close it.
+	Store interface {
+		// Append saves the record. The records are appended in increasing order of their
+		// sequence numbers, which may have gaps between them.
+		Append(r Record) error
+		// Read calls fn for each saved record with a sequence number greater than or
+		// equal to from, in order, until fn returns false.
+		Read(from uint64, fn func(Record) bool) error
+		// LastSequence returns the sequence number of the last appended record,
+		// or 0 if the Store is empty.
+		LastSequence() (uint64, error)
+	}
+
+	// Codec encodes and decodes the messages saved in a Store.
+	Codec interface {
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	jsonCodec struct{}
+)
+
+// JSON is a Codec that uses the encoding/json package. Keep in mind that when decoding
+// messages of interface types, like the ones of a Hub, JSON objects are decoded as maps
+// and numbers as float64s.
+var JSON Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// persist appends to the Store the message published to the given persisted topics.
+func (m *manager[T]) persist(msg T, topics []string, seq uint64, now time.Time) {
+	data, err := m.opts.codec.Marshal(msg)
+	if err != nil {
+		m.fail(err)
+		return
+	}
+
+	if err := m.opts.store.Append(Record{Sequence: seq, Time: now, Topics: topics, Data: data}); err != nil {
+		m.fail(err)
+	}
+}
+
+// stored returns the entries from the Store with a sequence number greater than since,
+// published to topics matched by the given topic, which must be a string or a Pattern.
+func (m *manager[T]) stored(t Topic, since uint64) []entry[T] {
+	p, isPattern := t.(Pattern)
+	s, isString := t.(string)
+	if m.opts.store == nil || (!isPattern && !isString) {
+		return nil
+	}
+
+	var entries []entry[T]
+	err := m.opts.store.Read(since+1, func(r Record) bool {
+		var msg T
+		decoded := false
+
+		for _, rt := range r.Topics {
+			if (isString && rt != s) || (isPattern && !p.Match(rt)) {
+				continue
+			}
+
+			if !decoded {
+				if err := m.opts.codec.Unmarshal(r.Data, &msg); err != nil {
+					// a single bad record doesn't stop the Hub, so it is skipped
+					m.report(fmt.Errorf("hub: decoding stored record %d: %w", r.Sequence, err))
+					return true
+				}
+				decoded = true
+			}
+
+			entries = append(entries, entry[T]{msg: msg, topic: rt, seq: r.Sequence, time: r.Time})
+		}
+
+		return true
+	})
+	if err != nil {
+		m.fail(err)
+	}
+
+	return entries
+}
@@ -0,0 +1,263 @@
+package hub
+
+import "sync"
+
+type (
+	// SubscriptionOf is a binding of a Conn to some topics, with its own message counters. Pass
+	// a new Subscription when connecting the Conn, and the topics and the MessageCount of the
+	// command are bound to it, instead of replacing the Conn's settings. This way, different
+	// parts of the code can share a Conn, each with its own Subscription.
+	//
+	// The Conn receives a message of a topic once, even if multiple of its subscriptions have
+	// the topic, but the message counts towards the MessageCount of each of them.
+	// The Conn is disconnected from a topic once none of its subscriptions have the topic
+	// anymore, unless it was also connected to the topic without a Subscription.
+	//
+	// The zero value is ready to use. A Subscription must not be used for more than one command.
+	SubscriptionOf[T any] struct {
+		once sync.Once
+		// mu guards topics and messages, which are modified by the Hub.
+		mu       sync.Mutex
+		conn     ConnOf[T]
+		topics   map[Topic]counter
+		messages counter
+		used     bool
+
+		done       chan struct{}
+		cancel     chan struct{}
+		cancelOnce sync.Once
+	}
+
+	// Subscription is the SubscriptionOf for a Hub.
+	Subscription = SubscriptionOf[interface{}]
+)
+
+func (s *SubscriptionOf[T]) init() {
+	s.once.Do(func() {
+		s.done = make(chan struct{})
+		s.cancel = make(chan struct{})
+	})
+}
+
+// Cancel ends the subscription. It never blocks, so it can be called from the goroutine
+// receiving from the Conn even if the Hub is waiting for it to receive a message.
+func (s *SubscriptionOf[T]) Cancel() {
+	s.init()
+	s.cancelOnce.Do(func() {
+		close(s.cancel)
+	})
+}
+
+// Done returns a channel that is closed when the subscription ends, because it was canceled,
+// it has received its MessageCount or the Conn was disconnected from all its topics.
+func (s *SubscriptionOf[T]) Done() <-chan struct{} {
+	s.init()
+	return s.done
+}
+
+// Remaining returns the number of messages the subscription will still receive, or 0
+// if it isn't limited or it has ended.
+func (s *SubscriptionOf[T]) Remaining() Number {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Number(s.messages)
+}
+
+// Topics returns the topics of the subscription, in no particular order.
+func (s *SubscriptionOf[T]) Topics() []Topic {
+	select {
+	case <-s.Done():
+		return nil
+	default:
+		return s.bound()
+	}
+}
+
+func (s *SubscriptionOf[T]) bound() []Topic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topics := make([]Topic, 0, len(s.topics))
+	for t := range s.topics {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// Conn returns the Conn the subscription binds.
+func (s *SubscriptionOf[T]) Conn() ConnOf[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn
+}
+
+// Subscribe is a shortcut for sending a Connect command with a new Subscription to the Hub.
+// The Conn is created if it is nil.
+func (h HubOf[T]) Subscribe(c ConnOf[T], topics ...Topic) (ConnOf[T], *SubscriptionOf[T]) {
+	if c == nil {
+		c = make(ConnOf[T])
+	}
+	s := &SubscriptionOf[T]{}
+
+	h <- ConnectOf[T]{
+		Conn:         c,
+		Topics:       topics,
+		Subscription: s,
+	}
+
+	return c, s
+}
+
+// bind adds the topic to the subscription.
+func (s *SubscriptionOf[T]) bind(t Topic, tr *topicRef[T], messages Number) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.topics[t] = counter(messages)
+	if tr.subs == nil {
+		tr.subs = map[*SubscriptionOf[T]]struct{}{}
+	}
+	tr.subs[s] = struct{}{}
+}
+
+// remaining returns the number of messages the subscription will still receive from
+// the topic, or 0 if it isn't limited.
+func (s *SubscriptionOf[T]) remaining(t Topic) Number {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, total := s.topics[t], s.messages
+	if n == 0 || (total != 0 && total < n) {
+		return Number(total)
+	}
+	return Number(n)
+}
+
+// consume counts a message received from the topic. It returns whether the subscription
+// has received all the messages it should from the topic, and whether it has ended.
+func (s *SubscriptionOf[T]) consume(t Topic) (topicDone bool, done bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.topics[t]
+	topicDone = c.dec()
+	s.topics[t] = c
+
+	return topicDone, s.messages.dec()
+}
+
+// drop removes the topic from the subscription. It returns true if the subscription
+// has no topics left.
+func (s *SubscriptionOf[T]) drop(t Topic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.topics, t)
+	return len(s.topics) == 0
+}
+
+// finish ends the subscription, if it hasn't ended already.
+func (s *SubscriptionOf[T]) finish() {
+	s.init()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.mu.Lock()
+	s.messages = 0
+	s.mu.Unlock()
+
+	close(s.done)
+}
+
+// subscribe starts the subscription, after its topics were bound.
+func (m *manager[T]) subscribe(s *SubscriptionOf[T], c ConnOf[T], messages Number) {
+	s.init()
+
+	s.mu.Lock()
+	if s.used {
+		s.mu.Unlock()
+		panic("hub: Subscription used for more than one command")
+	}
+	s.used = true
+	s.conn = c
+	s.topics = map[Topic]counter{}
+	s.messages = counter(messages)
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-s.cancel:
+			select {
+			case m.cancels <- cancellation[T]{conn: c, sub: s}:
+			case <-m.stopped:
+			case <-s.done:
+			}
+		case <-m.stopped:
+		case <-s.done:
+		}
+	}()
+}
+
+// unsubscribe ends the subscription and disconnects the Conn from the topics
+// it isn't connected to anymore.
+func (m *manager[T]) unsubscribe(s *SubscriptionOf[T], reason CloseReason) {
+	for _, t := range s.bound() {
+		m.unbind(s, t, reason)
+	}
+	s.finish()
+}
+
+// unbind removes the topic from the subscription, and disconnects the Conn from it
+// if it isn't connected to it anymore.
+func (m *manager[T]) unbind(s *SubscriptionOf[T], t Topic, reason CloseReason) {
+	if s.drop(t) {
+		s.finish()
+	}
+
+	tr, ok := m.topics[t][s.conn]
+	if !ok {
+		return
+	}
+
+	delete(tr.subs, s)
+	if !tr.direct && len(tr.subs) == 0 {
+		m.removeConnFromTopic(t, s.conn, reason)
+	}
+}
+
+// release removes the topic from the subscriptions of the Conn, which was disconnected from it.
+func (m *manager[T]) release(t Topic, tr *topicRef[T]) {
+	for s := range tr.subs {
+		if s.drop(t) {
+			s.finish()
+		}
+	}
+	tr.subs = nil
+}
+
+// consume counts the message received by the Conn from the topic towards its subscriptions'
+// counters, and ends the subscriptions that have received all their messages.
+func (m *manager[T]) consume(t Topic, tr *topicRef[T]) {
+	var ended, unbound []*SubscriptionOf[T]
+	for s := range tr.subs {
+		topicDone, done := s.consume(t)
+		if topicDone {
+			unbound = append(unbound, s)
+		}
+		if done {
+			ended = append(ended, s)
+		}
+	}
+
+	for _, s := range unbound {
+		m.unbind(s, t, ReasonMessageCount)
+	}
+	for _, s := range ended {
+		m.unsubscribe(s, ReasonMessageCount)
+	}
+}
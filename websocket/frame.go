@@ -0,0 +1,254 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// The opcodes of the frames.
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+	// maxControlSize is the maximum payload size of a control frame.
+	maxControlSize = 125
+)
+
+// acceptGUID is appended to the key of the handshake to compute the accept value.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeError is a failure which closes the socket with the given code.
+type closeError struct {
+	code int
+	text string
+}
+
+func (e *closeError) Error() string {
+	return "websocket: " + e.text
+}
+
+var (
+	errProtocol    = &closeError{CloseProtocolError, "protocol error"}
+	errTooBig      = &closeError{CloseMessageTooBig, "message too big"}
+	errInvalidUTF8 = &closeError{CloseInvalidPayload, "invalid UTF-8"}
+)
+
+// readFrame reads a frame sent by a client, whose payload must be masked. The payload
+// is unmasked and it can't be larger than max.
+func readFrame(r *bufio.Reader, max int64) (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin, op = header[0]&finBit != 0, header[0]&0x0F
+	if header[0]&rsvBits != 0 || header[1]&maskBit == 0 {
+		return false, 0, nil, errProtocol
+	}
+	switch op {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if !fin || header[1]&0x7F > maxControlSize {
+			return false, 0, nil, errProtocol
+		}
+	default:
+		return false, 0, nil, errProtocol
+	}
+
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+		if size>>63 != 0 {
+			return false, 0, nil, errProtocol
+		}
+	}
+	if size > uint64(max) {
+		return false, 0, nil, errTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, op, payload, nil
+}
+
+// writeFrame writes an unmasked, final frame, as sent by a server.
+func writeFrame(w *bufio.Writer, op byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = finBit | op
+
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// closePayload returns the payload of a close frame with the given code and reason.
+// A reason which doesn't fit is cut after its last character that does, so it stays
+// valid UTF-8.
+func closePayload(code int, reason string) []byte {
+	if len(reason) > maxControlSize-2 {
+		n := maxControlSize - 2
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
+// parseClose returns the code of a close frame received from a client, or an error
+// if its payload is invalid.
+func parseClose(p []byte) (int, error) {
+	if len(p) == 0 {
+		return CloseNoStatus, nil
+	}
+	if len(p) == 1 {
+		return 0, errProtocol
+	}
+	if !utf8.Valid(p[2:]) {
+		return 0, errInvalidUTF8
+	}
+
+	code := int(binary.BigEndian.Uint16(p))
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011, code >= 3000 && code <= 4999:
+		return code, nil
+	default:
+		return 0, errProtocol
+	}
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the request has no Origin header, or its Origin's host
+// is the one the request was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// upgrade performs the opening handshake and hijacks the connection. If it fails,
+// it replies with an error and returns false.
+func upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) (net.Conn, *bufio.ReadWriter, bool) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "websocket: method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket: not a websocket handshake", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket: unsupported version", http.StatusUpgradeRequired)
+		return nil, nil, false
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		http.Error(w, "websocket: invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "websocket: origin not allowed", http.StatusForbidden)
+		return nil, nil, false
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: hijacking unsupported", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "websocket: "+err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	_, _ = rw.WriteString(acceptKey(key))
+	_, _ = rw.WriteString("\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, nil, false
+	}
+
+	return conn, rw, true
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	_, _ = io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,505 @@
+/*
+Package websocket is a WebSocket gateway to a Hub, implemented using only the standard library.
+
+Clients send JSON text messages to subscribe, unsubscribe and publish:
+
+	{"type": "subscribe", "id": "s1", "topics": ["news"], "patterns": ["orders/+"], "count": 10}
+	{"type": "unsubscribe", "id": "s1", "topics": ["news"]}
+	{"type": "publish", "topics": ["news"], "data": {"title": "Hello"}, "retain": true}
+
+Each subscription is a Conn, identified by the id the client chooses. Its topics are the given
+topics and patterns, or the default topic if there are none, and count is its MessageCount.
+An unsubscribe without topics ends the subscription. A publish without topics publishes
+to the default topic, and one without data is rejected.
+
+The server sends the messages received by the subscriptions, tells when a subscription
+ends and reports the invalid commands:
+
+	{"type": "message", "id": "s1", "topic": "news", "seq": 42, "data": {"title": "Hello"}}
+	{"type": "closed", "id": "s1", "reason": "message count reached"}
+	{"type": "error", "error": "websocket: unknown command type"}
+
+The topic and the sequence number are sent only if the Conns can receive EnvelopeOf values,
+as is the case for a Hub.
+*/
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tmaxmax/hub"
+)
+
+type (
+	// HandlerOf is an http.Handler which upgrades the requests to WebSockets and executes
+	// the commands sent on them on a Hub.
+	HandlerOf[T any] struct {
+		Hub hub.HubOf[T]
+		// The Policy and the QueueSize of the subscriptions' Conns. Each Conn has a queue, so
+		// the Hub never waits for slow sockets: if the Policy is Block, DisconnectOnFull is used.
+		Policy    hub.Policy
+		QueueSize hub.Number
+		// A ping is sent at each PingInterval, and sockets on which nothing is received for
+		// two intervals are closed. If it isn't positive, DefaultPingInterval is used.
+		PingInterval time.Duration
+		// Sockets on which larger messages are received are closed. If it isn't positive,
+		// DefaultMaxMessageSize is used.
+		MaxMessageSize int64
+		// CheckOrigin returns whether the request is accepted. If it is nil, the requests
+		// with an Origin header whose host isn't the request's host are rejected.
+		CheckOrigin func(*http.Request) bool
+	}
+
+	// Handler is the HandlerOf for a Hub.
+	Handler = HandlerOf[interface{}]
+
+	// command is a message received from a client.
+	command struct {
+		Type     string          `json:"type"`
+		ID       string          `json:"id"`
+		Topics   []string        `json:"topics"`
+		Patterns []string        `json:"patterns"`
+		Count    hub.Number      `json:"count"`
+		Data     json.RawMessage `json:"data"`
+		Retain   bool            `json:"retain"`
+	}
+
+	// event is a message sent to a client.
+	event struct {
+		Type     string          `json:"type"`
+		ID       string          `json:"id,omitempty"`
+		Topic    hub.Topic       `json:"topic,omitempty"`
+		Sequence uint64          `json:"seq,omitempty"`
+		Data     json.RawMessage `json:"data,omitempty"`
+		Reason   string          `json:"reason,omitempty"`
+		Error    string          `json:"error,omitempty"`
+	}
+
+	// frame is a frame waiting in the write queue of a socket.
+	frame struct {
+		op      byte
+		payload []byte
+	}
+
+	socket[T any] struct {
+		h        *HandlerOf[T]
+		conn     net.Conn
+		r        *bufio.Reader
+		w        *bufio.Writer
+		envelope bool
+		ping     time.Duration
+		// ctx is canceled when the socket is closed. The Conns are connected with it,
+		// so they are removed from the Hub.
+		ctx    context.Context
+		cancel context.CancelFunc
+		// out is the write queue of the socket.
+		out chan frame
+		// closing is closed after the close frame is queued, and written after it is written.
+		closing   chan struct{}
+		closeOnce sync.Once
+		written   chan struct{}
+
+		mu   sync.Mutex
+		subs map[string]*subscription[T]
+
+		wg sync.WaitGroup
+	}
+
+	subscription[T any] struct {
+		conn   hub.ConnOf[T]
+		status *hub.Status
+	}
+)
+
+// The close codes sent to the clients, as defined by RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	// DefaultPingInterval is the interval at which pings are sent when none is specified.
+	DefaultPingInterval = 30 * time.Second
+	// DefaultMaxMessageSize is the maximum size of the messages received when none is specified.
+	DefaultMaxMessageSize = 1 << 20
+	// closeTimeout is how long the client has to reply to a close frame.
+	closeTimeout = 5 * time.Second
+	// writeQueueSize is the capacity of the write queue of a socket.
+	writeQueueSize = 16
+)
+
+var (
+	errUnknownCommand = errors.New("websocket: unknown command type")
+	errMissingData    = errors.New("websocket: publish without data")
+)
+
+func (h *HandlerOf[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+
+	conn, rw, ok := upgrade(w, r, checkOrigin)
+	if !ok {
+		return
+	}
+
+	ping := h.PingInterval
+	if ping <= 0 {
+		ping = DefaultPingInterval
+	}
+
+	_, envelope := interface{}(hub.EnvelopeOf[T]{}).(T)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &socket[T]{
+		h:        h,
+		conn:     conn,
+		r:        rw.Reader,
+		w:        rw.Writer,
+		envelope: envelope,
+		ping:     ping,
+		ctx:      ctx,
+		cancel:   cancel,
+		out:      make(chan frame, writeQueueSize),
+		closing:  make(chan struct{}),
+		written:  make(chan struct{}),
+		subs:     map[string]*subscription[T]{},
+	}
+	s.serve()
+}
+
+func (s *socket[T]) serve() {
+	writerDone := make(chan struct{})
+	go func() {
+		s.write()
+		close(writerDone)
+	}()
+
+	err := s.read()
+
+	var ce *closeError
+	if errors.As(err, &ce) {
+		s.close(ce.code, ce.text)
+	}
+
+	// give the writer the chance to send the close frame
+	select {
+	case <-s.closing:
+		select {
+		case <-s.written:
+		case <-writerDone:
+		case <-time.After(closeTimeout):
+		}
+	default:
+	}
+
+	s.cancel()
+	_ = s.conn.Close()
+	<-writerDone
+	s.wg.Wait()
+}
+
+// read executes the commands received until the socket is closed.
+func (s *socket[T]) read() error {
+	max := s.h.MaxMessageSize
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+
+	var msg []byte
+	var msgOp byte
+
+	for {
+		select {
+		case <-s.closing:
+			// the deadline for the client's close frame is already set
+		default:
+			_ = s.conn.SetReadDeadline(time.Now().Add(2 * s.ping))
+		}
+
+		fin, op, payload, err := readFrame(s.r, max-int64(len(msg)))
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opPing:
+			s.send(frame{opPong, payload})
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code, err := parseClose(payload)
+			if err != nil {
+				return err
+			}
+			if code == CloseNoStatus {
+				code = CloseNormal
+			}
+			// reply to the client's close frame, unless it replies to the server's
+			s.close(code, "")
+			return nil
+		case opContinuation:
+			if msgOp == 0 {
+				return errProtocol
+			}
+			msg = append(msg, payload...)
+		default:
+			if msgOp != 0 {
+				return errProtocol
+			}
+			msgOp, msg = op, payload
+		}
+
+		if !fin {
+			continue
+		}
+
+		if msgOp == opBinary {
+			return &closeError{CloseUnsupportedData, "binary messages are not supported"}
+		}
+		if !utf8.Valid(msg) {
+			return errInvalidUTF8
+		}
+
+		select {
+		case <-s.closing:
+			// the commands received after closing are ignored
+		default:
+			if err := s.execute(msg); err != nil {
+				s.event(&event{Type: "error", Error: err.Error()})
+			}
+		}
+
+		msg, msgOp = nil, 0
+	}
+}
+
+func (s *socket[T]) execute(msg []byte) error {
+	var cmd command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return err
+	}
+
+	var topics []hub.Topic
+	for _, t := range cmd.Topics {
+		topics = append(topics, t)
+	}
+	for _, p := range cmd.Patterns {
+		topics = append(topics, hub.Pattern(p))
+	}
+
+	switch cmd.Type {
+	case "subscribe":
+		return s.subscribe(cmd.ID, topics, cmd.Count)
+	case "unsubscribe":
+		s.mu.Lock()
+		sub, ok := s.subs[cmd.ID]
+		s.mu.Unlock()
+
+		if !ok {
+			return errors.New("websocket: unknown subscription " + cmd.ID)
+		}
+		if len(topics) == 0 {
+			sub.status.Leave()
+			return nil
+		}
+		s.command(hub.DisconnectOf[T]{Conn: sub.conn, Topics: topics})
+		return nil
+	case "publish":
+		if cmd.Data == nil {
+			return errMissingData
+		}
+
+		var data T
+		if err := json.Unmarshal(cmd.Data, &data); err != nil {
+			return err
+		}
+		s.command(hub.MessageOf[T]{Message: data, Topics: topics, Retain: cmd.Retain})
+		return nil
+	default:
+		return errUnknownCommand
+	}
+}
+
+func (s *socket[T]) subscribe(id string, topics []hub.Topic, count hub.Number) error {
+	if id == "" {
+		return errors.New("websocket: missing subscription id")
+	}
+
+	s.mu.Lock()
+	if _, ok := s.subs[id]; ok {
+		s.mu.Unlock()
+		return errors.New("websocket: subscription " + id + " already exists")
+	}
+	sub := &subscription[T]{conn: make(hub.ConnOf[T]), status: &hub.Status{}}
+	s.subs[id] = sub
+	s.mu.Unlock()
+
+	policy := s.h.Policy
+	if policy == hub.Block {
+		policy = hub.DisconnectOnFull
+	}
+
+	s.wg.Add(1)
+	go s.forward(id, sub)
+
+	s.command(hub.ConnectOf[T]{
+		Conn:         sub.conn,
+		Topics:       topics,
+		MessageCount: count,
+		Policy:       policy,
+		QueueSize:    s.h.QueueSize,
+		Envelope:     s.envelope,
+		Context:      s.ctx,
+		Status:       sub.status,
+	})
+
+	return nil
+}
+
+// command sends the command to the Hub, unless the socket is closed meanwhile.
+func (s *socket[T]) command(cmd interface{}) {
+	select {
+	case s.h.Hub <- cmd:
+	case <-s.ctx.Done():
+	}
+}
+
+// forward sends the messages received by the subscription to the client, and then
+// tells why the subscription has ended.
+func (s *socket[T]) forward(id string, sub *subscription[T]) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-sub.conn:
+			if !ok {
+				s.ended(id, sub.status.Reason())
+				return
+			}
+
+			e := event{Type: "message", ID: id}
+			if s.envelope {
+				env := interface{}(msg).(hub.EnvelopeOf[T])
+				e.Topic, e.Sequence, msg = env.Topic, env.Sequence, env.Message
+			}
+
+			data, err := json.Marshal(msg)
+			if err != nil {
+				s.close(CloseInternalError, err.Error())
+				return
+			}
+			e.Data = data
+			s.event(&e)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// ended tells the client that the subscription has ended, or closes the socket if the
+// subscription has ended because of a failure.
+func (s *socket[T]) ended(id string, reason hub.CloseReason) {
+	s.mu.Lock()
+	delete(s.subs, id)
+	s.mu.Unlock()
+
+	switch reason {
+	case hub.ReasonQueueFull:
+		s.close(ClosePolicyViolation, reason.String())
+	case hub.ReasonHubClosed:
+		s.close(CloseGoingAway, reason.String())
+	case hub.ReasonContextDone:
+		// the socket is closed
+	default:
+		s.event(&event{Type: "closed", ID: id, Reason: reason.String()})
+	}
+}
+
+func (s *socket[T]) event(e *event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		s.close(CloseInternalError, err.Error())
+		return
+	}
+	s.send(frame{opText, data})
+}
+
+// send queues the frame, unless the socket is closing.
+func (s *socket[T]) send(f frame) {
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+
+	select {
+	case s.out <- f:
+	case <-s.closing:
+	case <-s.ctx.Done():
+	}
+}
+
+// close starts the closing handshake, if it hasn't started yet. The client has closeTimeout
+// to reply, after which the connection is closed.
+func (s *socket[T]) close(code int, reason string) {
+	s.closeOnce.Do(func() {
+		_ = s.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		close(s.closing)
+
+		go func() {
+			select {
+			case s.out <- frame{opClose, closePayload(code, reason)}:
+			case <-s.ctx.Done():
+			}
+		}()
+	})
+}
+
+// write writes the frames in the write queue and the pings, until the close frame is written.
+func (s *socket[T]) write() {
+	t := time.NewTicker(s.ping)
+	defer t.Stop()
+
+	for {
+		var f frame
+
+		select {
+		case f = <-s.out:
+		case <-t.C:
+			f = frame{opPing, nil}
+		case <-s.ctx.Done():
+			return
+		}
+
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.ping))
+		if err := writeFrame(s.w, f.op, f.payload); err != nil {
+			// the socket can't be closed cleanly anymore
+			s.cancel()
+			_ = s.conn.Close()
+			return
+		}
+
+		if f.op == opClose {
+			close(s.written)
+			return
+		}
+	}
+}
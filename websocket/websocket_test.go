@@ -0,0 +1,290 @@
+package websocket_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/tmaxmax/hub"
+	"github.com/tmaxmax/hub/internal/hubtest"
+	"github.com/tmaxmax/hub/websocket"
+)
+
+// client is a minimal WebSocket client.
+type client struct {
+	tb   testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(tb testing.TB, s *httptest.Server) *client {
+	tb.Helper()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		tb.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		tb.Fatalf("Expected the protocol to be switched, got %s", res.Status)
+	}
+	// the example from RFC 6455
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		tb.Fatalf("Invalid Sec-WebSocket-Accept %q", accept)
+	}
+
+	return &client{tb: tb, conn: conn, r: r}
+}
+
+func (c *client) write(op byte, masked bool, payload []byte) {
+	c.tb.Helper()
+
+	frame := []byte{0x80 | op, byte(len(payload))}
+	if len(payload) > 125 {
+		frame[1] = 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if _, err := c.conn.Write(frame); err != nil {
+		c.tb.Fatal(err)
+	}
+}
+
+func (c *client) send(cmd string) {
+	c.tb.Helper()
+	c.write(0x1, true, []byte(cmd))
+}
+
+// read returns the opcode and the payload of the next frame other than a ping.
+func (c *client) read() (byte, []byte) {
+	c.tb.Helper()
+
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			c.tb.Fatal(err)
+		}
+
+		size := int(header[1] & 0x7F)
+		if size == 126 {
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				c.tb.Fatal(err)
+			}
+			size = int(binary.BigEndian.Uint16(ext[:]))
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			c.tb.Fatal(err)
+		}
+
+		if op := header[0] & 0x0F; op != 0x9 {
+			return op, payload
+		}
+	}
+}
+
+func (c *client) expect(expected string) {
+	c.tb.Helper()
+
+	op, payload := c.read()
+	if op != 0x1 {
+		c.tb.Fatalf("Expected a text message, got a frame with opcode %d", op)
+	}
+
+	var got, want interface{}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		c.tb.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		c.tb.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		c.tb.Fatalf("Invalid message.\nExpected %s\nGot %s", expected, payload)
+	}
+}
+
+func (c *client) expectClose(code int) {
+	c.tb.Helper()
+
+	op, payload := c.read()
+	if op != 0x8 || len(payload) < 2 {
+		c.tb.Fatalf("Expected a close frame, got a frame with opcode %d and payload %q", op, payload)
+	}
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		c.tb.Fatalf("Expected close code %d, got %d (%s)", code, got, payload[2:])
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&websocket.Handler{Hub: h})
+	defer s.Close()
+
+	c := dial(t, s)
+	c.send(`{"type": "subscribe", "id": "s1", "topics": ["A"], "patterns": ["B/+"], "count": 2}`)
+	c.send(`{"type": "publish", "topics": ["A"], "data": "First"}`)
+	c.send(`{"type": "publish", "topics": ["C"], "data": "Second"}`)
+	c.send(`{"type": "publish", "topics": ["B/1"], "data": {"third": 3}}`)
+
+	c.expect(`{"type": "message", "id": "s1", "topic": "A", "seq": 1, "data": "First"}`)
+	c.expect(`{"type": "message", "id": "s1", "topic": "B/1", "seq": 3, "data": {"third": 3}}`)
+	c.expect(`{"type": "closed", "id": "s1", "reason": "message count reached"}`)
+
+	c.write(0x8, true, []byte{0x03, 0xE8})
+	c.expectClose(websocket.CloseNormal)
+
+	close(h)
+	<-done
+}
+
+func TestHandlerCommands(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&websocket.Handler{Hub: h})
+	defer s.Close()
+
+	c := dial(t, s)
+	c.send(`{"type": "subscribe", "id": "s1", "topics": ["A", "B"]}`)
+	c.send(`{"type": "subscribe", "id": "s1"}`)
+	c.expect(`{"type": "error", "error": "websocket: subscription s1 already exists"}`)
+
+	c.send(`{"type": "unsubscribe", "id": "s1", "topics": ["A"]}`)
+	c.send(`{"type": "publish", "topics": ["A"], "data": "First"}`)
+	c.send(`{"type": "publish", "topics": ["B"], "data": "Second"}`)
+	c.expect(`{"type": "message", "id": "s1", "topic": "B", "seq": 2, "data": "Second"}`)
+
+	c.send(`{"type": "unsubscribe", "id": "s1"}`)
+	c.expect(`{"type": "closed", "id": "s1", "reason": "left"}`)
+
+	c.send(`{"type": "dance"}`)
+	c.expect(`{"type": "error", "error": "websocket: unknown command type"}`)
+
+	c.send(`{"type": "publish", "topics": ["B"]}`)
+	c.expect(`{"type": "error", "error": "websocket: publish without data"}`)
+
+	close(h)
+	<-done
+}
+
+func TestHandlerClose(t *testing.T) {
+	h, done := hub.NewOf[string]()
+	s := httptest.NewServer(&websocket.HandlerOf[string]{Hub: h})
+	defer s.Close()
+
+	c := dial(t, s)
+	c.send(`{"type": "subscribe", "id": "s1"}`)
+	hubtest.WaitConns(t, h, 1)
+
+	// as the messages aren't envelopes, they have no topic nor sequence number
+	h.Send("First")
+	c.expect(`{"type": "message", "id": "s1", "data": "First"}`)
+
+	close(h)
+	<-done
+
+	c.expectClose(websocket.CloseGoingAway)
+}
+
+// unencodable is a message which can't be encoded, with a long error containing
+// multi-byte characters.
+type unencodable struct{}
+
+func (unencodable) MarshalJSON() ([]byte, error) {
+	return nil, errors.New(strings.Repeat("é", 100))
+}
+
+func TestHandlerCloseReason(t *testing.T) {
+	h, done := hub.NewOf[unencodable]()
+	s := httptest.NewServer(&websocket.HandlerOf[unencodable]{Hub: h})
+	defer s.Close()
+
+	c := dial(t, s)
+	c.send(`{"type": "subscribe", "id": "s1"}`)
+	hubtest.WaitConns(t, h, 1)
+
+	h.Send(unencodable{})
+
+	op, payload := c.read()
+	if op != 0x8 || len(payload) < 2 {
+		t.Fatalf("Expected a close frame, got a frame with opcode %d and payload %q", op, payload)
+	}
+	if code := int(binary.BigEndian.Uint16(payload)); code != websocket.CloseInternalError {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseInternalError, code)
+	}
+	// the reason is cut to fit in the control frame, but not in the middle of a character
+	if reason := payload[2:]; len(reason) > 123 || !utf8.Valid(reason) {
+		t.Fatalf("Invalid close reason %q", reason)
+	}
+
+	close(h)
+	<-done
+}
+
+func TestHandlerProtocolError(t *testing.T) {
+	h, done := hub.New()
+	s := httptest.NewServer(&websocket.Handler{Hub: h, MaxMessageSize: 64})
+	defer s.Close()
+
+	c := dial(t, s)
+	c.send(`{"type": "subscribe", "id": "s1"}`)
+	hubtest.WaitConns(t, h, 1)
+
+	c.write(0x1, false, []byte(`{}`))
+	c.expectClose(websocket.CloseProtocolError)
+	hubtest.WaitConns(t, h, 0)
+
+	c = dial(t, s)
+	c.send(strings.Repeat(" ", 65))
+	c.expectClose(websocket.CloseMessageTooBig)
+
+	c = dial(t, s)
+	c.write(0x2, true, []byte{0})
+	c.expectClose(websocket.CloseUnsupportedData)
+
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a request without handshake to be rejected, got %s", res.Status)
+	}
+
+	close(h)
+	<-done
+}